@@ -0,0 +1,82 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// AccessLogger writes one JSON object per line for each registry API request,
+// describing how it was routed.
+//
+// This is independent of klog and its verbosity so it can be shipped
+// to a log pipeline. A nil *AccessLogger discards entries.
+//
+// Use NewAccessLogger to instantiate
+type AccessLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewAccessLogger returns an AccessLogger writing to w
+func NewAccessLogger(w io.Writer) *AccessLogger {
+	return &AccessLogger{enc: json.NewEncoder(w)}
+}
+
+// accessLogEntry is the access log format, see docs/admin.md
+type accessLogEntry struct {
+	Time   string `json:"time"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	routeDecision
+	LatencySeconds float64 `json:"latencySeconds"`
+}
+
+// Log writes an entry for r, which was served according to d in latency
+func (a *AccessLogger) Log(r *http.Request, d routeDecision, latency time.Duration) {
+	if a == nil {
+		return
+	}
+	// signed URLs carry credentials in their query, which must not be logged
+	d.Redirect = stripQuery(d.Redirect)
+	d.BlobFillURL = stripQuery(d.BlobFillURL)
+	entry := accessLogEntry{
+		Time:           time.Now().UTC().Format(time.RFC3339Nano),
+		Method:         r.Method,
+		Path:           r.URL.Path,
+		routeDecision:  d,
+		LatencySeconds: latency.Seconds(),
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(entry); err != nil {
+		klog.ErrorS(err, "failed to write access log")
+	}
+}
+
+// stripQuery returns u without its query string
+func stripQuery(u string) string {
+	u, _, _ = strings.Cut(u, "?")
+	return u
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessLoggerNil(t *testing.T) {
+	var a *AccessLogger
+	// should not panic
+	a.Log(httptest.NewRequest("GET", "http://localhost:8080/v2/", nil), routeDecision{Status: http.StatusOK}, time.Second)
+}
+
+type errWriter struct{}
+
+func (e errWriter) Write(_ []byte) (int, error) {
+	return 0, errors.New("nope")
+}
+
+func TestAccessLoggerWriteError(t *testing.T) {
+	a := NewAccessLogger(errWriter{})
+	// should not panic, the error is logged
+	a.Log(httptest.NewRequest("GET", "http://localhost:8080/v2/", nil), routeDecision{Status: http.StatusOK}, time.Second)
+}
+
+func TestAccessLoggerSignedURLs(t *testing.T) {
+	buf := &bytes.Buffer{}
+	a := NewAccessLogger(buf)
+	const blobURL = "https://bucket.example/containers/images/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e"
+	a.Log(httptest.NewRequest("GET", "http://localhost:8080/v2/", nil), routeDecision{
+		Status:      http.StatusTemporaryRedirect,
+		Redirect:    blobURL + "?X-Amz-Signature=secret",
+		BlobFillURL: blobURL + "?Signature=secret&Key-Pair-Id=key",
+	}, time.Second)
+	entry := map[string]any{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("access log line is not JSON: %v", err)
+	}
+	for _, key := range []string{"redirect", "blobFillURL"} {
+		if entry[key] != blobURL {
+			t.Errorf("expected %q to be %v without its query, got: %v", key, blobURL, entry[key])
+		}
+	}
+}
+
+func TestAccessLogV2Handler(t *testing.T) {
+	const blobPath = "/v2/pause/blobs/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e"
+	const bucketURL = "https://prod-registry-k8s-io-eu-west-1.s3.dualstack.eu-west-1.amazonaws.com"
+	blobs := fakeBlobsChecker{
+		knownURLs: map[string]bool{
+			bucketURL + "/containers/images/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e": true,
+		},
+	}
+	configs, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	handler := makeV2Handler(newRouter(configs, &blobs), NewAccessLogger(buf))
+
+	// one line per request
+	r := httptest.NewRequest("GET", "http://localhost:8080"+blobPath, nil)
+	r.RemoteAddr = "35.180.1.1:888"
+	handler(httptest.NewRecorder(), r)
+	handler(httptest.NewRecorder(), httptest.NewRequest("HEAD", "http://localhost:8080/v2/", nil))
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 access log lines, got: %q", buf.String())
+	}
+
+	entry := map[string]any{}
+	if err := json.Unmarshal(lines[0], &entry); err != nil {
+		t.Fatalf("access log line is not JSON: %v", err)
+	}
+	expected := map[string]any{
+		"method":       "GET",
+		"path":         blobPath,
+		"status":       float64(http.StatusTemporaryRedirect),
+		"clientIP":     "35.180.1.1",
+		"cloud":        "AWS",
+		"region":       "eu-west-3",
+		"route":        routeS3Blob,
+		"backend":      "eu-west-1",
+		"redirect":     bucketURL + "/containers/images/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e",
+		"blobCacheHit": false,
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("expected %q to be %v, got: %v", key, value, entry[key])
+		}
+	}
+	if _, ok := entry["latencySeconds"].(float64); !ok {
+		t.Errorf("expected latencySeconds to be set, got: %v", entry["latencySeconds"])
+	}
+	if _, ok := entry["time"].(string); !ok {
+		t.Errorf("expected time to be set, got: %v", entry["time"])
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MakeAdminHandler returns the archeio admin HTTP handler
+//
+// This is intended to be served on a separate port from MakeHandler that is
+// not exposed to the public.
+//
+// router should be the same Router used with MakeHandler
+//
+// Endpoints should be documented in docs/admin.md
+func MakeAdminHandler(router *Router) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/explain", makeExplainHandler(router))
+	return mux
+}
+
+// makeExplainHandler serves Router.Explain for the ip and path query parameters
+func makeExplainHandler(router *Router) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		explanation, err := router.Explain(query.Get("ip"), query.Get("path"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		// this can only fail writing to the client, which we can't report
+		_ = enc.Encode(explanation)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs"
+)
+
+func TestMakeAdminHandlerMetrics(t *testing.T) {
+	configs, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	handler := MakeAdminHandler(mustNewRouter(t, configs))
+	// ensure at least one sample exists
+	recordRoute(routeUpstreamManifest, cloudcidrs.IPInfo{})
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "http://localhost:8081/metrics", nil))
+	response := recorder.Result()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status: %v, but got status: %v", http.StatusText(http.StatusOK), http.StatusText(response.StatusCode))
+	}
+	body, _ := io.ReadAll(response.Body)
+	if !strings.Contains(string(body), "archeio_requests_total") {
+		t.Fatalf("expected archeio metrics in response, got: %s", body)
+	}
+}
+
+func TestMakeAdminHandlerExplain(t *testing.T) {
+	configs, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	handler := MakeAdminHandler(newRouter(configs, &fakeBlobsChecker{}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "http://localhost:8081/explain?ip=35.180.1.1&path=/v2/pause/manifests/latest", nil))
+	response := recorder.Result()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status: %v, but got status: %v", http.StatusText(http.StatusOK), http.StatusText(response.StatusCode))
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("expected JSON content type, got: %q", contentType)
+	}
+	explanation := map[string]any{}
+	if err := json.NewDecoder(response.Body).Decode(&explanation); err != nil {
+		t.Fatalf("failed to decode explanation: %v", err)
+	}
+	if explanation["route"] != routeUpstreamManifest || explanation["region"] != "eu-west-3" || explanation["configHash"] != configs.Hash() {
+		t.Fatalf("unexpected explanation: %v", explanation)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "http://localhost:8081/explain?path=/v2/", nil))
+	if recorder.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected bad request without an ip, got: %v", recorder.Result().Status)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Backend types, see BucketConfig.Type
+const (
+	// an S3 bucket, or S3 compatible storage such as MinIO
+	BackendS3 = "s3"
+	// a GCS bucket, at https://storage.googleapis.com/$bucket
+	BackendGCS = "gcs"
+	// an Azure Blob Storage container, at https://$account.blob.core.windows.net/$container
+	BackendAzure = "azure"
+	// any HTTP server with blobs in the same layout as the buckets
+	BackendHTTP = "http"
+	// an OCI distribution registry, optionally with a repository prefix in the URL path
+	BackendOCI = "oci"
+)
+
+// Backend is a blob mirror that blob requests may be redirected to
+//
+// Blob existence checks use the shared blob existence cache, circuit breakers
+// and request limits, so backends only decide where blobs are.
+type Backend interface {
+	// Name identifies the backend in the config, metrics and logs
+	Name() string
+	// URL is the configured base URL of the backend
+	URL() string
+	// BlobURL returns where clients are redirected to for a blob
+	// given the repository name it was requested from
+	BlobURL(repo, digest string) string
+	// CheckURL returns the URL requested with HEAD to check if a blob exists
+	CheckURL(repo, digest string) string
+	// HealthURL returns the URL requested with HEAD to probe the backend's health
+	HealthURL() string
+	// SignURL returns rawURL, a BlobURL or CheckURL, signed for requests
+	// with method if the bucket is private, or unchanged otherwise
+	SignURL(ctx context.Context, method, rawURL string) (string, error)
+}
+
+// newBackend returns the Backend for bucket, which should already be validated
+func newBackend(bucket BucketConfig) Backend {
+	switch bucket.Type {
+	case BackendOCI:
+		// validation ensures this parses
+		u, _ := url.Parse(bucket.URL)
+		return &registryBackend{
+			name:     bucket.Name,
+			url:      bucket.URL,
+			endpoint: u.Scheme + "://" + u.Host,
+			prefix:   u.Path,
+		}
+	case BackendAzure:
+		return &objectBackend{
+			name: bucket.Name,
+			url:  bucket.URL,
+			// Get Container Properties, the closest equivalent of the bucket root
+			healthURL:      bucket.URL + "?restype=container",
+			redirectURL:    bucket.RedirectURL,
+			redirectSigner: newCDNSigner(bucket.CDNSigning),
+		}
+	default:
+		return &objectBackend{
+			name:           bucket.Name,
+			url:            bucket.URL,
+			healthURL:      bucket.URL + "/",
+			signer:         newURLSigner(bucket),
+			redirectURL:    bucket.RedirectURL,
+			redirectSigner: newCDNSigner(bucket.CDNSigning),
+		}
+	}
+}
+
+// objectBackend is object storage with blobs at blobPathPrefix, this is GCR's
+// GCS layout which geranos also uploads to S3
+//
+// The repository is not part of the layout, as blobs are shared by all of them.
+type objectBackend struct {
+	name      string
+	url       string
+	healthURL string
+	// signer is nil for public buckets
+	signer urlSigner
+	// redirectURL is where clients are redirected to instead of url if set,
+	// with URLs signed by redirectSigner instead of signer
+	redirectURL    string
+	redirectSigner urlSigner
+}
+
+func (b *objectBackend) Name() string { return b.name }
+
+func (b *objectBackend) URL() string { return b.url }
+
+func (b *objectBackend) BlobURL(_, digest string) string {
+	if b.redirectURL != "" {
+		return b.redirectURL + blobPathPrefix + digest
+	}
+	return b.url + blobPathPrefix + digest
+}
+
+func (b *objectBackend) CheckURL(_, digest string) string {
+	return b.url + blobPathPrefix + digest
+}
+
+func (b *objectBackend) HealthURL() string { return b.healthURL }
+
+func (b *objectBackend) SignURL(ctx context.Context, method, rawURL string) (string, error) {
+	signer := b.signer
+	if b.redirectURL != "" && strings.HasPrefix(rawURL, b.redirectURL+"/") {
+		signer = b.redirectSigner
+	}
+	if signer == nil {
+		return rawURL, nil
+	}
+	return signer.sign(ctx, method, rawURL)
+}
+
+// registryBackend is an OCI distribution registry mirroring the upstream
+// repositories, under prefix
+type registryBackend struct {
+	name     string
+	url      string
+	endpoint string
+	prefix   string
+}
+
+func (b *registryBackend) Name() string { return b.name }
+
+func (b *registryBackend) URL() string { return b.url }
+
+func (b *registryBackend) BlobURL(repo, digest string) string {
+	return b.endpoint + path.Join("/v2", b.prefix, repo, "blobs", digest)
+}
+
+func (b *registryBackend) CheckURL(repo, digest string) string {
+	return b.BlobURL(repo, digest)
+}
+
+func (b *registryBackend) HealthURL() string { return b.endpoint + "/v2/" }
+
+func (b *registryBackend) SignURL(_ context.Context, _, rawURL string) (string, error) {
+	return rawURL, nil
+}
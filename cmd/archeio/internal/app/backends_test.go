@@ -0,0 +1,113 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"testing"
+)
+
+func TestNewBackend(t *testing.T) {
+	const digest = "sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e"
+	testCases := []struct {
+		Name            string
+		Bucket          BucketConfig
+		ExpectedBlobURL string
+		// ExpectedCheckURL defaults to ExpectedBlobURL
+		ExpectedCheckURL  string
+		ExpectedHealthURL string
+	}{
+		{
+			Name:              "default",
+			Bucket:            BucketConfig{Name: "b", URL: "https://bucket.s3.us-east-1.amazonaws.com"},
+			ExpectedBlobURL:   "https://bucket.s3.us-east-1.amazonaws.com/containers/images/" + digest,
+			ExpectedHealthURL: "https://bucket.s3.us-east-1.amazonaws.com/",
+		},
+		{
+			Name:              "s3",
+			Bucket:            BucketConfig{Name: "b", Type: BackendS3, URL: "http://minio.example:9000/bucket"},
+			ExpectedBlobURL:   "http://minio.example:9000/bucket/containers/images/" + digest,
+			ExpectedHealthURL: "http://minio.example:9000/bucket/",
+		},
+		{
+			Name:              "redirect URL",
+			Bucket:            BucketConfig{Name: "b", URL: "https://bucket.s3.us-east-1.amazonaws.com", RedirectURL: "https://cdn.example"},
+			ExpectedBlobURL:   "https://cdn.example/containers/images/" + digest,
+			ExpectedCheckURL:  "https://bucket.s3.us-east-1.amazonaws.com/containers/images/" + digest,
+			ExpectedHealthURL: "https://bucket.s3.us-east-1.amazonaws.com/",
+		},
+		{
+			Name:              "gcs",
+			Bucket:            BucketConfig{Name: "b", Type: BackendGCS, URL: "https://storage.googleapis.com/bucket"},
+			ExpectedBlobURL:   "https://storage.googleapis.com/bucket/containers/images/" + digest,
+			ExpectedHealthURL: "https://storage.googleapis.com/bucket/",
+		},
+		{
+			Name:              "azure",
+			Bucket:            BucketConfig{Name: "b", Type: BackendAzure, URL: "https://account.blob.core.windows.net/container"},
+			ExpectedBlobURL:   "https://account.blob.core.windows.net/container/containers/images/" + digest,
+			ExpectedHealthURL: "https://account.blob.core.windows.net/container?restype=container",
+		},
+		{
+			Name:              "azure redirect URL",
+			Bucket:            BucketConfig{Name: "b", Type: BackendAzure, URL: "https://account.blob.core.windows.net/container", RedirectURL: "https://cdn.example"},
+			ExpectedBlobURL:   "https://cdn.example/containers/images/" + digest,
+			ExpectedCheckURL:  "https://account.blob.core.windows.net/container/containers/images/" + digest,
+			ExpectedHealthURL: "https://account.blob.core.windows.net/container?restype=container",
+		},
+		{
+			Name:              "http",
+			Bucket:            BucketConfig{Name: "b", Type: BackendHTTP, URL: "https://mirror.example/blobs"},
+			ExpectedBlobURL:   "https://mirror.example/blobs/containers/images/" + digest,
+			ExpectedHealthURL: "https://mirror.example/blobs/",
+		},
+		{
+			Name:              "oci",
+			Bucket:            BucketConfig{Name: "b", Type: BackendOCI, URL: "https://registry.example"},
+			ExpectedBlobURL:   "https://registry.example/v2/kube-proxy/blobs/" + digest,
+			ExpectedHealthURL: "https://registry.example/v2/",
+		},
+		{
+			Name:              "oci with prefix",
+			Bucket:            BucketConfig{Name: "b", Type: BackendOCI, URL: "https://registry.example/mirrors/k8s"},
+			ExpectedBlobURL:   "https://registry.example/v2/mirrors/k8s/kube-proxy/blobs/" + digest,
+			ExpectedHealthURL: "https://registry.example/v2/",
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			b := newBackend(tc.Bucket)
+			if b.Name() != tc.Bucket.Name || b.URL() != tc.Bucket.URL {
+				t.Errorf("unexpected name %q or URL %q", b.Name(), b.URL())
+			}
+			if u := b.BlobURL("kube-proxy", digest); u != tc.ExpectedBlobURL {
+				t.Errorf("expected blob URL %q, got: %q", tc.ExpectedBlobURL, u)
+			}
+			expectedCheckURL := tc.ExpectedCheckURL
+			if expectedCheckURL == "" {
+				expectedCheckURL = tc.ExpectedBlobURL
+			}
+			if u := b.CheckURL("kube-proxy", digest); u != expectedCheckURL {
+				t.Errorf("expected check URL %q, got: %q", expectedCheckURL, u)
+			}
+			if u := b.HealthURL(); u != tc.ExpectedHealthURL {
+				t.Errorf("expected health URL %q, got: %q", tc.ExpectedHealthURL, u)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// BlobCacheOptions configures the blob existence cache
+type BlobCacheOptions struct {
+	// MaxEntries bounds the number of cached blob URLs,
+	// the least recently used entries are evicted first
+	MaxEntries int
+	// PositiveTTL is how long blobs found to exist are cached
+	PositiveTTL time.Duration
+	// NegativeTTL is how long blobs found not to exist are cached,
+	// zero disables caching them
+	NegativeTTL time.Duration
+}
+
+// DefaultBlobCacheOptions returns the default BlobCacheOptions
+func DefaultBlobCacheOptions() BlobCacheOptions {
+	return BlobCacheOptions{
+		MaxEntries:  100000,
+		PositiveTTL: time.Hour,
+		NegativeTTL: time.Minute,
+	}
+}
+
+// Validate returns an error if o is not usable
+func (o BlobCacheOptions) Validate() error {
+	var errs []error
+	if o.MaxEntries < 1 {
+		errs = append(errs, errors.New("blob cache max entries must be at least 1"))
+	}
+	if o.PositiveTTL <= 0 {
+		errs = append(errs, errors.New("blob cache positive TTL must be positive"))
+	}
+	if o.NegativeTTL < 0 {
+		errs = append(errs, errors.New("blob cache negative TTL must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// blobCache is a size bounded LRU cache of blob existence, with separate
+// TTLs for blobs that exist and blobs that do not
+//
+// Use newBlobCache to instantiate
+type blobCache struct {
+	opts BlobCacheOptions
+	// now is time.Now, except in tests
+	now func() time.Time
+
+	mu sync.Mutex
+	// most recently used at the front
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type blobCacheEntry struct {
+	blobURL string
+	exists  bool
+	expires time.Time
+}
+
+// newBlobCache returns a blobCache, opts should already be validated
+func newBlobCache(opts BlobCacheOptions) *blobCache {
+	return &blobCache{
+		opts:    opts,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached existence of blobURL, with ok=false if it is not cached
+func (b *blobCache) Get(blobURL string) (exists, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, found := b.entries[blobURL]
+	if !found {
+		return false, false
+	}
+	entry := e.Value.(*blobCacheEntry)
+	if !b.now().Before(entry.expires) {
+		b.remove(e, blobCacheEvictExpired)
+		return false, false
+	}
+	b.lru.MoveToFront(e)
+	return entry.exists, true
+}
+
+// Put caches the existence of blobURL
+func (b *blobCache) Put(blobURL string, exists bool) {
+	ttl := b.opts.PositiveTTL
+	if !exists {
+		ttl = b.opts.NegativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry := &blobCacheEntry{blobURL: blobURL, exists: exists, expires: b.now().Add(ttl)}
+	if e, found := b.entries[blobURL]; found {
+		e.Value = entry
+		b.lru.MoveToFront(e)
+		return
+	}
+	b.entries[blobURL] = b.lru.PushFront(entry)
+	for b.lru.Len() > b.opts.MaxEntries {
+		b.remove(b.lru.Back(), blobCacheEvictCapacity)
+	}
+	blobCacheEntries.Set(float64(b.lru.Len()))
+}
+
+// remove evicts e for reason, b.mu must be held
+func (b *blobCache) remove(e *list.Element, reason string) {
+	b.lru.Remove(e)
+	delete(b.entries, e.Value.(*blobCacheEntry).blobURL)
+	blobCacheEvictions.WithLabelValues(reason).Inc()
+	blobCacheEntries.Set(float64(b.lru.Len()))
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestBlobCache returns a blobCache with a fake clock, advanced by the returned func
+func newTestBlobCache(opts BlobCacheOptions) (*blobCache, func(time.Duration)) {
+	b := newBlobCache(opts)
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+	return b, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestBlobCacheOptionsValidate(t *testing.T) {
+	testCases := []struct {
+		Name        string
+		Options     BlobCacheOptions
+		ExpectError bool
+	}{
+		{Name: "default", Options: DefaultBlobCacheOptions()},
+		{Name: "negative caching disabled", Options: BlobCacheOptions{MaxEntries: 1, PositiveTTL: time.Second}},
+		{Name: "zero value", Options: BlobCacheOptions{}, ExpectError: true},
+		{Name: "negative TTL", Options: BlobCacheOptions{MaxEntries: 1, PositiveTTL: time.Second, NegativeTTL: -time.Second}, ExpectError: true},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			err := tc.Options.Validate()
+			if err != nil != tc.ExpectError {
+				t.Fatalf("expected error: %v, got: %v", tc.ExpectError, err)
+			}
+		})
+	}
+}
+
+func TestBlobCache(t *testing.T) {
+	bc, _ := newTestBlobCache(DefaultBlobCacheOptions())
+	bc.Put("foo", true)
+	if exists, ok := bc.Get("foo"); !ok || !exists {
+		t.Fatal("Cache did not contain key we just put")
+	}
+	bc.Put("missing", false)
+	if exists, ok := bc.Get("missing"); !ok || exists {
+		t.Fatal("Cache did not contain negative key we just put")
+	}
+	if _, ok := bc.Get("bar"); ok {
+		t.Fatal("Cache contained key we did not put")
+	}
+	// updating an entry replaces it
+	bc.Put("missing", true)
+	if exists, ok := bc.Get("missing"); !ok || !exists {
+		t.Fatal("Cache did not update key we put again")
+	}
+}
+
+func TestBlobCacheTTL(t *testing.T) {
+	bc, advance := newTestBlobCache(BlobCacheOptions{
+		MaxEntries:  10,
+		PositiveTTL: time.Hour,
+		NegativeTTL: time.Minute,
+	})
+	expiredBefore := testutil.ToFloat64(blobCacheEvictions.WithLabelValues(blobCacheEvictExpired))
+	bc.Put("exists", true)
+	bc.Put("missing", false)
+	advance(time.Minute)
+	if _, ok := bc.Get("missing"); ok {
+		t.Fatal("expected negative entry to expire after NegativeTTL")
+	}
+	if _, ok := bc.Get("exists"); !ok {
+		t.Fatal("expected positive entry to outlive NegativeTTL")
+	}
+	advance(time.Hour)
+	if _, ok := bc.Get("exists"); ok {
+		t.Fatal("expected positive entry to expire after PositiveTTL")
+	}
+	if expired := testutil.ToFloat64(blobCacheEvictions.WithLabelValues(blobCacheEvictExpired)) - expiredBefore; expired != 2 {
+		t.Fatalf("expected two expired evictions, got: %v", expired)
+	}
+}
+
+func TestBlobCacheNegativeCachingDisabled(t *testing.T) {
+	bc, _ := newTestBlobCache(BlobCacheOptions{MaxEntries: 10, PositiveTTL: time.Hour})
+	bc.Put("missing", false)
+	if _, ok := bc.Get("missing"); ok {
+		t.Fatal("expected negative entry to not be cached")
+	}
+}
+
+func TestBlobCacheLRU(t *testing.T) {
+	bc, _ := newTestBlobCache(BlobCacheOptions{MaxEntries: 2, PositiveTTL: time.Hour})
+	capacityBefore := testutil.ToFloat64(blobCacheEvictions.WithLabelValues(blobCacheEvictCapacity))
+	bc.Put("a", true)
+	bc.Put("b", true)
+	// a is now the most recently used, so b is evicted next
+	bc.Get("a")
+	bc.Put("c", true)
+	if _, ok := bc.Get("b"); ok {
+		t.Fatal("expected least recently used entry to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := bc.Get(key); !ok {
+			t.Fatalf("expected %q to be cached", key)
+		}
+	}
+	if evicted := testutil.ToFloat64(blobCacheEvictions.WithLabelValues(blobCacheEvictCapacity)) - capacityBefore; evicted != 1 {
+		t.Fatalf("expected one capacity eviction, got: %v", evicted)
+	}
+}
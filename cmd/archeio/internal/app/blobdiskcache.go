@@ -0,0 +1,514 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// BlobDiskCacheOptions configures storing blobs on local disk and serving
+// them from archeio, instead of redirecting blob requests
+type BlobDiskCacheOptions struct {
+	// Dir is where blobs are stored, the blob disk cache is disabled if empty
+	Dir string
+	// MaxBytes bounds the total size of stored blobs,
+	// the least recently used blobs are evicted first
+	MaxBytes int64
+}
+
+// DefaultBlobDiskCacheOptions returns the default BlobDiskCacheOptions
+func DefaultBlobDiskCacheOptions() BlobDiskCacheOptions {
+	return BlobDiskCacheOptions{
+		MaxBytes: 100 << 30,
+	}
+}
+
+// Validate returns an error if o is not usable
+func (o BlobDiskCacheOptions) Validate() error {
+	if o.Dir != "" && o.MaxBytes < 1 {
+		return errors.New("blob disk cache max bytes must be at least 1")
+	}
+	return nil
+}
+
+// reSHA256Blob matches blob requests for sha256 digests, which are the
+// only blobs the disk cache can verify, and captures the digest
+var reSHA256Blob = regexp.MustCompile("^/v2/" + nameGrammar + "/blobs/(sha256:[a-f0-9]{64})$")
+
+// reSHA256BlobFile matches blob file names in the disk cache
+var reSHA256BlobFile = regexp.MustCompile("^sha256-[a-f0-9]{64}$")
+
+// blobDiskCacheTempPrefix prefixes blobs that are still being downloaded
+const blobDiskCacheTempPrefix = ".tmp-"
+
+// blobDiskCache is a size bounded LRU cache of verified blobs on local disk,
+// filled from wherever the blob request would otherwise be redirected
+//
+// Use newBlobDiskCache to instantiate
+type blobDiskCache struct {
+	opts     BlobDiskCacheOptions
+	registry *registryClient
+	// ctx is cancelled to abandon downloads, see blobDiskCache.shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+	// fills tracks downloads, which outlive the requests that started them
+	fills sync.WaitGroup
+
+	mu sync.Mutex
+	// filling are the downloads in progress by digest
+	filling map[string]*blobFill
+	// most recently used at the front
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+type diskBlob struct {
+	digest string
+	size   int64
+}
+
+// newBlobDiskCache returns a blobDiskCache with the blobs already in opts.Dir,
+// which is created if it does not exist
+func newBlobDiskCache(opts BlobDiskCacheOptions) (*blobDiskCache, error) {
+	err := os.MkdirAll(opts.Dir, 0o755)
+	var files []os.DirEntry
+	if err == nil {
+		files, err = os.ReadDir(opts.Dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob disk cache dir: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// blobs may be large, so we only bound waiting for the backend to respond
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &blobDiskCache{
+		opts:     opts,
+		registry: &registryClient{client: &http.Client{Transport: transport}},
+		ctx:      ctx,
+		cancel:   cancel,
+		filling:  map[string]*blobFill{},
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+	// resume with the existing blobs, the least recently modified first
+	type existingBlob struct {
+		diskBlob
+		modTime time.Time
+	}
+	existing := []existingBlob{}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, blobDiskCacheTempPrefix) {
+			// interrupted download
+			os.Remove(filepath.Join(opts.Dir, name))
+			continue
+		}
+		info, err := file.Info()
+		if err != nil || !reSHA256BlobFile.MatchString(name) || !info.Mode().IsRegular() {
+			continue
+		}
+		digest := strings.Replace(name, "-", ":", 1)
+		existing = append(existing, existingBlob{diskBlob{digest: digest, size: info.Size()}, info.ModTime()})
+	}
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].modTime.Before(existing[j].modTime)
+	})
+	for _, blob := range existing {
+		c.add(blob.diskBlob)
+	}
+	return c, nil
+}
+
+// path returns where the blob with digest is stored
+func (c *blobDiskCache) path(digest string) string {
+	return filepath.Join(c.opts.Dir, strings.Replace(digest, ":", "-", 1))
+}
+
+// contains returns true if the blob with digest is stored
+func (c *blobDiskCache) contains(digest string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[digest]
+	return ok
+}
+
+// open opens the stored blob with digest and marks it as recently used
+func (c *blobDiskCache) open(digest string) (*os.File, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[digest]
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(c.path(digest))
+	if err != nil {
+		// this should not happen unless the directory was modified
+		klog.ErrorS(err, "failed to open blob disk cache file", "digest", digest)
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return f, true
+}
+
+// add records a stored blob as the most recently used and evicts the
+// least recently used blobs to stay within opts.MaxBytes
+func (c *blobDiskCache) add(blob diskBlob) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[blob.digest] = c.lru.PushFront(blob)
+	c.size += blob.size
+	for c.size > c.opts.MaxBytes {
+		e := c.lru.Back()
+		evicted := e.Value.(diskBlob)
+		if err := os.Remove(c.path(evicted.digest)); err != nil {
+			klog.ErrorS(err, "failed to remove evicted blob disk cache file", "digest", evicted.digest)
+		}
+		c.remove(e)
+		klog.V(3).InfoS("evicted blob from disk cache", "digest", evicted.digest)
+	}
+	blobDiskCacheBytes.Set(float64(c.size))
+}
+
+// remove drops e from the index, c.mu must be held
+func (c *blobDiskCache) remove(e *list.Element) {
+	blob := e.Value.(diskBlob)
+	c.lru.Remove(e)
+	delete(c.entries, blob.digest)
+	c.size -= blob.size
+	blobDiskCacheBytes.Set(float64(c.size))
+}
+
+// blobFill is a download of a missing blob to the blob disk cache,
+// which clients are streamed from while it is written
+type blobFill struct {
+	// ready is closed once the blob is being written or the download failed
+	ready chan struct{}
+	// size is the blob size if known and -1 otherwise, set before ready is closed
+	size int64
+
+	mu sync.Mutex
+	// tempPath is the file the blob is written to until done
+	tempPath string
+	written  int64
+	// progress is closed and replaced whenever written or done change
+	progress chan struct{}
+	done     bool
+	err      error
+}
+
+func newBlobFill() *blobFill {
+	return &blobFill{ready: make(chan struct{}), size: -1, progress: make(chan struct{})}
+}
+
+// fill returns the download of the blob with digest from fillURL,
+// starting it unless it is in progress already
+func (c *blobDiskCache) fill(digest, fillURL string) *blobFill {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.filling[digest]; ok {
+		return f
+	}
+	f := newBlobFill()
+	c.filling[digest] = f
+	c.fills.Add(1)
+	go func() {
+		defer c.fills.Done()
+		err := c.download(c.ctx, f, digest, fillURL)
+		c.mu.Lock()
+		delete(c.filling, digest)
+		c.mu.Unlock()
+		if err != nil {
+			klog.V(2).InfoS("failed to fill blob disk cache", "url", stripQuery(fillURL), "error", err)
+			blobDiskCacheFills.WithLabelValues(blobDiskCacheFillError).Inc()
+			return
+		}
+		blobDiskCacheFills.WithLabelValues(blobDiskCacheFillSuccess).Inc()
+	}()
+	return f
+}
+
+// download writes the blob with digest from fillURL to a temporary file,
+// which is stored if it is verified, and finishes f with the result
+func (c *blobDiskCache) download(ctx context.Context, f *blobFill, digest, fillURL string) (err error) {
+	size := int64(0)
+	defer func() {
+		err = f.finish(err, func() error {
+			// under f.mu, so clients open the temporary file before it is moved
+			if err := os.Rename(f.tempPath, c.path(digest)); err != nil {
+				return err
+			}
+			c.add(diskBlob{digest: digest, size: size})
+			return nil
+		})
+	}()
+	resp, err := c.registry.get(ctx, fillURL, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &upstreamStatusError{status: resp.StatusCode}
+	}
+	if resp.ContentLength > c.opts.MaxBytes {
+		return fmt.Errorf("blob size %d exceeds the blob disk cache size", resp.ContentLength)
+	}
+	file, err := os.CreateTemp(c.opts.Dir, blobDiskCacheTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.tempPath = file.Name()
+	f.mu.Unlock()
+	f.size = resp.ContentLength
+	close(f.ready)
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(file, h, f), io.LimitReader(resp.Body, c.opts.MaxBytes+1))
+	if err = errors.Join(err, file.Close()); err != nil {
+		return err
+	}
+	if size > c.opts.MaxBytes {
+		return errors.New("blob exceeds the blob disk cache size")
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return fmt.Errorf("downloaded blob has digest %q", actual)
+	}
+	return nil
+}
+
+// Write records that p was written to the temporary file
+func (f *blobFill) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written += int64(len(p))
+	close(f.progress)
+	f.progress = make(chan struct{})
+	return len(p), nil
+}
+
+// finish completes f with err, running store first if err is nil,
+// and removes the temporary file unless it was stored
+//
+// This returns the result f was completed with.
+func (f *blobFill) finish(err error, store func() error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		err = store()
+	}
+	if err != nil && f.tempPath != "" {
+		os.Remove(f.tempPath)
+	}
+	f.done, f.err = true, err
+	close(f.progress)
+	select {
+	case <-f.ready:
+	default:
+		close(f.ready)
+	}
+	return err
+}
+
+// shutdown waits for downloads in progress until ctx is done,
+// and then abandons them
+func (c *blobDiskCache) shutdown(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		c.fills.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.cancel()
+		<-done
+	}
+}
+
+// Shutdown waits for blobs being downloaded to the blob disk cache, if enabled,
+// until ctx is done and then abandons them
+//
+// These downloads continue after the requests for them, so call this once
+// the server is shut down.
+func (rt *Router) Shutdown(ctx context.Context) {
+	if rt.blobDisk != nil {
+		rt.blobDisk.shutdown(ctx)
+	}
+}
+
+// serveDiskBlob serves the blob request r decided by d from the blob disk
+// cache, see Router.route
+//
+// If the blob is not stored, GET requests are streamed the blob while it is
+// downloaded from d.BlobFillURL, which happens once however many clients
+// request it, and HEAD requests are answered from d.BlobFillURL. Clients are
+// redirected to d.BlobFillURL, as when the blob disk cache is disabled, only
+// if this fails before anything was served.
+func (rt *Router) serveDiskBlob(w http.ResponseWriter, r *http.Request, rc *routingConfig, d routeDecision) routeDecision {
+	c := rt.blobDisk
+	// Router.route only decides to serve matching requests
+	digest := reSHA256Blob.FindStringSubmatch(r.URL.Path)[1]
+	d.BlobDiskCache = blobDiskCacheHit
+	f, ok := c.open(digest)
+	if !ok && d.Route == routeCachedBlob {
+		// evicted since it was routed, serve it as if the cache were disabled
+		d = rt.routeV2(r, rc)
+		d.BlobDiskCache = blobDiskCacheError
+		blobDiskCacheTotal.WithLabelValues(d.BlobDiskCache).Inc()
+		writeRouteDecision(w, r, d)
+		return d
+	}
+	if !ok {
+		d.BlobDiskCache = blobDiskCacheMiss
+		if r.Method == http.MethodHead {
+			d = c.serveHead(w, r, d, digest)
+		} else {
+			d = c.serveFill(w, r, d, digest)
+		}
+		blobDiskCacheTotal.WithLabelValues(d.BlobDiskCache).Inc()
+		return d
+	}
+	defer f.Close()
+	blobDiskCacheTotal.WithLabelValues(d.BlobDiskCache).Inc()
+	writeBlobHeaders(w, digest)
+	w.Header().Set("ETag", `"`+digest+`"`)
+	// handles HEAD, range requests and Content-Length
+	http.ServeContent(w, r, "", time.Time{}, f)
+	return d
+}
+
+// writeBlobHeaders sets the headers of blobs served from the blob disk cache
+func writeBlobHeaders(w http.ResponseWriter, digest string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+}
+
+// redirectFill serves the redirect to d.BlobFillURL, after failing to serve
+// the blob without it
+func redirectFill(w http.ResponseWriter, r *http.Request, d routeDecision) routeDecision {
+	d.BlobDiskCache = blobDiskCacheError
+	d.Status = http.StatusTemporaryRedirect
+	d.Redirect = d.BlobFillURL
+	writeRouteDecision(w, r, d)
+	return d
+}
+
+// serveHead answers a HEAD request for a missing blob from d.BlobFillURL,
+// without downloading it
+func (c *blobDiskCache) serveHead(w http.ResponseWriter, r *http.Request, d routeDecision, digest string) routeDecision {
+	resp, err := c.registry.head(r.Context(), d.BlobFillURL)
+	if err != nil {
+		klog.V(2).InfoS("failed to check blob for blob disk cache", "url", stripQuery(d.BlobFillURL), "error", err)
+		return redirectFill(w, r, d)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return redirectFill(w, r, d)
+	}
+	writeBlobHeaders(w, digest)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	return d
+}
+
+// serveFill streams a missing blob to the client while it is downloaded
+func (c *blobDiskCache) serveFill(w http.ResponseWriter, r *http.Request, d routeDecision, digest string) routeDecision {
+	fill := c.fill(digest, d.BlobFillURL)
+	select {
+	case <-fill.ready:
+	case <-r.Context().Done():
+		return d
+	}
+	fill.mu.Lock()
+	if fill.done {
+		fill.mu.Unlock()
+		if fill.err != nil {
+			return redirectFill(w, r, d)
+		}
+		// downloaded already, though it may have been evicted again
+		f, ok := c.open(digest)
+		if !ok {
+			return redirectFill(w, r, d)
+		}
+		defer f.Close()
+		writeBlobHeaders(w, digest)
+		http.ServeContent(w, r, "", time.Time{}, f)
+		return d
+	}
+	f, err := os.Open(fill.tempPath)
+	fill.mu.Unlock()
+	if err != nil {
+		klog.ErrorS(err, "failed to open blob disk cache download", "digest", digest)
+		return redirectFill(w, r, d)
+	}
+	defer f.Close()
+	writeBlobHeaders(w, digest)
+	if fill.size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(fill.size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	served := int64(0)
+	for {
+		fill.mu.Lock()
+		written, done, err, progress := fill.written, fill.done, fill.err, fill.progress
+		fill.mu.Unlock()
+		if served < written {
+			n, err := io.Copy(w, io.NewSectionReader(f, served, written-served))
+			served += n
+			if err != nil {
+				// the client went away, the download continues regardless
+				return d
+			}
+			_ = rc.Flush()
+			continue
+		}
+		if done {
+			if err != nil {
+				// too late to redirect, the client sees a short or corrupt blob
+				d.BlobDiskCache = blobDiskCacheError
+			}
+			return d
+		}
+		select {
+		case <-progress:
+		case <-r.Context().Done():
+			return d
+		}
+	}
+}
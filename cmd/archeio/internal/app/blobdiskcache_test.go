@@ -0,0 +1,704 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testBlobDigest(content string) string {
+	h := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// fakeBlobs serves blobs by digest from any repository, except that the
+// chunked repository omits Content-Length, the truncated repository
+// ends responses early, and the corrupt repository serves the wrong content
+type fakeBlobs struct {
+	*httptest.Server
+	blobs map[string]string
+	// requests counts blob requests
+	requests atomic.Int32
+}
+
+func newFakeBlobs(t *testing.T, blobs ...string) *fakeBlobs {
+	f := &fakeBlobs{blobs: map[string]string{}}
+	for _, blob := range blobs {
+		f.blobs[testBlobDigest(blob)] = blob
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.requests.Add(1)
+		blob, ok := f.blobs[path.Base(r.URL.Path)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch {
+		case strings.Contains(r.URL.Path, "/chunked/"):
+			_, _ = w.Write([]byte(blob))
+			w.(http.Flusher).Flush()
+		case strings.Contains(r.URL.Path, "/truncated/"):
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)+1))
+			_, _ = w.Write([]byte(blob))
+		case strings.Contains(r.URL.Path, "/corrupt/"):
+			_, _ = w.Write([]byte(blob + "!"))
+		default:
+			_, _ = w.Write([]byte(blob))
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestBlobDiskCacheOptionsValidate(t *testing.T) {
+	if err := DefaultBlobDiskCacheOptions().Validate(); err != nil {
+		t.Fatalf("unexpected error validating default options: %v", err)
+	}
+	if err := (BlobDiskCacheOptions{Dir: "blobs"}).Validate(); err == nil {
+		t.Fatal("expected error for zero max bytes")
+	}
+}
+
+func TestRouterBlobDiskCache(t *testing.T) {
+	blobA, blobB, tooLarge := "0123456789", "abcdef", "0123456789!"
+	digestA, digestB := testBlobDigest(blobA), testBlobDigest(blobB)
+	backend := newFakeBlobs(t, blobA, blobB, tooLarge)
+	rc := DefaultRegistryConfig()
+	rc.UpstreamRegistryEndpoint = backend.URL
+	rc.UpstreamRegistryPath = "images"
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	dir := t.TempDir()
+	// no blobs are in the buckets so they are all filled from upstream
+	router := newRouter(configs, &fakeBlobsChecker{})
+	router.blobDisk, err = newBlobDiskCache(BlobDiskCacheOptions{Dir: dir, MaxBytes: int64(len(blobA))})
+	if err != nil {
+		t.Fatalf("unexpected error creating blob disk cache: %v", err)
+	}
+	handler := MakeHandler(router, HandlerOptions{})
+
+	serve := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, "http://localhost:8080"+path, nil)
+		r.RemoteAddr = "127.0.0.1:8888"
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	expectBlob := func(w *httptest.ResponseRecorder, expectedStatus int, digest, expectedBody string, expectedRequests int32) {
+		t.Helper()
+		if w.Code != expectedStatus ||
+			w.Header().Get("Docker-Content-Digest") != digest ||
+			w.Header().Get("Content-Type") != "application/octet-stream" {
+			t.Fatalf("unexpected response: %d %v", w.Code, w.Header())
+		}
+		if body := w.Body.String(); body != expectedBody {
+			t.Fatalf("expected response body %q, got: %q", expectedBody, body)
+		}
+		if requests := backend.requests.Load(); requests != expectedRequests {
+			t.Fatalf("expected %d backend requests, got: %d", expectedRequests, requests)
+		}
+	}
+	expectRedirect := func(w *httptest.ResponseRecorder, expectedURL string) {
+		t.Helper()
+		if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != expectedURL {
+			t.Fatalf("expected redirect to %q, got: %d %q", expectedURL, w.Code, w.Header().Get("Location"))
+		}
+	}
+	// expectFill expects a GET of blobPath to be streamed the blob while it
+	// is downloaded, and waits for the download to be recorded
+	expectFill := func(blobPath, digest, expectedBody string, expectedRequests int32) {
+		t.Helper()
+		expectBlob(serve(http.MethodGet, blobPath, nil), http.StatusOK, digest, expectedBody, expectedRequests)
+		router.blobDisk.fills.Wait()
+	}
+	errorsBefore := testutil.ToFloat64(blobDiskCacheTotal.WithLabelValues(blobDiskCacheError))
+	fillErrorsBefore := testutil.ToFloat64(blobDiskCacheFills.WithLabelValues(blobDiskCacheFillError))
+
+	// blobs are streamed while they are downloaded and then served from disk
+	pathA := "/v2/pause/blobs/" + digestA
+	expectFill(pathA, digestA, blobA, 1)
+	if !router.blobDisk.contains(digestA) {
+		t.Fatal("expected streamed blob to be stored")
+	}
+	expectBlob(serve(http.MethodGet, pathA, nil), http.StatusOK, digestA, blobA, 1)
+	expectBlob(serve(http.MethodGet, pathA, http.Header{"Range": {"bytes=2-4"}}), http.StatusPartialContent, digestA, "234", 1)
+	w := serve(http.MethodHead, pathA, nil)
+	expectBlob(w, http.StatusOK, digestA, "", 1)
+	if w.Header().Get("Content-Length") != strconv.Itoa(len(blobA)) {
+		t.Fatalf("unexpected Content-Length: %q", w.Header().Get("Content-Length"))
+	}
+	// from any repository
+	expectBlob(serve(http.MethodGet, "/v2/other/blobs/"+digestA, nil), http.StatusOK, digestA, blobA, 1)
+	// HEAD requests for missing blobs are answered from the backend without downloading them
+	w = serve(http.MethodHead, "/v2/pause/blobs/"+digestB, nil)
+	expectBlob(w, http.StatusOK, digestB, "", 2)
+	if w.Header().Get("Content-Length") != strconv.Itoa(len(blobB)) {
+		t.Fatalf("unexpected Content-Length: %q", w.Header().Get("Content-Length"))
+	}
+	router.blobDisk.fills.Wait()
+	if router.blobDisk.contains(digestB) {
+		t.Fatal("expected HEAD not to download the blob")
+	}
+	// or redirected if the backend does not have them
+	missingPath := "/v2/missing/blobs/sha256:" + strings.Repeat("0", 64)
+	expectRedirect(serve(http.MethodHead, missingPath, nil), backend.URL+"/v2/images"+strings.TrimPrefix(missingPath, "/v2"))
+
+	// explaining reports stored blobs without serving them
+	explanation, err := router.Explain("127.0.0.1", pathA)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if explanation.Status != http.StatusOK || explanation.Route != routeCachedBlob || explanation.ClientIP != "127.0.0.1" {
+		t.Fatalf("unexpected explanation: %+v", explanation)
+	}
+	// and where missing blobs would be filled from without downloading them
+	explanation, err = router.Explain("127.0.0.1", "/v2/pause/blobs/"+digestB)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if explanation.Status != http.StatusOK || explanation.Route != routeS3Fallback ||
+		explanation.Redirect != "" || explanation.BlobFillURL != backend.URL+"/v2/images/pause/blobs/"+digestB ||
+		backend.requests.Load() != 3 {
+		t.Fatalf("unexpected explanation: %+v", explanation)
+	}
+
+	// the least recently used blobs are evicted to stay within the size limit
+	expectFill("/v2/pause/blobs/"+digestB, digestB, blobB, 4)
+	if _, err := os.Stat(filepath.Join(dir, strings.Replace(digestA, ":", "-", 1))); !os.IsNotExist(err) {
+		t.Fatalf("expected evicted blob to be removed, got: %v", err)
+	}
+	if bytes := testutil.ToFloat64(blobDiskCacheBytes); bytes != float64(len(blobB)) {
+		t.Fatalf("unexpected blob disk cache bytes: %v", bytes)
+	}
+	expectFill(pathA, digestA, blobA, 5)
+
+	// blobs that cannot be downloaded are redirected
+	for _, blobPath := range []string{
+		missingPath,
+		"/v2/pause/blobs/" + testBlobDigest(tooLarge),
+	} {
+		// and downloading them is tried again on the next request
+		for i := 0; i < 2; i++ {
+			expectRedirect(serve(http.MethodGet, blobPath, nil), backend.URL+"/v2/images"+strings.TrimPrefix(blobPath, "/v2"))
+			router.blobDisk.fills.Wait()
+		}
+	}
+	// unless they fail once streaming started, which clients detect
+	for _, tc := range []struct {
+		path, digest, body string
+	}{
+		{"/v2/chunked/blobs/" + testBlobDigest(tooLarge), testBlobDigest(tooLarge), tooLarge},
+		{"/v2/truncated/blobs/" + digestB, digestB, blobB},
+		{"/v2/corrupt/blobs/" + digestB, digestB, blobB + "!"},
+	} {
+		for i := 0; i < 2; i++ {
+			// the download may fail before streaming, which is redirected
+			w := serve(http.MethodGet, tc.path, nil)
+			if w.Code == http.StatusTemporaryRedirect {
+				expectRedirect(w, backend.URL+"/v2/images"+strings.TrimPrefix(tc.path, "/v2"))
+			} else if w.Code != http.StatusOK || w.Body.String() != tc.body {
+				t.Fatalf("unexpected response for %s: %d %q", tc.path, w.Code, w.Body.String())
+			}
+			router.blobDisk.fills.Wait()
+			if router.blobDisk.contains(tc.digest) {
+				t.Fatalf("expected %s not to be stored", tc.path)
+			}
+		}
+	}
+	if requests := backend.requests.Load(); requests != 15 {
+		t.Fatalf("expected 15 backend requests, got: %d", requests)
+	}
+	if errors := testutil.ToFloat64(blobDiskCacheFills.WithLabelValues(blobDiskCacheFillError)) - fillErrorsBefore; errors != 10 {
+		t.Fatalf("expected 10 blob disk cache fill errors, got: %v", errors)
+	}
+	if errors := testutil.ToFloat64(blobDiskCacheTotal.WithLabelValues(blobDiskCacheError)) - errorsBefore; errors != 11 {
+		t.Fatalf("expected 11 blob disk cache errors, got: %v", errors)
+	}
+	// but chunked blobs within the size limit are stored
+	expectFill("/v2/chunked/blobs/"+digestB, digestB, blobB, 16)
+	expectBlob(serve(http.MethodGet, "/v2/chunked/blobs/"+digestB, nil), http.StatusOK, digestB, blobB, 16)
+
+	// blobs removed after routing are redirected
+	if err := os.Remove(router.blobDisk.path(digestB)); err != nil {
+		t.Fatalf("unexpected error removing blob: %v", err)
+	}
+	expectRedirect(serve(http.MethodGet, "/v2/pause/blobs/"+digestB, nil), backend.URL+"/v2/images/pause/blobs/"+digestB)
+	if router.blobDisk.contains(digestB) {
+		t.Fatal("expected removed blob to be dropped from the blob disk cache")
+	}
+
+	// other blobs and requests are still redirected
+	unsupportedDigest := "sha512:" + strings.Repeat("0", 128)
+	expectRedirect(serve(http.MethodGet, "/v2/pause/blobs/"+unsupportedDigest, nil), backend.URL+"/v2/images/pause/blobs/"+unsupportedDigest)
+	expectRedirect(serve(http.MethodGet, "/v2/pause/manifests/3.9", nil), backend.URL+"/v2/images/pause/manifests/3.9")
+	// including routing errors, which do not apply to stored blobs
+	invalidClientIP := http.Header{"X-Forwarded-For": {"invalid"}}
+	if w := serve(http.MethodGet, pathA, invalidClientIP); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid client IP to be rejected, got: %d", w.Code)
+	}
+	expectFill(pathA, digestA, blobA, 17)
+	expectBlob(serve(http.MethodGet, pathA, invalidClientIP), http.StatusOK, digestA, blobA, 17)
+}
+
+func TestNewBlobDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	blobs := []string{"oldest", "older", "newest"}
+	now := time.Now()
+	for i, blob := range blobs {
+		name := filepath.Join(dir, strings.Replace(testBlobDigest(blob), ":", "-", 1))
+		if err := os.WriteFile(name, []byte(blob), 0o644); err != nil {
+			t.Fatalf("unexpected error writing blob: %v", err)
+		}
+		modTime := now.Add(time.Duration(i-len(blobs)) * time.Hour)
+		if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatalf("unexpected error setting blob time: %v", err)
+		}
+	}
+	for _, name := range []string{".tmp-123", "unrelated"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0o644); err != nil {
+			t.Fatalf("unexpected error writing file: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, strings.Replace(testBlobDigest("dir"), ":", "-", 1)), 0o755); err != nil {
+		t.Fatalf("unexpected error creating dir: %v", err)
+	}
+
+	// existing blobs are loaded and the oldest are evicted to fit
+	c, err := newBlobDiskCache(BlobDiskCacheOptions{Dir: dir, MaxBytes: int64(len("older") + len("newest"))})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, blob := range blobs {
+		if expected := blob != "oldest"; c.contains(testBlobDigest(blob)) != expected {
+			t.Fatalf("expected stored %q to be %v", blob, expected)
+		}
+	}
+	if c.contains(testBlobDigest("dir")) {
+		t.Fatal("expected directories to be ignored")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".tmp-123")); !os.IsNotExist(err) {
+		t.Fatalf("expected interrupted download to be removed, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unrelated")); err != nil {
+		t.Fatalf("expected unrelated file to be kept, got: %v", err)
+	}
+
+	// files removed from disk are still evicted from the index
+	if err := os.Remove(c.path(testBlobDigest("older"))); err != nil {
+		t.Fatalf("unexpected error removing blob: %v", err)
+	}
+	c.add(diskBlob{digest: testBlobDigest("added"), size: int64(len("added"))})
+	if c.contains(testBlobDigest("older")) {
+		t.Fatal("expected least recently used blob to be evicted")
+	}
+
+	// the dir must be usable
+	if _, err := newBlobDiskCache(BlobDiskCacheOptions{Dir: filepath.Join(dir, "unrelated"), MaxBytes: 1}); err == nil {
+		t.Fatal("expected error for file as blob disk cache dir")
+	}
+	configs, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	opts := DefaultRouterOptions()
+	opts.BlobDiskCache.Dir = filepath.Join(dir, "unrelated")
+	if _, err := NewRouter(configs, opts); err == nil {
+		t.Fatal("expected error creating router with file as blob disk cache dir")
+	}
+	opts.BlobDiskCache.Dir = dir
+	if router, err := NewRouter(configs, opts); err != nil || router.blobDisk == nil {
+		t.Fatalf("expected router with blob disk cache, got error: %v", err)
+	}
+}
+
+func TestBlobDiskCacheDownloadErrors(t *testing.T) {
+	blob := "blob"
+	digest := testBlobDigest(blob)
+	backend := newFakeBlobs(t, blob)
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	testCases := []struct {
+		Name  string
+		URL   string
+		Setup func(t *testing.T, c *blobDiskCache)
+	}{
+		{
+			Name: "unreachable",
+			URL:  unreachable.URL + "/v2/images/pause/blobs/" + digest,
+		},
+		{
+			Name: "missing dir",
+			URL:  backend.URL + "/v2/images/pause/blobs/" + digest,
+			Setup: func(t *testing.T, c *blobDiskCache) {
+				c.opts.Dir = filepath.Join(c.opts.Dir, "missing")
+			},
+		},
+		{
+			Name: "blob path is a dir",
+			URL:  backend.URL + "/v2/images/pause/blobs/" + digest,
+			Setup: func(t *testing.T, c *blobDiskCache) {
+				if err := os.MkdirAll(filepath.Join(c.path(digest), "dir"), 0o755); err != nil {
+					t.Fatalf("unexpected error creating dir: %v", err)
+				}
+			},
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			c, err := newBlobDiskCache(BlobDiskCacheOptions{Dir: t.TempDir(), MaxBytes: 100})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.Setup != nil {
+				tc.Setup(t, c)
+			}
+			f := newBlobFill()
+			if err := c.download(context.Background(), f, digest, tc.URL); err == nil || f.err != err || !f.done {
+				t.Fatalf("expected the download to finish with an error, got: %v", err)
+			}
+			if c.contains(digest) {
+				t.Fatal("expected blob not to be stored")
+			}
+		})
+	}
+}
+
+func TestBlobDiskCacheConcurrentFill(t *testing.T) {
+	blob := "0123456789"
+	digest := testBlobDigest(blob)
+	release := make(chan struct{})
+	var requests atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		_, _ = w.Write([]byte(blob[:5]))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte(blob[5:]))
+	}))
+	t.Cleanup(backend.Close)
+	c, err := newBlobDiskCache(BlobDiskCacheOptions{Dir: t.TempDir(), MaxBytes: 100})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := routeDecision{BlobFillURL: backend.URL + "/v2/pause/blobs/" + digest}
+
+	// every client is streamed from the same download as it is written
+	responses := make(chan *httptest.ResponseRecorder, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			c.serveFill(w, httptest.NewRequest(http.MethodGet, "http://localhost:8080/v2/pause/blobs/"+digest, nil), d, digest)
+			responses <- w
+		}()
+	}
+	// wait for the first half of the blob to be written
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c.mu.Lock()
+		f := c.filling[digest]
+		c.mu.Unlock()
+		if f != nil {
+			f.mu.Lock()
+			written := f.written
+			f.mu.Unlock()
+			if written == 5 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the download to start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		w := <-responses
+		if w.Code != http.StatusOK || w.Body.String() != blob ||
+			w.Header().Get("Content-Length") != strconv.Itoa(len(blob)) || w.Header().Get("Docker-Content-Digest") != digest {
+			t.Fatalf("unexpected response: %d %v %q", w.Code, w.Header(), w.Body.String())
+		}
+	}
+	c.fills.Wait()
+	if requests.Load() != 1 || !c.contains(digest) {
+		t.Fatalf("expected one download of the blob to be stored, got %d requests", requests.Load())
+	}
+}
+
+// failingResponseWriter fails writes, as when the client went away
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (f failingResponseWriter) Write(_ []byte) (int, error) {
+	return 0, errors.New("client went away")
+}
+
+// failingFillResponseWriter fails fill once the client was served some of it
+type failingFillResponseWriter struct {
+	*httptest.ResponseRecorder
+	fill *blobFill
+}
+
+func (f failingFillResponseWriter) Write(p []byte) (int, error) {
+	_ = f.fill.finish(errors.New("nope"), nil)
+	return f.ResponseRecorder.Write(p)
+}
+
+// cancellingResponseWriter cancels the request once the response is started
+type cancellingResponseWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (c cancellingResponseWriter) WriteHeader(code int) {
+	c.ResponseRecorder.WriteHeader(code)
+	c.cancel()
+}
+
+func TestBlobDiskCacheServeFill(t *testing.T) {
+	blob := "blob"
+	digest := testBlobDigest(blob)
+	const fillURL = "https://bucket.example/blob"
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	// the client goes away only once the download started
+	streaming, cancelStreaming := context.WithCancel(context.Background())
+	t.Cleanup(cancelStreaming)
+	testCases := []struct {
+		Name string
+		// Setup returns the download clients are served from
+		Setup          func(t *testing.T, c *blobDiskCache) *blobFill
+		Context        context.Context
+		Writer         func(w *httptest.ResponseRecorder, f *blobFill) http.ResponseWriter
+		ExpectedStatus int
+		ExpectedBody   string
+		ExpectedResult string
+	}{
+		{
+			Name: "download failed",
+			Setup: func(t *testing.T, c *blobDiskCache) *blobFill {
+				f := newBlobFill()
+				_ = f.finish(errors.New("nope"), nil)
+				return f
+			},
+			ExpectedStatus: http.StatusTemporaryRedirect,
+			ExpectedResult: blobDiskCacheError,
+		},
+		{
+			Name: "downloaded",
+			Setup: func(t *testing.T, c *blobDiskCache) *blobFill {
+				if err := os.WriteFile(c.path(digest), []byte(blob), 0o644); err != nil {
+					t.Fatalf("unexpected error writing blob: %v", err)
+				}
+				c.add(diskBlob{digest: digest, size: int64(len(blob))})
+				f := newBlobFill()
+				_ = f.finish(nil, func() error { return nil })
+				return f
+			},
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   blob,
+			ExpectedResult: blobDiskCacheMiss,
+		},
+		{
+			Name: "downloaded and evicted",
+			Setup: func(t *testing.T, c *blobDiskCache) *blobFill {
+				f := newBlobFill()
+				_ = f.finish(nil, func() error { return nil })
+				return f
+			},
+			ExpectedStatus: http.StatusTemporaryRedirect,
+			ExpectedResult: blobDiskCacheError,
+		},
+		{
+			Name: "missing temporary file",
+			Setup: func(t *testing.T, c *blobDiskCache) *blobFill {
+				f := newBlobFill()
+				f.tempPath = filepath.Join(c.opts.Dir, "missing")
+				close(f.ready)
+				return f
+			},
+			ExpectedStatus: http.StatusTemporaryRedirect,
+			ExpectedResult: blobDiskCacheError,
+		},
+		{
+			Name: "failed while streaming",
+			Setup: func(t *testing.T, c *blobDiskCache) *blobFill {
+				return newTestBlobFill(t, c, blob[:2])
+			},
+			Writer: func(w *httptest.ResponseRecorder, f *blobFill) http.ResponseWriter {
+				return failingFillResponseWriter{w, f}
+			},
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   blob[:2],
+			ExpectedResult: blobDiskCacheError,
+		},
+		{
+			Name: "client gone before the download started",
+			Setup: func(t *testing.T, c *blobDiskCache) *blobFill {
+				return newBlobFill()
+			},
+			Context:        cancelled,
+			ExpectedStatus: http.StatusOK,
+			ExpectedResult: blobDiskCacheMiss,
+		},
+		{
+			Name: "client gone while streaming",
+			Setup: func(t *testing.T, c *blobDiskCache) *blobFill {
+				return newTestBlobFill(t, c, "")
+			},
+			Context: streaming,
+			Writer: func(w *httptest.ResponseRecorder, _ *blobFill) http.ResponseWriter {
+				return cancellingResponseWriter{w, cancelStreaming}
+			},
+			ExpectedStatus: http.StatusOK,
+			ExpectedResult: blobDiskCacheMiss,
+		},
+		{
+			Name: "client write fails",
+			Setup: func(t *testing.T, c *blobDiskCache) *blobFill {
+				return newTestBlobFill(t, c, blob)
+			},
+			Writer: func(w *httptest.ResponseRecorder, _ *blobFill) http.ResponseWriter {
+				return failingResponseWriter{w}
+			},
+			ExpectedStatus: http.StatusOK,
+			ExpectedResult: blobDiskCacheMiss,
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			c, err := newBlobDiskCache(BlobDiskCacheOptions{Dir: t.TempDir(), MaxBytes: 100})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			f := tc.Setup(t, c)
+			c.filling[digest] = f
+			r := httptest.NewRequest(http.MethodGet, "http://localhost:8080/v2/pause/blobs/"+digest, nil)
+			if tc.Context != nil {
+				r = r.WithContext(tc.Context)
+			}
+			recorder := httptest.NewRecorder()
+			var w http.ResponseWriter = recorder
+			if tc.Writer != nil {
+				w = tc.Writer(recorder, f)
+			}
+			d := c.serveFill(w, r, routeDecision{BlobFillURL: fillURL, BlobDiskCache: blobDiskCacheMiss}, digest)
+			if recorder.Code != tc.ExpectedStatus || d.BlobDiskCache != tc.ExpectedResult {
+				t.Fatalf("unexpected response: %d %+v", recorder.Code, d)
+			}
+			if tc.ExpectedStatus == http.StatusTemporaryRedirect {
+				if recorder.Header().Get("Location") != fillURL {
+					t.Fatalf("expected redirect to %q, got: %q", fillURL, recorder.Header().Get("Location"))
+				}
+			} else if recorder.Body.String() != tc.ExpectedBody {
+				t.Fatalf("expected body %q, got: %q", tc.ExpectedBody, recorder.Body.String())
+			}
+		})
+	}
+}
+
+// newTestBlobFill returns a download in progress that has written written
+func newTestBlobFill(t *testing.T, c *blobDiskCache, written string) *blobFill {
+	f := newBlobFill()
+	f.tempPath = filepath.Join(c.opts.Dir, blobDiskCacheTempPrefix+"test")
+	if err := os.WriteFile(f.tempPath, []byte(written), 0o644); err != nil {
+		t.Fatalf("unexpected error writing download: %v", err)
+	}
+	_, _ = f.Write([]byte(written))
+	close(f.ready)
+	return f
+}
+
+func TestBlobDiskCacheServeHeadErrors(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	c, err := newBlobDiskCache(BlobDiskCacheOptions{Dir: t.TempDir(), MaxBytes: 100})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	digest := testBlobDigest("blob")
+	fillURL := unreachable.URL + "/v2/pause/blobs/" + digest
+	w := httptest.NewRecorder()
+	d := c.serveHead(w, httptest.NewRequest(http.MethodHead, "http://localhost:8080/v2/pause/blobs/"+digest, nil), routeDecision{BlobFillURL: fillURL}, digest)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != fillURL || d.BlobDiskCache != blobDiskCacheError {
+		t.Fatalf("expected unreachable backend to be redirected to, got: %d %v %+v", w.Code, w.Header(), d)
+	}
+}
+
+func TestRouterShutdown(t *testing.T) {
+	configs, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	router := newRouter(configs, &fakeBlobsChecker{})
+	// without the blob disk cache there is nothing to wait for
+	router.Shutdown(context.Background())
+
+	router.blobDisk, err = newBlobDiskCache(BlobDiskCacheOptions{Dir: t.TempDir(), MaxBytes: 100})
+	if err != nil {
+		t.Fatalf("unexpected error creating blob disk cache: %v", err)
+	}
+	// finished downloads are not waited for
+	router.Shutdown(context.Background())
+
+	// downloads are waited for until the context is done, and then abandoned
+	blob := "blob"
+	digest := testBlobDigest(blob)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(blob[:2]))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(backend.Close)
+	f := router.blobDisk.fill(digest, backend.URL+"/v2/pause/blobs/"+digest)
+	<-f.ready
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	router.Shutdown(ctx)
+	if !f.done || f.err == nil || router.blobDisk.contains(digest) {
+		t.Fatalf("expected the download to be abandoned, got: %v", f.err)
+	}
+	if _, err := os.Stat(f.tempPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the abandoned download to be removed, got: %v", err)
+	}
+}
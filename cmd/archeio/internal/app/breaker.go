@@ -0,0 +1,164 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// CircuitBreakerOptions configures the per bucket circuit breaker for blob
+// existence checks
+type CircuitBreakerOptions struct {
+	// Failures is the number of consecutive failed checks that opens the circuit
+	Failures int
+	// Cooldown is how long the circuit stays open before a trial check is made
+	Cooldown time.Duration
+}
+
+// DefaultCircuitBreakerOptions returns the default CircuitBreakerOptions
+func DefaultCircuitBreakerOptions() CircuitBreakerOptions {
+	return CircuitBreakerOptions{
+		Failures: 5,
+		Cooldown: 30 * time.Second,
+	}
+}
+
+// Validate returns an error if o is not usable
+func (o CircuitBreakerOptions) Validate() error {
+	var errs []error
+	if o.Failures < 1 {
+		errs = append(errs, errors.New("circuit breaker failures must be at least 1"))
+	}
+	if o.Cooldown <= 0 {
+		errs = append(errs, errors.New("circuit breaker cooldown must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// circuitState is the state of a bucket's circuit
+type circuitState int
+
+const (
+	// checks are made normally
+	circuitClosed circuitState = iota
+	// checks are skipped
+	circuitOpen
+	// a single trial check is in flight
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker tracks a circuit per bucket name, so that a failing bucket
+// is not checked for every blob request until a cooldown has passed
+//
+// Use newCircuitBreaker to instantiate
+type circuitBreaker struct {
+	opts CircuitBreakerOptions
+	// now is time.Now, except in tests
+	now func() time.Time
+
+	mu       sync.Mutex
+	circuits map[string]*bucketCircuit
+}
+
+type bucketCircuit struct {
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+// newCircuitBreaker returns a circuitBreaker, opts should already be validated
+func newCircuitBreaker(opts CircuitBreakerOptions) *circuitBreaker {
+	return &circuitBreaker{
+		opts:     opts,
+		now:      time.Now,
+		circuits: make(map[string]*bucketCircuit),
+	}
+}
+
+// Allow returns true if bucket should be checked, callers must then Report the result
+//
+// Once the cooldown has passed for an open circuit, a single caller is allowed
+// to make a trial check.
+func (b *circuitBreaker) Allow(bucket string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(bucket)
+	switch c.state {
+	case circuitOpen:
+		if b.now().Sub(c.openedAt) < b.opts.Cooldown {
+			return false
+		}
+		b.transition(bucket, c, circuitHalfOpen)
+		return true
+	case circuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// Report records the result of a check allowed by Allow
+func (b *circuitBreaker) Report(bucket string, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(bucket)
+	if ok {
+		c.failures = 0
+		if c.state != circuitClosed {
+			b.transition(bucket, c, circuitClosed)
+		}
+		return
+	}
+	c.failures++
+	if c.state == circuitHalfOpen || (c.state == circuitClosed && c.failures >= b.opts.Failures) {
+		c.openedAt = b.now()
+		b.transition(bucket, c, circuitOpen)
+	}
+}
+
+// circuit returns the circuit for bucket, b.mu must be held
+func (b *circuitBreaker) circuit(bucket string) *bucketCircuit {
+	c, ok := b.circuits[bucket]
+	if !ok {
+		c = &bucketCircuit{}
+		b.circuits[bucket] = c
+	}
+	return c
+}
+
+// transition changes c's state, b.mu must be held
+func (b *circuitBreaker) transition(bucket string, c *bucketCircuit, state circuitState) {
+	klog.InfoS("bucket circuit breaker state changed", "bucket", bucket, "from", c.state, "to", state, "failures", c.failures)
+	c.state = state
+	bucketCircuitState.WithLabelValues(bucket).Set(float64(state))
+	bucketCircuitTransitions.WithLabelValues(bucket, state.String()).Inc()
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCircuitBreakerOptionsValidate(t *testing.T) {
+	if err := DefaultCircuitBreakerOptions().Validate(); err != nil {
+		t.Fatalf("unexpected error for default options: %v", err)
+	}
+	if err := (CircuitBreakerOptions{}).Validate(); err == nil {
+		t.Fatal("expected error for zero value options but got none")
+	}
+}
+
+func TestCircuitStateString(t *testing.T) {
+	for state, expected := range map[circuitState]string{
+		circuitClosed:   "closed",
+		circuitOpen:     "open",
+		circuitHalfOpen: "half-open",
+	} {
+		if state.String() != expected {
+			t.Errorf("expected %q, got: %q", expected, state.String())
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	const bucket = "breaker.example"
+	b := newCircuitBreaker(CircuitBreakerOptions{Failures: 2, Cooldown: time.Minute})
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+	expectState := func(expected circuitState) {
+		t.Helper()
+		if state := circuitState(testutil.ToFloat64(bucketCircuitState.WithLabelValues(bucket))); state != expected {
+			t.Fatalf("expected circuit to be %v, got: %v", expected, state)
+		}
+	}
+
+	// a success resets consecutive failures
+	for _, ok := range []bool{false, true, false} {
+		if !b.Allow(bucket) {
+			t.Fatal("expected closed circuit to allow checks")
+		}
+		b.Report(bucket, ok)
+	}
+	// the second consecutive failure opens the circuit
+	b.Allow(bucket)
+	b.Report(bucket, false)
+	expectState(circuitOpen)
+	if b.Allow(bucket) {
+		t.Fatal("expected open circuit to skip checks")
+	}
+
+	// after the cooldown a single trial is allowed
+	now = now.Add(time.Minute)
+	if !b.Allow(bucket) {
+		t.Fatal("expected a trial check after the cooldown")
+	}
+	expectState(circuitHalfOpen)
+	if b.Allow(bucket) {
+		t.Fatal("expected only one trial check")
+	}
+	// a failed trial reopens the circuit for another cooldown
+	b.Report(bucket, false)
+	expectState(circuitOpen)
+	now = now.Add(time.Second)
+	if b.Allow(bucket) {
+		t.Fatal("expected reopened circuit to skip checks")
+	}
+
+	// a successful trial closes the circuit
+	now = now.Add(time.Minute)
+	if !b.Allow(bucket) {
+		t.Fatal("expected a trial check after the cooldown")
+	}
+	b.Report(bucket, true)
+	expectState(circuitClosed)
+	if !b.Allow(bucket) {
+		t.Fatal("expected closed circuit to allow checks")
+	}
+	if opened := testutil.ToFloat64(bucketCircuitTransitions.WithLabelValues(bucket, "open")); opened != 2 {
+		t.Fatalf("expected circuit to open twice, got: %v", opened)
+	}
+}
+
+func TestCachedBlobCheckerCircuitBreaker(t *testing.T) {
+	var heads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		heads.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	backend := &objectBackend{name: server.URL, url: server.URL}
+	bucket := backend.Name()
+	blobs := newCachedBlobChecker(DefaultBlobCacheOptions(), 1, CircuitBreakerOptions{Failures: 2, Cooldown: time.Hour})
+
+	for _, digest := range []string{"sha256:a", "sha256:b", "sha256:c"} {
+		if exists, cached := blobs.BlobExists(backend, "pause", digest); exists || cached {
+			t.Fatalf("expected blob to not exist uncached, got exists: %v, cached: %v", exists, cached)
+		}
+	}
+	if heads.Load() != 2 {
+		t.Fatalf("expected HEADs to stop once the circuit opens, got: %d", heads.Load())
+	}
+	if skipped := testutil.ToFloat64(blobHeadShortCircuited.WithLabelValues(bucket)); skipped != 1 {
+		t.Fatalf("expected one short circuited check, got: %v", skipped)
+	}
+	// buckets sharing a host have their own circuits
+	other := &objectBackend{name: server.URL + "-other", url: server.URL}
+	blobs.BlobExists(other, "pause", "sha256:a")
+	if heads.Load() != 3 {
+		t.Fatalf("expected a HEAD to the other bucket, got: %d", heads.Load())
+	}
+
+	// connection errors also count as failures
+	server.Close()
+	unreachable := newCachedBlobChecker(DefaultBlobCacheOptions(), 1, CircuitBreakerOptions{Failures: 1, Cooldown: time.Hour})
+	unreachable.BlobExists(backend, "pause", "sha256:a")
+	if unreachable.breaker.Allow(bucket) {
+		t.Fatal("expected circuit to open after a connection error")
+	}
+}
+
+func TestCachedBlobCheckerCircuitBreakerDenied(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		status := status
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			t.Parallel()
+			var heads atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				heads.Add(1)
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+			backend := &objectBackend{name: server.URL, url: server.URL}
+			blobs := newCachedBlobChecker(DefaultBlobCacheOptions(), 1, CircuitBreakerOptions{Failures: 2, Cooldown: time.Hour})
+
+			// denied checks are not cached, so the same blob is checked again
+			for i := 0; i < 3; i++ {
+				if exists, cached := blobs.BlobExists(backend, "pause", "sha256:a"); exists || cached {
+					t.Fatalf("expected blob to not exist uncached, got exists: %v, cached: %v", exists, cached)
+				}
+			}
+			// until the circuit opens
+			if heads.Load() != 2 {
+				t.Fatalf("expected HEADs to stop once the circuit opens, got: %d", heads.Load())
+			}
+			if blobs.breaker.Allow(backend.Name()) {
+				t.Fatal("expected circuit to open after being denied")
+			}
+		})
+	}
+}
+
+// failingSigner fails to sign every URL, like a signer without credentials
+type failingSigner struct{}
+
+func (failingSigner) sign(context.Context, string, string) (string, error) {
+	return "", errors.New("no credentials")
+}
+
+func TestCachedBlobCheckerCircuitBreakerSigningErrors(t *testing.T) {
+	var heads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		heads.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	backend := &objectBackend{name: server.URL, url: server.URL}
+	bucket := backend.Name()
+	blobs := newCachedBlobChecker(DefaultBlobCacheOptions(), 1, CircuitBreakerOptions{Failures: 1, Cooldown: time.Minute})
+	now := time.Now()
+	blobs.breaker.now = func() time.Time { return now }
+	blobs.BlobExists(backend, "pause", "sha256:a")
+	if blobs.breaker.Allow(bucket) {
+		t.Fatal("expected circuit to open after a server error")
+	}
+
+	// failing to sign the HEAD once the cooldown passed must not use up the trial check
+	now = now.Add(time.Minute)
+	failing := &objectBackend{name: backend.name, url: backend.url, signer: failingSigner{}}
+	if exists, cached := blobs.BlobExists(failing, "pause", "sha256:b"); exists || cached {
+		t.Fatalf("expected blob to not exist uncached, got exists: %v, cached: %v", exists, cached)
+	}
+	if heads.Load() != 1 {
+		t.Fatalf("expected no HEAD without a signed URL, got: %d", heads.Load())
+	}
+	if !blobs.breaker.Allow(bucket) {
+		t.Fatal("expected the trial check to still be allowed after a signing error")
+	}
+}
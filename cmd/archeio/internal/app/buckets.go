@@ -17,112 +17,274 @@ limitations under the License.
 package app
 
 import (
+	"context"
+	"math"
 	"net/http"
+	"net/netip"
 	"sync"
 	"time"
 
+	"golang.org/x/sync/singleflight"
 	"k8s.io/klog/v2"
+
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs"
 )
 
-// awsRegionToHostURL returns the base S3 bucket URL for an OCI layer blob given the AWS region
+// blobKeyPrefix is where blobs are stored in buckets, matching GCR's GCS
+// layout and the keys geranos uploads to
+const blobKeyPrefix = "containers/images/"
+
+// blobPathPrefix is blobKeyPrefix as a URL path
+const blobPathPrefix = "/" + blobKeyPrefix
+
+// regionBuckets maps AWS regions to the bucket that should serve blobs to
+// clients in them, as configured in RegistryConfig
+type regionBuckets struct {
+	// all buckets in config order
+	backends       []Backend
+	fallbacks      map[string][]Backend
+	regionToBucket map[string]Backend
+	// nearest bucket with a Region for each other AWS region we know the location of
+	nearestBucket map[string]Backend
+	defaultBucket Backend
+	// trafficSplits override the bucket for clients in their regions
+	trafficSplits map[string]*trafficSplit
+}
+
+// newRegionBuckets resolves rc's bucket names to backends
 //
-// blobs in the buckets should be stored at /containers/images/sha256:$hash
-func awsRegionToHostURL(region, defaultURL string) string {
-	switch region {
-	// each of these has the region in which we have a bucket listed first
-	// and then additional regions we're mapping to that bucket
-	// based roughly on physical adjacency (and therefore _presumed_ latency)
-	//
-	// if you add a bucket, add a case for the region it is in, and consider
-	// shifting other regions that do not have their own bucket
-
-	// US East (N. Virginia)
-	case "us-east-1", "sa-east-1":
-		return "https://prod-registry-k8s-io-us-east-1.s3.dualstack.us-east-1.amazonaws.com"
-	// US East (Ohio)
-	case "us-east-2", "ca-central-1":
-		return "https://prod-registry-k8s-io-us-east-2.s3.dualstack.us-east-2.amazonaws.com"
-	// US West (N. California)
-	case "us-west-1":
-		return "https://prod-registry-k8s-io-us-west-1.s3.dualstack.us-west-1.amazonaws.com"
-	// US West (Oregon)
-	case "us-west-2", "ca-west-1":
-		return "https://prod-registry-k8s-io-us-west-2.s3.dualstack.us-west-2.amazonaws.com"
-	// Asia Pacific (Mumbai)
-	case "ap-south-1", "ap-south-2", "me-south-1", "me-central-1":
-		return "https://prod-registry-k8s-io-ap-south-1.s3.dualstack.ap-south-1.amazonaws.com"
-	// Asia Pacific (Tokyo)
-	case "ap-northeast-1", "ap-northeast-2", "ap-northeast-3":
-		return "https://prod-registry-k8s-io-ap-northeast-1.s3.dualstack.ap-northeast-1.amazonaws.com"
-	// Asia Pacific (Singapore)
-	case "ap-southeast-1", "ap-southeast-2", "ap-southeast-3", "ap-southeast-4", "ap-southeast-5", "ap-southeast-6", "ap-east-1", "cn-northwest-1", "cn-north-1":
-		return "https://prod-registry-k8s-io-ap-southeast-1.s3.dualstack.ap-southeast-1.amazonaws.com"
-	// Europe (Frankfurt)
-	case "eu-central-1", "eu-central-2", "eu-south-1", "eu-south-2", "il-central-1":
-		return "https://prod-registry-k8s-io-eu-central-1.s3.dualstack.eu-central-1.amazonaws.com"
-	// Europe (Ireland)
-	case "eu-west-1", "af-south-1", "eu-west-2", "eu-west-3", "eu-north-1":
-		return "https://prod-registry-k8s-io-eu-west-1.s3.dualstack.eu-west-1.amazonaws.com"
-	default:
-		return defaultURL
+// rc should already be validated, see RegistryConfig.Validate
+func newRegionBuckets(rc RegistryConfig) *regionBuckets {
+	backends := make([]Backend, 0, len(rc.Buckets))
+	nameToBackend := make(map[string]Backend, len(rc.Buckets))
+	for _, bucket := range rc.Buckets {
+		backend := newBackend(bucket)
+		backends = append(backends, backend)
+		nameToBackend[bucket.Name] = backend
+	}
+	fallbacks := map[string][]Backend{}
+	for _, bucket := range rc.Buckets {
+		for _, name := range bucket.Fallbacks {
+			fallbacks[bucket.Name] = append(fallbacks[bucket.Name], nameToBackend[name])
+		}
+	}
+	regionToBucket := make(map[string]Backend, len(rc.RegionToBucket))
+	for region, name := range rc.RegionToBucket {
+		regionToBucket[region] = nameToBackend[name]
+	}
+	trafficSplits := make(map[string]*trafficSplit, len(rc.TrafficSplits))
+	for region, split := range rc.TrafficSplits {
+		trafficSplits[region] = newTrafficSplit(split, nameToBackend)
+	}
+	return &regionBuckets{
+		backends:       backends,
+		fallbacks:      fallbacks,
+		regionToBucket: regionToBucket,
+		nearestBucket:  nearestBuckets(rc.Buckets, nameToBackend, regionToBucket),
+		defaultBucket:  nameToBackend[rc.DefaultBucket],
+		trafficSplits:  trafficSplits,
 	}
 }
 
-// blobChecker are used to check if a blob exists, possibly with caching
-type blobChecker interface {
-	// BlobExists should check that blobURL exists
-	// bucket and layerHash may be used for caching purposes
-	BlobExists(blobURL string) bool
+// nearestBuckets returns the nearest of buckets with a Region for each
+// AWS region with a known location that is not in regionToBucket
+//
+// Ties go to the first bucket in buckets
+func nearestBuckets(buckets []BucketConfig, nameToBackend, regionToBucket map[string]Backend) map[string]Backend {
+	nearest := map[string]Backend{}
+	for _, info := range cloudcidrs.AllIPInfos() {
+		if _, ok := regionToBucket[info.Region]; ok || info.Cloud != cloudcidrs.AWS {
+			continue
+		}
+		location, ok := cloudcidrs.GetRegionInfo(info)
+		if !ok {
+			continue
+		}
+		distance := math.Inf(1)
+		for _, bucket := range buckets {
+			bucketLocation, ok := cloudcidrs.GetRegionInfo(cloudcidrs.IPInfo{Cloud: cloudcidrs.AWS, Region: bucket.Region})
+			if !ok {
+				continue
+			}
+			if d := location.DistanceKm(bucketLocation); d < distance {
+				distance = d
+				nearest[info.Region] = nameToBackend[bucket.Name]
+			}
+		}
+	}
+	return nearest
 }
 
-// cachedBlobChecker just performs an HTTP HEAD check against the blob
+// ForRegion returns the bucket for an OCI layer blob given the AWS region
 //
-// TODO: potentially replace with a caching implementation
-// should be plenty fast for now, HTTP HEAD on s3 is cheap
-type cachedBlobChecker struct {
-	blobCache
+// If the region is not mapped this returns the nearest bucket with a Region,
+// and otherwise the default bucket, which is nil if no default is configured
+func (b *regionBuckets) ForRegion(region string) Backend {
+	if bucket, ok := b.regionToBucket[region]; ok {
+		return bucket
+	}
+	if bucket, ok := b.nearestBucket[region]; ok {
+		return bucket
+	}
+	return b.defaultBucket
+}
+
+// Candidates returns the buckets to check in order for an OCI layer blob
+// given the client's AWS region and IP, the bucket from ForRegion or the
+// region's traffic split followed by its fallbacks
+//
+// This is empty if ForRegion has no bucket for the region
+func (b *regionBuckets) Candidates(region string, clientIP netip.Addr) []Backend {
+	var bucket Backend
+	if split, ok := b.trafficSplits[region]; ok {
+		bucket = split.pick(clientIP)
+	} else {
+		bucket = b.ForRegion(region)
+	}
+	if bucket == nil {
+		return nil
+	}
+	return append([]Backend{bucket}, b.fallbacks[bucket.Name()]...)
 }
 
-func newCachedBlobChecker() *cachedBlobChecker {
-	return &cachedBlobChecker{}
+// TrafficSplit returns the weights clients in region are split between
+// buckets by for logs, or an empty string if they are not split
+func (b *regionBuckets) TrafficSplit(region string) string {
+	if split, ok := b.trafficSplits[region]; ok {
+		return split.weights
+	}
+	return ""
 }
 
-type blobCache struct {
-	m sync.Map
+// blobChecker are used to check if a blob exists, possibly with caching
+type blobChecker interface {
+	// BlobExists should check that the blob digest requested from repo
+	// exists in bucket, at bucket's CheckURL
+	//
+	// cached reports if the result was served from a cache, for logging
+	BlobExists(bucket Backend, repo, digest string) (exists, cached bool)
 }
 
-func (b *blobCache) Get(blobURL string) bool {
-	_, exists := b.m.Load(blobURL)
-	return exists
+// cachedBlobChecker performs an HTTP HEAD check against the blob, caching
+// the result in a blobCache
+//
+// Concurrent checks for the same blob share one HEAD, and the number of
+// outstanding HEADs to each bucket is bounded.
+//
+// should be plenty fast for now, HTTP HEAD on s3 is cheap
+type cachedBlobChecker struct {
+	cache *blobCache
+	// inventory holds blobs known to exist without checking, if set
+	inventory *blobInventory
+	// inflight coalesces concurrent HEADs by blob URL
+	inflight singleflight.Group
+	// maxHeadsPerBucket bounds headSlots
+	maxHeadsPerBucket int
+	// headSlots maps bucket name to a semaphore channel of outstanding HEADs
+	headSlots sync.Map
+	// breaker skips HEADs to failing buckets by name
+	breaker *circuitBreaker
 }
 
-func (b *blobCache) Put(blobURL string) {
-	b.m.Store(blobURL, struct{}{})
+func newCachedBlobChecker(opts BlobCacheOptions, maxHeadsPerBucket int, breakerOpts CircuitBreakerOptions) *cachedBlobChecker {
+	return &cachedBlobChecker{
+		cache:             newBlobCache(opts),
+		maxHeadsPerBucket: maxHeadsPerBucket,
+		breaker:           newCircuitBreaker(breakerOpts),
+	}
 }
 
-func (c *cachedBlobChecker) BlobExists(blobURL string) bool {
-	if c.blobCache.Get(blobURL) {
-		klog.V(3).InfoS("blob existence cache hit", "url", blobURL)
-		return true
+func (c *cachedBlobChecker) BlobExists(backend Backend, repo, digest string) (exists, cached bool) {
+	// buckets may share a host, so limits, circuits and metrics are by name
+	bucket := backend.Name()
+	blobURL := backend.CheckURL(repo, digest)
+	if c.inventory.Contains(blobURL) {
+		klog.V(3).InfoS("blob found in inventory", "url", blobURL)
+		blobCacheTotal.WithLabelValues(bucket, blobCacheInventory).Inc()
+		return true, true
+	}
+	if exists, ok := c.cache.Get(blobURL); ok {
+		klog.V(3).InfoS("blob existence cache hit", "url", blobURL, "exists", exists)
+		result := blobCacheHit
+		if !exists {
+			result = blobCacheNegativeHit
+		}
+		blobCacheTotal.WithLabelValues(bucket, result).Inc()
+		return exists, true
 	}
 	klog.V(3).InfoS("blob existence cache miss", "url", blobURL)
+	blobCacheTotal.WithLabelValues(bucket, blobCacheMiss).Inc()
+	// when many clients request the same new blob at once, only check it once
+	v, _, shared := c.inflight.Do(blobURL, func() (any, error) {
+		return c.headBlob(backend, bucket, blobURL), nil
+	})
+	if shared {
+		blobHeadCoalesced.WithLabelValues(bucket).Inc()
+	}
+	return v.(bool), false
+}
+
+// headBlob checks if blobURL exists with a HEAD request and caches the result
+func (c *cachedBlobChecker) headBlob(backend Backend, bucket, blobURL string) bool {
+	// bound outstanding HEADs per bucket, if the bucket is this slow
+	// we are better off sending clients upstream than queueing
+	slotsV, _ := c.headSlots.LoadOrStore(bucket, make(chan struct{}, c.maxHeadsPerBucket))
+	slots := slotsV.(chan struct{})
+	select {
+	case slots <- struct{}{}:
+		defer func() { <-slots }()
+	default:
+		klog.V(2).InfoS("too many outstanding blob HEADs", "bucket", bucket)
+		blobHeadRejected.WithLabelValues(bucket).Inc()
+		return false
+	}
+	// the unsigned URL is still the cache key
+	// signing failures are not the bucket's fault, so this is before the
+	// breaker, which must be told the result of any request it allows
+	headURL, err := backend.SignURL(context.Background(), http.MethodHead, blobURL)
+	if err != nil {
+		klog.ErrorS(err, "failed to sign blob HEAD", "bucket", bucket)
+		blobCacheTotal.WithLabelValues(bucket, blobCacheError).Inc()
+		return false
+	}
+	// if the bucket is failing, don't make clients wait for it to time out
+	if !c.breaker.Allow(bucket) {
+		klog.V(2).InfoS("skipping blob HEAD, bucket circuit is open", "bucket", bucket)
+		blobHeadShortCircuited.WithLabelValues(bucket).Inc()
+		return false
+	}
 	// NOTE: this client will still share http.DefaultTransport
 	// We do not wish to share the rest of the client state currently
 	client := &http.Client{
 		// ensure sensible timeouts
 		Timeout: time.Second * 5,
 	}
-	r, err := client.Head(blobURL)
+	start := time.Now()
+	r, err := client.Head(headURL)
+	blobHeadDuration.WithLabelValues(bucket).Observe(time.Since(start).Seconds())
 	// fallback to assuming blob is unavailable on errors
+	// these are not cached, the bucket may be temporarily unreachable
 	if err != nil {
+		blobCacheTotal.WithLabelValues(bucket, blobCacheError).Inc()
+		c.breaker.Report(bucket, false)
 		return false
 	}
 	r.Body.Close()
+	// being denied is a problem with our credentials or the bucket's policy
+	// rather than the blob, so like server errors it is not cached
+	failed := r.StatusCode >= http.StatusInternalServerError ||
+		r.StatusCode == http.StatusUnauthorized || r.StatusCode == http.StatusForbidden
+	c.breaker.Report(bucket, !failed)
 	// if the blob exists it HEAD should return 200 OK
 	// this is true for S3 and for OCI registries
-	if r.StatusCode == http.StatusOK {
-		c.blobCache.Put(blobURL)
+	switch {
+	case r.StatusCode == http.StatusOK:
+		c.cache.Put(blobURL, true)
 		return true
+	case failed:
+		klog.V(2).InfoS("blob HEAD failed", "bucket", bucket, "status", r.StatusCode)
+	case r.StatusCode >= 400 && r.StatusCode < 500:
+		c.cache.Put(blobURL, false)
 	}
 	return false
 }
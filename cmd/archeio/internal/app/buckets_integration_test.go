@@ -32,34 +32,37 @@ import (
 
 func TestIntegrationCachedBlobChecker(t *testing.T) {
 	t.Parallel()
-	bucket := awsRegionToHostURL("us-east-1", "")
-	blobs := newCachedBlobChecker()
+	bucket := newRegionBuckets(DefaultRegistryConfig()).ForRegion("us-east-1")
+	blobs := newCachedBlobChecker(DefaultBlobCacheOptions(), DefaultRouterOptions().MaxBlobHeadsPerBucket, DefaultCircuitBreakerOptions())
 	testCases := []struct {
 		Name         string
-		BlobURL      string
-		Bucket       string
-		HashKey      string
+		Bucket       Backend
+		Digest       string
 		ExpectExists bool
 	}{
 		{
 			Name:         "known bucket entry",
-			BlobURL:      bucket + "/containers/images/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e",
+			Bucket:       bucket,
+			Digest:       "sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e",
 			ExpectExists: true,
 		},
 		// to cover the case that we get a cache hit
 		{
 			Name:         "same-known bucket entry",
-			BlobURL:      bucket + "/containers/images/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e",
+			Bucket:       bucket,
+			Digest:       "sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e",
 			ExpectExists: true,
 		},
 		{
 			Name:         "known bucket, bad entry",
-			BlobURL:      bucket + "/c0ntainers/images/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e",
+			Bucket:       bucket,
+			Digest:       "sha256:0000000000000000000000000000000000000000000000000000000000000000",
 			ExpectExists: false,
 		},
 		{
 			Name:         "bogus bucket on domain without webserver",
-			BlobURL:      "http://bogus.k8s.io/foo",
+			Bucket:       &objectBackend{name: "bogus", url: "http://bogus.k8s.io"},
+			Digest:       "sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e",
 			ExpectExists: false,
 		},
 	}
@@ -69,8 +72,7 @@ func TestIntegrationCachedBlobChecker(t *testing.T) {
 	for i := range testCases {
 		tc := testCases[i]
 		t.Run(tc.Name, func(t *testing.T) {
-			url := tc.BlobURL
-			exists := blobs.BlobExists(url)
+			exists, _ := blobs.BlobExists(tc.Bucket, "pause", tc.Digest)
 			if exists != tc.ExpectExists {
 				t.Fatalf("expected: %v but got: %v", tc.ExpectExists, exists)
 			}
@@ -79,8 +81,7 @@ func TestIntegrationCachedBlobChecker(t *testing.T) {
 	for i := range testCases {
 		tc := testCases[i]
 		t.Run(tc.Name, func(t *testing.T) {
-			url := tc.BlobURL
-			exists := blobs.BlobExists(url)
+			exists, _ := blobs.BlobExists(tc.Bucket, "pause", tc.Digest)
 			if exists != tc.ExpectExists {
 				t.Fatalf("expected: %v but got: %v", tc.ExpectExists, exists)
 			}
@@ -97,6 +98,9 @@ func TestIntegrationAllBucketsValid(t *testing.T) {
 		t.Fatalf("Failed to decode test blob digest: %v", err)
 	}
 	// iterate all AWS regions and their mapped buckets
+	rc := DefaultRegistryConfig()
+	rc.DefaultBucket = ""
+	buckets := newRegionBuckets(rc)
 	ipInfos := cloudcidrs.AllIPInfos()
 	for i := range ipInfos {
 		ipInfo := ipInfos[i]
@@ -108,10 +112,11 @@ func TestIntegrationAllBucketsValid(t *testing.T) {
 			continue
 		}
 		// skip regions that aren't mapped and would've used the default
-		baseURL := awsRegionToHostURL(ipInfo.Region, "")
-		if baseURL == "" {
+		bucket := buckets.ForRegion(ipInfo.Region)
+		if bucket == nil {
 			continue
 		}
+		baseURL := bucket.URL()
 		// for all remaining regions, fetch a real blob to make sure this
 		// bucket will work
 		t.Run(ipInfo.Region, func(t *testing.T) {
@@ -17,13 +17,21 @@ limitations under the License.
 package app
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs"
 )
 
-func TestRegionToAWSRegionToHostURL(t *testing.T) {
+func TestRegionBucketsForRegion(t *testing.T) {
 	// ensure known regions return a configured bucket
 	regions := []string{}
 	for _, ipInfo := range cloudcidrs.AllIPInfos() {
@@ -33,25 +41,297 @@ func TestRegionToAWSRegionToHostURL(t *testing.T) {
 			regions = append(regions, ipInfo.Region)
 		}
 	}
+	rc := DefaultRegistryConfig()
+	rc.DefaultBucket = ""
+	buckets := newRegionBuckets(rc)
 	for _, region := range regions {
-		url := awsRegionToHostURL(region, "")
+		url := buckets.ForRegion(region).URL()
 		if url == "" {
 			t.Fatalf("received empty string for known region %q", region)
 		}
 	}
 	// test default region
-	if url := awsRegionToHostURL("nonsensical-region", "____default____"); url != "____default____" {
-		t.Fatalf("received non-empty URL string for made up region \"nonsensical-region\": %q", url)
+	rc.Buckets = append(rc.Buckets, BucketConfig{Name: "____default____", URL: "https://default.example"})
+	rc.DefaultBucket = "____default____"
+	if url := newRegionBuckets(rc).ForRegion("nonsensical-region").URL(); url != "https://default.example" {
+		t.Fatalf("received non-default URL string for made up region \"nonsensical-region\": %q", url)
+	}
+}
+
+func TestRegionBucketsDefaultConfig(t *testing.T) {
+	// the bucket for each AWS region known before buckets were selected
+	// automatically, regions added since are sent to the nearest bucket
+	previous := map[string]string{
+		// these were not mapped and went to the default bucket
+		"GLOBAL":         "us-east-1",
+		"us-gov-east-1":  "us-east-1",
+		"us-gov-west-1":  "us-east-1",
+		"eusc-de-east-1": "us-east-1",
+		"us-east-1":      "us-east-1",
+		"sa-east-1":      "us-east-1",
+		"us-east-2":      "us-east-2",
+		"ca-central-1":   "us-east-2",
+		"us-west-1":      "us-west-1",
+		"us-west-2":      "us-west-2",
+		"ca-west-1":      "us-west-2",
+		"ap-south-1":     "ap-south-1",
+		"ap-south-2":     "ap-south-1",
+		"me-south-1":     "ap-south-1",
+		"me-central-1":   "ap-south-1",
+		"ap-northeast-1": "ap-northeast-1",
+		"ap-northeast-2": "ap-northeast-1",
+		"ap-northeast-3": "ap-northeast-1",
+		"ap-southeast-1": "ap-southeast-1",
+		"ap-southeast-2": "ap-southeast-1",
+		"ap-southeast-3": "ap-southeast-1",
+		"ap-southeast-4": "ap-southeast-1",
+		"ap-southeast-5": "ap-southeast-1",
+		"ap-southeast-6": "ap-southeast-1",
+		"ap-east-1":      "ap-southeast-1",
+		"cn-northwest-1": "ap-southeast-1",
+		"cn-north-1":     "ap-southeast-1",
+		"eu-central-1":   "eu-central-1",
+		"eu-central-2":   "eu-central-1",
+		"eu-south-1":     "eu-central-1",
+		"eu-south-2":     "eu-central-1",
+		"il-central-1":   "eu-central-1",
+		"eu-west-1":      "eu-west-1",
+		"af-south-1":     "eu-west-1",
+		"eu-west-2":      "eu-west-1",
+		"eu-west-3":      "eu-west-1",
+		"eu-north-1":     "eu-west-1",
+	}
+	// the default config must keep routing these regions as before
+	buckets := newRegionBuckets(DefaultRegistryConfig())
+	for region, expected := range previous {
+		if bucket := buckets.ForRegion(region).Name(); bucket != expected {
+			t.Errorf("expected bucket %q for region %q, got: %q", expected, region, bucket)
+		}
+	}
+}
+
+func TestRegionBucketsNearest(t *testing.T) {
+	rc := DefaultRegistryConfig()
+	rc.Buckets = []BucketConfig{
+		{Name: "default", URL: "https://default.example"},
+		{Name: "eu-west-1", URL: "https://eu-west-1.example", Region: "eu-west-1"},
+		{Name: "also-eu-west-1", URL: "https://also-eu-west-1.example", Region: "eu-west-1"},
+		{Name: "us-east-1", URL: "https://us-east-1.example", Region: "us-east-1"},
+	}
+	rc.RegionToBucket = map[string]string{"eu-west-2": "us-east-1"}
+	rc.DefaultBucket = "default"
+	buckets := newRegionBuckets(rc)
+	testCases := []struct {
+		Region         string
+		ExpectedBucket string
+	}{
+		// the first of equally near buckets
+		{Region: "eu-west-1", ExpectedBucket: "eu-west-1"},
+		{Region: "eu-central-1", ExpectedBucket: "eu-west-1"},
+		{Region: "us-east-1", ExpectedBucket: "us-east-1"},
+		{Region: "sa-east-1", ExpectedBucket: "us-east-1"},
+		// explicit override
+		{Region: "eu-west-2", ExpectedBucket: "us-east-1"},
+		// no known location
+		{Region: "GLOBAL", ExpectedBucket: "default"},
+		{Region: "nonsensical-region", ExpectedBucket: "default"},
+		// only AWS regions are considered
+		{Region: "europe-west1", ExpectedBucket: "default"},
+	}
+	for _, tc := range testCases {
+		if bucket := buckets.ForRegion(tc.Region).Name(); bucket != tc.ExpectedBucket {
+			t.Errorf("expected bucket %q for region %q, got: %q", tc.ExpectedBucket, tc.Region, bucket)
+		}
+	}
+
+	// without any bucket regions, only explicit mappings are used
+	for i := range rc.Buckets {
+		rc.Buckets[i].Region = ""
+	}
+	if bucket := newRegionBuckets(rc).ForRegion("eu-central-1").Name(); bucket != "default" {
+		t.Errorf("expected default bucket without bucket regions, got: %q", bucket)
 	}
 }
 
-func TestBlobCache(t *testing.T) {
-	bc := &blobCache{}
-	bc.Put("foo")
-	if !bc.Get("foo") {
-		t.Fatal("Cache did not contain key we just put")
+func TestRegionBucketsCandidates(t *testing.T) {
+	rc := DefaultRegistryConfig()
+	rc.Buckets = []BucketConfig{
+		{Name: "eu-west-1", URL: "https://eu-west-1.example", Fallbacks: []string{"eu-central-1", "us-east-1"}},
+		{Name: "eu-central-1", URL: "https://eu-central-1.example"},
+		{Name: "us-east-1", URL: "https://us-east-1.example"},
+	}
+	rc.RegionToBucket = map[string]string{"eu-west-1": "eu-west-1", "us-east-1": "us-east-1"}
+	rc.DefaultBucket = ""
+	buckets := newRegionBuckets(rc)
+	clientIP := netip.MustParseAddr("192.0.2.1")
+	names := func(candidates []Backend) []string {
+		r := []string{}
+		for _, bucket := range candidates {
+			r = append(r, bucket.Name())
+		}
+		return r
+	}
+	if c := names(buckets.Candidates("eu-west-1", clientIP)); !slices.Equal(c, []string{"eu-west-1", "eu-central-1", "us-east-1"}) {
+		t.Errorf("unexpected candidates for eu-west-1: %v", c)
+	}
+	if c := names(buckets.Candidates("us-east-1", clientIP)); !slices.Equal(c, []string{"us-east-1"}) {
+		t.Errorf("unexpected candidates for us-east-1: %v", c)
+	}
+	if c := buckets.Candidates("nonsensical-region", clientIP); len(c) != 0 {
+		t.Errorf("expected no candidates for unmapped region, got: %v", c)
+	}
+}
+
+func TestCachedBlobChecker(t *testing.T) {
+	var heads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		heads.Add(1)
+		switch r.URL.Path {
+		case "/containers/images/sha256:exists":
+		case "/containers/images/sha256:broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	backend := &objectBackend{name: server.URL, url: server.URL}
+	bucket := backend.Name()
+	blobs := newCachedBlobChecker(DefaultBlobCacheOptions(), DefaultRouterOptions().MaxBlobHeadsPerBucket, DefaultCircuitBreakerOptions())
+
+	// first check misses the cache and performs a HEAD
+	if exists, cached := blobs.BlobExists(backend, "pause", "sha256:exists"); !exists || cached {
+		t.Fatalf("expected blob to exist uncached, got exists: %v, cached: %v", exists, cached)
+	}
+	// second check is served from cache
+	if exists, cached := blobs.BlobExists(backend, "pause", "sha256:exists"); !exists || !cached {
+		t.Fatalf("expected blob to exist cached, got exists: %v, cached: %v", exists, cached)
+	}
+	if heads.Load() != 1 {
+		t.Fatalf("expected exactly one HEAD, got: %d", heads.Load())
+	}
+	if hits := testutil.ToFloat64(blobCacheTotal.WithLabelValues(bucket, blobCacheHit)); hits != 1 {
+		t.Fatalf("expected one cache hit, got: %v", hits)
+	}
+	// missing blob, the miss is cached
+	if exists, cached := blobs.BlobExists(backend, "pause", "sha256:missing"); exists || cached {
+		t.Fatalf("expected blob to not exist uncached, got exists: %v, cached: %v", exists, cached)
+	}
+	if exists, cached := blobs.BlobExists(backend, "pause", "sha256:missing"); exists || !cached {
+		t.Fatalf("expected blob to not exist cached, got exists: %v, cached: %v", exists, cached)
+	}
+	if heads.Load() != 2 {
+		t.Fatalf("expected exactly two HEADs, got: %d", heads.Load())
+	}
+	if hits := testutil.ToFloat64(blobCacheTotal.WithLabelValues(bucket, blobCacheNegativeHit)); hits != 1 {
+		t.Fatalf("expected one negative cache hit, got: %v", hits)
+	}
+	// server errors are not cached
+	for i := 0; i < 2; i++ {
+		if exists, cached := blobs.BlobExists(backend, "pause", "sha256:broken"); exists || cached {
+			t.Fatalf("expected broken blob to not exist uncached, got exists: %v, cached: %v", exists, cached)
+		}
+	}
+	if heads.Load() != 4 {
+		t.Fatalf("expected exactly four HEADs, got: %d", heads.Load())
+	}
+	if misses := testutil.ToFloat64(blobCacheTotal.WithLabelValues(bucket, blobCacheMiss)); misses != 4 {
+		t.Fatalf("expected four cache misses, got: %v", misses)
+	}
+	// unreachable bucket
+	server.Close()
+	if exists, _ := blobs.BlobExists(backend, "pause", "sha256:other"); exists {
+		t.Fatal("expected blob on unreachable bucket to not exist")
+	}
+	if errs := testutil.ToFloat64(blobCacheTotal.WithLabelValues(bucket, blobCacheError)); errs != 1 {
+		t.Fatalf("expected one error, got: %v", errs)
+	}
+	if _, cached := blobs.cache.Get(server.URL + "/containers/images/sha256:other"); cached {
+		t.Fatal("expected errors to not be cached")
+	}
+}
+
+func TestCachedBlobCheckerCoalesce(t *testing.T) {
+	const concurrency = 10
+	var heads atomic.Int32
+	received := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		if heads.Add(1) == 1 {
+			close(received)
+		}
+		<-release
+	}))
+	defer server.Close()
+	backend := &objectBackend{name: server.URL, url: server.URL}
+	bucket := backend.Name()
+	blobs := newCachedBlobChecker(DefaultBlobCacheOptions(), 1, DefaultCircuitBreakerOptions())
+
+	results := make(chan bool, concurrency)
+	check := func() {
+		exists, _ := blobs.BlobExists(backend, "pause", "sha256:new")
+		results <- exists
+	}
+	go check()
+	<-received
+	// while the first HEAD is outstanding, these should wait for it
+	// instead of being rejected by the limit of one HEAD per bucket
+	for i := 1; i < concurrency; i++ {
+		go check()
+	}
+	// give the other checks time to join the in-flight HEAD
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	for i := 0; i < concurrency; i++ {
+		if !<-results {
+			t.Fatal("expected every concurrent check to find the blob")
+		}
+	}
+	if heads.Load() != 1 {
+		t.Fatalf("expected exactly one HEAD, got: %d", heads.Load())
+	}
+	if coalesced := testutil.ToFloat64(blobHeadCoalesced.WithLabelValues(bucket)); coalesced != concurrency {
+		t.Fatalf("expected %d coalesced checks, got: %v", concurrency, coalesced)
+	}
+}
+
+func TestCachedBlobCheckerMaxHeadsPerBucket(t *testing.T) {
+	var heads atomic.Int32
+	received := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		if heads.Add(1) == 1 {
+			close(received)
+			<-release
+		}
+	}))
+	defer server.Close()
+	backend := &objectBackend{name: server.URL, url: server.URL}
+	bucket := backend.Name()
+	blobs := newCachedBlobChecker(DefaultBlobCacheOptions(), 1, DefaultCircuitBreakerOptions())
+
+	done := make(chan bool)
+	go func() {
+		exists, _ := blobs.BlobExists(backend, "pause", "sha256:slow")
+		done <- exists
+	}()
+	<-received
+	// a different blob in the same bucket exceeds the limit
+	if exists, cached := blobs.BlobExists(backend, "pause", "sha256:other"); exists || cached {
+		t.Fatalf("expected rejected check to not exist uncached, got exists: %v, cached: %v", exists, cached)
+	}
+	if rejected := testutil.ToFloat64(blobHeadRejected.WithLabelValues(bucket)); rejected != 1 {
+		t.Fatalf("expected one rejected check, got: %v", rejected)
+	}
+	close(release)
+	if !<-done {
+		t.Fatal("expected slow blob to exist")
+	}
+	// the slot is released once the HEAD completes, and rejections are not cached
+	if exists, cached := blobs.BlobExists(backend, "pause", "sha256:other"); !exists || cached {
+		t.Fatalf("expected blob to exist uncached, got exists: %v, cached: %v", exists, cached)
 	}
-	if bc.Get("bar") {
-		t.Fatal("Cache contained key we did not put")
+	if heads.Load() != 2 {
+		t.Fatalf("expected exactly two HEADs, got: %d", heads.Load())
 	}
 }
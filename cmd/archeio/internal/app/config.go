@@ -0,0 +1,661 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs"
+)
+
+// RegistryConfig is the archeio configuration, it may be loaded from a YAML
+// or JSON file with LoadRegistryConfig.
+//
+// See default-config.yaml for the configuration registry.k8s.io uses.
+type RegistryConfig struct {
+	// UpstreamRegistryEndpoint and UpstreamRegistryPath locate the primary
+	// registry archeio is fronting, e.g. https://us-central1-docker.pkg.dev
+	// and k8s-artifacts-prod/images
+	UpstreamRegistryEndpoint string `json:"upstreamRegistryEndpoint"`
+	UpstreamRegistryPath     string `json:"upstreamRegistryPath"`
+	InfoURL                  string `json:"infoURL"`
+	PrivacyURL               string `json:"privacyURL"`
+	// Buckets are the blob mirrors we may redirect blob requests to
+	Buckets []BucketConfig `json:"buckets"`
+	// RegionToBucket maps AWS or Azure regions to the Name of one of Buckets,
+	// overriding the nearest bucket for AWS regions, see BucketConfig.Region
+	RegionToBucket map[string]string `json:"regionToBucket"`
+	// DefaultBucket is the Name of the bucket used for regions that are not
+	// in RegionToBucket and have no nearest bucket, if empty those clients
+	// are sent upstream
+	DefaultBucket string `json:"defaultBucket"`
+	// FallbackBudget bounds the time spent checking a blob request's bucket
+	// before its fallback buckets are skipped, as a Go duration string.
+	// Defaults to 1s, see BucketConfig.Fallbacks
+	FallbackBudget string `json:"fallbackBudget,omitempty"`
+	// RoutingRules route requests for some repositories to a different
+	// upstream registry and buckets, the first rule matching the requested
+	// repository is used and other requests are routed with the fields above
+	RoutingRules []RoutingRuleConfig `json:"routingRules,omitempty"`
+	// RateLimits throttles registry API requests per client, if set
+	RateLimits *RateLimitConfig `json:"rateLimits,omitempty"`
+	// TrafficSplits maps AWS or Azure regions to weighted buckets their
+	// clients are split between, overriding RegionToBucket and the nearest
+	// bucket for those regions
+	//
+	// These only apply to repositories that match no routing rule,
+	// see RoutingRuleConfig.TrafficSplits
+	TrafficSplits map[string][]WeightedBucketConfig `json:"trafficSplits,omitempty"`
+}
+
+// WeightedBucketConfig is a bucket selected for a share of a region's clients
+type WeightedBucketConfig struct {
+	// Bucket is the Name of one of RegistryConfig.Buckets
+	Bucket string `json:"bucket"`
+	// Weight is the bucket's share of clients relative to the other buckets
+	// in the split, zero sends no clients to it
+	Weight int `json:"weight"`
+}
+
+// RateLimitConfig configures token bucket rate limits for each client IP
+// and each client prefix, the limits for a client are the most specific of
+// its region's, its cloud's, or these defaults
+type RateLimitConfig struct {
+	RateLimit
+	// IPv4PrefixLength and IPv6PrefixLength group client IPs into prefixes
+	// for the prefix limits, defaulting to /24 and /64
+	IPv4PrefixLength int `json:"ipv4PrefixLength,omitempty"`
+	IPv6PrefixLength int `json:"ipv6PrefixLength,omitempty"`
+	// Clouds overrides the limits for clients from a cloud, by cloudcidrs
+	// cloud name such as AWS
+	Clouds map[string]CloudRateLimit `json:"clouds,omitempty"`
+	// Allowlist are CIDR prefixes of clients that are never throttled
+	Allowlist []string `json:"allowlist,omitempty"`
+}
+
+// CloudRateLimit is the rate limits for clients from a cloud
+type CloudRateLimit struct {
+	RateLimit
+	// Regions overrides the limits for clients from a region of the cloud
+	Regions map[string]RateLimit `json:"regions,omitempty"`
+}
+
+// RateLimit is the token bucket limits for a client, a zero rate is unlimited
+type RateLimit struct {
+	// RequestsPerSecond and Burst limit each client IP
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+	Burst             int     `json:"burst,omitempty"`
+	// PrefixRequestsPerSecond and PrefixBurst limit each client prefix,
+	// see RateLimitConfig.IPv4PrefixLength
+	PrefixRequestsPerSecond float64 `json:"prefixRequestsPerSecond,omitempty"`
+	PrefixBurst             int     `json:"prefixBurst,omitempty"`
+}
+
+// RoutingRuleConfig routes requests for the repositories it matches,
+// exactly one of Prefix or Glob must be set
+type RoutingRuleConfig struct {
+	// Name identifies the rule in logs, /explain and health
+	Name string `json:"name"`
+	// Prefix matches repositories under this path, e.g. "team" matches
+	// "team/app" and "team/sub/app" but not "team" or "teamapp"
+	Prefix string `json:"prefix,omitempty"`
+	// Glob matches repository names with path.Match, so * does not match /
+	Glob string `json:"glob,omitempty"`
+	// UpstreamRegistryEndpoint and UpstreamRegistryPath locate the registry
+	// the matching repositories are in
+	UpstreamRegistryEndpoint string `json:"upstreamRegistryEndpoint"`
+	UpstreamRegistryPath     string `json:"upstreamRegistryPath"`
+	// StripPrefix removes Prefix from repository names when redirecting,
+	// so "team/app" is redirected to "app" under UpstreamRegistryPath
+	StripPrefix bool `json:"stripPrefix,omitempty"`
+	// Buckets are the Names of the buckets blobs in the matching repositories
+	// may be redirected to, if empty they are always served upstream
+	Buckets []string `json:"buckets,omitempty"`
+	// RegionToBucket and DefaultBucket select from Buckets for these
+	// repositories, like RegistryConfig.RegionToBucket and DefaultBucket
+	RegionToBucket map[string]string `json:"regionToBucket,omitempty"`
+	DefaultBucket  string            `json:"defaultBucket,omitempty"`
+	// TrafficSplits splits clients between Buckets for these repositories,
+	// like RegistryConfig.TrafficSplits
+	TrafficSplits map[string][]WeightedBucketConfig `json:"trafficSplits,omitempty"`
+}
+
+// BucketConfig describes a blob mirror bucket
+type BucketConfig struct {
+	// Name identifies this bucket elsewhere in the config
+	Name string `json:"name"`
+	// Type is the kind of backend the bucket is, one of the Backend constants
+	// such as BackendS3, which is the default
+	Type string `json:"type,omitempty"`
+	// URL is the base URL for the bucket, blobs should be stored under it at
+	// /containers/images/sha256:$hash
+	//
+	// For BackendOCI this is the registry endpoint, and any path is a prefix
+	// for repositories, so blobs are at /v2/$path/$repo/blobs/sha256:$hash
+	URL string `json:"url"`
+	// Inventory optionally lists the blobs known to be in the bucket,
+	// so requests for them are redirected without checking the bucket first
+	Inventory *BlobInventoryConfig `json:"inventory,omitempty"`
+	// Region is the AWS region the bucket is in, if set the bucket is
+	// selected for clients in the nearest AWS regions that are not in
+	// RegistryConfig.RegionToBucket
+	Region string `json:"region,omitempty"`
+	// Fallbacks are the Names of buckets to check in order if a blob is not
+	// in this bucket, before falling back to the upstream registry
+	Fallbacks []string `json:"fallbacks,omitempty"`
+	// Signing optionally signs the URLs clients are redirected to and the
+	// HEADs checking for blobs, for private BackendS3 and BackendGCS buckets
+	Signing *BucketSigningConfig `json:"signing,omitempty"`
+	// RedirectURL is an optional base URL clients are redirected to instead
+	// of URL, such as a CDN in front of the bucket, URL is still checked
+	RedirectURL string `json:"redirectURL,omitempty"`
+	// CDNSigning optionally signs the URLs clients are redirected to at
+	// RedirectURL, which replaces Signing for them
+	CDNSigning *CDNSigningConfig `json:"cdnSigning,omitempty"`
+}
+
+// BucketSigningConfig configures signed URLs for a private bucket
+//
+// Credentials come from the standard provider chains, the AWS SDK default
+// credential chain for BackendS3 and Google Application Default Credentials
+// for BackendGCS, which must be a service account key to sign with.
+type BucketSigningConfig struct {
+	// Expiry is how long signed URLs are valid for as a Go duration,
+	// defaults to 5m and may be at most 7 days
+	Expiry string `json:"expiry,omitempty"`
+	// Region is the AWS region S3 URLs are signed for,
+	// defaults to BucketConfig.Region
+	Region string `json:"region,omitempty"`
+}
+
+// CDNSigningConfig configures CloudFront style signed URLs with a canned policy
+// https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/private-content-creating-signed-url-canned-policy.html
+type CDNSigningConfig struct {
+	// KeyPairID identifies the public key the CDN verifies signatures with
+	KeyPairID string `json:"keyPairID"`
+	// PrivateKeyFile is the path to the PEM encoded RSA private key to sign with
+	PrivateKeyFile string `json:"privateKeyFile"`
+	// Expiry is how long signed URLs are valid for as a Go duration,
+	// defaults to 5m and may be at most 7 days
+	Expiry string `json:"expiry,omitempty"`
+}
+
+// BlobInventoryConfig is the source of a bucket's blob inventory,
+// exactly one field must be set
+type BlobInventoryConfig struct {
+	// File is the path to a local file listing one blob digest per line
+	File string `json:"file,omitempty"`
+	// ListBucket lists the blobs in the bucket with the S3 ListObjectsV2 API,
+	// which must be allowed anonymously
+	ListBucket bool `json:"listBucket,omitempty"`
+}
+
+//go:embed default-config.yaml
+var defaultConfigYAML []byte
+
+// DefaultRegistryConfig returns the built-in configuration, see default-config.yaml
+func DefaultRegistryConfig() RegistryConfig {
+	// the default config is covered by unit tests, this should never panic
+	return mustParseRegistryConfig(defaultConfigYAML)
+}
+
+func mustParseRegistryConfig(contents []byte) RegistryConfig {
+	rc, err := ParseRegistryConfig(contents)
+	if err != nil {
+		panic(err)
+	}
+	return rc
+}
+
+// LoadRegistryConfig reads and validates a YAML or JSON config file
+func LoadRegistryConfig(path string) (RegistryConfig, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return RegistryConfig{}, err
+	}
+	rc, err := ParseRegistryConfig(contents)
+	if err != nil {
+		return RegistryConfig{}, fmt.Errorf("invalid config file %q: %w", path, err)
+	}
+	return rc, nil
+}
+
+// ParseRegistryConfig parses and validates YAML or JSON config contents
+//
+// Unknown fields are rejected so typos do not silently change routing.
+func ParseRegistryConfig(contents []byte) (RegistryConfig, error) {
+	rc := RegistryConfig{}
+	if err := yaml.UnmarshalStrict(contents, &rc); err != nil {
+		return RegistryConfig{}, err
+	}
+	if err := rc.Validate(); err != nil {
+		return RegistryConfig{}, err
+	}
+	return rc, nil
+}
+
+// SetDefaultBucketURL points DefaultBucket at the bucket with baseURL,
+// adding a bucket named "default" if none has this URL.
+//
+// This exists for compatibility with $DEFAULT_AWS_BASE_URL
+func (rc *RegistryConfig) SetDefaultBucketURL(baseURL string) {
+	for _, bucket := range rc.Buckets {
+		if bucket.URL == baseURL {
+			rc.DefaultBucket = bucket.Name
+			return
+		}
+	}
+	rc.Buckets = append(rc.Buckets, BucketConfig{Name: "default", URL: baseURL})
+	rc.DefaultBucket = "default"
+}
+
+// Validate checks that rc is a usable configuration, returning all problems found
+func (rc *RegistryConfig) Validate() error {
+	errs := []error{}
+	if err := validateBaseURL(rc.UpstreamRegistryEndpoint); err != nil {
+		errs = append(errs, fmt.Errorf("upstreamRegistryEndpoint: %w", err))
+	}
+	bucketNames := make(map[string]bool, len(rc.Buckets))
+	for i, bucket := range rc.Buckets {
+		if bucket.Name == "" {
+			errs = append(errs, fmt.Errorf("buckets[%d]: name must be set", i))
+		} else if bucketNames[bucket.Name] {
+			errs = append(errs, fmt.Errorf("buckets[%d]: duplicate name %q", i, bucket.Name))
+		}
+		bucketNames[bucket.Name] = true
+		if err := validateBaseURL(bucket.URL); err != nil {
+			errs = append(errs, fmt.Errorf("buckets[%d] (%q): url: %w", i, bucket.Name, err))
+		}
+		switch bucket.Type {
+		case "", BackendS3, BackendGCS, BackendAzure, BackendHTTP, BackendOCI:
+		default:
+			errs = append(errs, fmt.Errorf("buckets[%d] (%q): unknown type %q", i, bucket.Name, bucket.Type))
+		}
+		if inventory := bucket.Inventory; inventory != nil {
+			if (inventory.File == "") == !inventory.ListBucket {
+				errs = append(errs, fmt.Errorf("buckets[%d] (%q): inventory: exactly one of file or listBucket must be set", i, bucket.Name))
+			}
+			if bucket.Type == BackendOCI {
+				errs = append(errs, fmt.Errorf("buckets[%d] (%q): inventory: not supported for type %q", i, bucket.Name, bucket.Type))
+			} else if inventory.ListBucket && bucket.Type != "" && bucket.Type != BackendS3 {
+				errs = append(errs, fmt.Errorf("buckets[%d] (%q): inventory: listBucket is only supported for type %q", i, bucket.Name, BackendS3))
+			}
+		}
+		if _, ok := cloudcidrs.GetRegionInfo(cloudcidrs.IPInfo{Cloud: cloudcidrs.AWS, Region: bucket.Region}); bucket.Region != "" && !ok {
+			errs = append(errs, fmt.Errorf("buckets[%d] (%q): region: unknown AWS region %q", i, bucket.Name, bucket.Region))
+		}
+		if bucket.Signing != nil {
+			if err := bucket.validateSigning(); err != nil {
+				errs = append(errs, fmt.Errorf("buckets[%d] (%q): signing: %w", i, bucket.Name, err))
+			}
+		}
+		if err := bucket.validateRedirect(); err != nil {
+			errs = append(errs, fmt.Errorf("buckets[%d] (%q): %w", i, bucket.Name, err))
+		}
+	}
+	for i, bucket := range rc.Buckets {
+		fallbacks := map[string]bool{bucket.Name: true}
+		for _, name := range bucket.Fallbacks {
+			if !bucketNames[name] {
+				errs = append(errs, fmt.Errorf("buckets[%d] (%q): fallbacks: unknown bucket %q", i, bucket.Name, name))
+			} else if fallbacks[name] {
+				errs = append(errs, fmt.Errorf("buckets[%d] (%q): fallbacks: duplicate bucket %q", i, bucket.Name, name))
+			}
+			fallbacks[name] = true
+		}
+	}
+	if _, err := rc.fallbackBudget(); err != nil {
+		errs = append(errs, fmt.Errorf("fallbackBudget: %w", err))
+	}
+	knownRegion := knownRegions()
+	for region, name := range rc.RegionToBucket {
+		if !knownRegion(region) {
+			errs = append(errs, fmt.Errorf("regionToBucket[%q]: unknown AWS or Azure region", region))
+		}
+		if !bucketNames[name] {
+			errs = append(errs, fmt.Errorf("regionToBucket[%q]: unknown bucket %q", region, name))
+		}
+	}
+	if rc.DefaultBucket != "" && !bucketNames[rc.DefaultBucket] {
+		errs = append(errs, fmt.Errorf("defaultBucket: unknown bucket %q", rc.DefaultBucket))
+	}
+	ruleNames := make(map[string]bool, len(rc.RoutingRules))
+	for i, rule := range rc.RoutingRules {
+		if rule.Name == "" {
+			errs = append(errs, fmt.Errorf("routingRules[%d]: name must be set", i))
+		} else if ruleNames[rule.Name] {
+			errs = append(errs, fmt.Errorf("routingRules[%d]: duplicate name %q", i, rule.Name))
+		}
+		ruleNames[rule.Name] = true
+		if err := rule.validate(rc.Buckets, knownRegion); err != nil {
+			errs = append(errs, fmt.Errorf("routingRules[%d] (%q): %w", i, rule.Name, err))
+		}
+	}
+	if rc.RateLimits != nil {
+		if err := rc.RateLimits.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rateLimits: %w", err))
+		}
+	}
+	for region, split := range rc.TrafficSplits {
+		if !knownRegion(region) {
+			errs = append(errs, fmt.Errorf("trafficSplits[%q]: unknown AWS or Azure region", region))
+		}
+		if err := validateTrafficSplit(split, bucketNames); err != nil {
+			errs = append(errs, fmt.Errorf("trafficSplits[%q]: %w", region, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// knownRegions returns a func reporting whether region is an AWS or Azure
+// region clients may be detected in, which buckets can be selected for
+func knownRegions() func(region string) bool {
+	generated := map[string]bool{}
+	for _, info := range cloudcidrs.AllIPInfos() {
+		if info.Cloud == cloudcidrs.AWS || info.Cloud == cloudcidrs.Azure {
+			generated[info.Region] = true
+		}
+	}
+	return func(region string) bool {
+		if generated[region] {
+			return true
+		}
+		// the compiled-in ranges may lack regions, such as Azure regions
+		// until its snapshot is generated, so also accept regions we know
+		// the location of
+		for _, cloud := range []string{cloudcidrs.AWS, cloudcidrs.Azure} {
+			if _, ok := cloudcidrs.GetRegionInfo(cloudcidrs.IPInfo{Cloud: cloud, Region: region}); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// validateTrafficSplit checks split only uses buckets in bucketNames, once each,
+// and sends clients to at least one of them
+func validateTrafficSplit(split []WeightedBucketConfig, bucketNames map[string]bool) error {
+	var errs []error
+	total := 0
+	seen := make(map[string]bool, len(split))
+	for _, b := range split {
+		if !bucketNames[b.Bucket] {
+			errs = append(errs, fmt.Errorf("unknown bucket %q", b.Bucket))
+		} else if seen[b.Bucket] {
+			errs = append(errs, fmt.Errorf("duplicate bucket %q", b.Bucket))
+		}
+		seen[b.Bucket] = true
+		if b.Weight < 0 {
+			errs = append(errs, fmt.Errorf("bucket %q: weight must not be negative", b.Bucket))
+		}
+		total += b.Weight
+	}
+	if total <= 0 {
+		errs = append(errs, errors.New("at least one bucket must have a positive weight"))
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks the rate limits against the known clouds and regions
+func (c *RateLimitConfig) validate() error {
+	errs := []error{}
+	if err := c.RateLimit.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.IPv4PrefixLength < 0 || c.IPv4PrefixLength > 32 {
+		errs = append(errs, fmt.Errorf("ipv4PrefixLength: %d must be between 1 and 32, or 0 for the default", c.IPv4PrefixLength))
+	}
+	if c.IPv6PrefixLength < 0 || c.IPv6PrefixLength > 128 {
+		errs = append(errs, fmt.Errorf("ipv6PrefixLength: %d must be between 1 and 128, or 0 for the default", c.IPv6PrefixLength))
+	}
+	known := map[cloudcidrs.IPInfo]bool{}
+	for _, info := range cloudcidrs.AllIPInfos() {
+		known[info] = true
+		known[cloudcidrs.IPInfo{Cloud: info.Cloud}] = true
+	}
+	for cloud, cloudLimit := range c.Clouds {
+		if !known[cloudcidrs.IPInfo{Cloud: cloud}] {
+			errs = append(errs, fmt.Errorf("clouds[%q]: unknown cloud", cloud))
+		}
+		if err := cloudLimit.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("clouds[%q]: %w", cloud, err))
+		}
+		for region, limit := range cloudLimit.Regions {
+			if !known[cloudcidrs.IPInfo{Cloud: cloud, Region: region}] {
+				errs = append(errs, fmt.Errorf("clouds[%q].regions[%q]: unknown region", cloud, region))
+			}
+			if err := limit.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("clouds[%q].regions[%q]: %w", cloud, region, err))
+			}
+		}
+	}
+	for i, prefix := range c.Allowlist {
+		if _, err := netip.ParsePrefix(prefix); err != nil {
+			errs = append(errs, fmt.Errorf("allowlist[%d]: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks that limit can be enforced
+func (limit RateLimit) validate() error {
+	errs := []error{}
+	if limit.RequestsPerSecond < 0 || limit.PrefixRequestsPerSecond < 0 {
+		errs = append(errs, errors.New("requests per second must not be negative"))
+	}
+	if limit.RequestsPerSecond > 0 && limit.Burst < 1 {
+		errs = append(errs, errors.New("burst: must be at least 1 with requestsPerSecond"))
+	}
+	if limit.PrefixRequestsPerSecond > 0 && limit.PrefixBurst < 1 {
+		errs = append(errs, errors.New("prefixBurst: must be at least 1 with prefixRequestsPerSecond"))
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks rule given all the configured buckets
+func (rule *RoutingRuleConfig) validate(buckets []BucketConfig, knownRegion func(string) bool) error {
+	errs := []error{}
+	if (rule.Prefix == "") == (rule.Glob == "") {
+		errs = append(errs, errors.New("exactly one of prefix or glob must be set"))
+	}
+	if strings.HasPrefix(rule.Prefix, "/") || strings.HasSuffix(rule.Prefix, "/") {
+		errs = append(errs, fmt.Errorf("prefix: %q must not start or end with /", rule.Prefix))
+	}
+	if _, err := path.Match(rule.Glob, ""); err != nil {
+		errs = append(errs, fmt.Errorf("glob: %q: %w", rule.Glob, err))
+	}
+	if rule.StripPrefix && rule.Prefix == "" {
+		errs = append(errs, errors.New("stripPrefix: requires prefix"))
+	}
+	if err := validateBaseURL(rule.UpstreamRegistryEndpoint); err != nil {
+		errs = append(errs, fmt.Errorf("upstreamRegistryEndpoint: %w", err))
+	}
+	nameToBucket := make(map[string]BucketConfig, len(buckets))
+	for _, bucket := range buckets {
+		nameToBucket[bucket.Name] = bucket
+	}
+	ruleBuckets := make(map[string]bool, len(rule.Buckets))
+	for _, name := range rule.Buckets {
+		if _, ok := nameToBucket[name]; !ok {
+			errs = append(errs, fmt.Errorf("buckets: unknown bucket %q", name))
+		} else if ruleBuckets[name] {
+			errs = append(errs, fmt.Errorf("buckets: duplicate bucket %q", name))
+		}
+		ruleBuckets[name] = true
+	}
+	// fallbacks are followed within the rule's buckets, so they must be included
+	for _, name := range rule.Buckets {
+		for _, fallback := range nameToBucket[name].Fallbacks {
+			if !ruleBuckets[fallback] {
+				errs = append(errs, fmt.Errorf("buckets: bucket %q has fallback %q which is not in buckets", name, fallback))
+			}
+		}
+	}
+	for region, name := range rule.RegionToBucket {
+		if !knownRegion(region) {
+			errs = append(errs, fmt.Errorf("regionToBucket[%q]: unknown AWS or Azure region", region))
+		}
+		if !ruleBuckets[name] {
+			errs = append(errs, fmt.Errorf("regionToBucket[%q]: bucket %q is not in buckets", region, name))
+		}
+	}
+	if rule.DefaultBucket != "" && !ruleBuckets[rule.DefaultBucket] {
+		errs = append(errs, fmt.Errorf("defaultBucket: bucket %q is not in buckets", rule.DefaultBucket))
+	}
+	for region, split := range rule.TrafficSplits {
+		if !knownRegion(region) {
+			errs = append(errs, fmt.Errorf("trafficSplits[%q]: unknown AWS or Azure region", region))
+		}
+		// splits select from the rule's buckets, like regionToBucket
+		if err := validateTrafficSplit(split, ruleBuckets); err != nil {
+			errs = append(errs, fmt.Errorf("trafficSplits[%q]: %w", region, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// defaultFallbackBudget is the default for RegistryConfig.FallbackBudget
+const defaultFallbackBudget = time.Second
+
+// fallbackBudget returns the parsed FallbackBudget or the default
+func (rc *RegistryConfig) fallbackBudget() (time.Duration, error) {
+	if rc.FallbackBudget == "" {
+		return defaultFallbackBudget, nil
+	}
+	budget, err := time.ParseDuration(rc.FallbackBudget)
+	if err != nil {
+		return 0, err
+	}
+	if budget < 0 {
+		return 0, fmt.Errorf("%q must not be negative", rc.FallbackBudget)
+	}
+	return budget, nil
+}
+
+// validateSigning checks bucket.Signing, which must be set
+func (bucket *BucketConfig) validateSigning() error {
+	var errs []error
+	switch bucket.Type {
+	case "", BackendS3:
+		if bucket.signingRegion() == "" {
+			errs = append(errs, errors.New("region must be set if the bucket has no region"))
+		}
+	case BackendGCS:
+		if bucket.Signing.Region != "" {
+			errs = append(errs, fmt.Errorf("region is not supported for type %q", bucket.Type))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("not supported for type %q", bucket.Type))
+	}
+	if _, err := bucket.Signing.expiry(); err != nil {
+		errs = append(errs, fmt.Errorf("expiry: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// validateRedirect checks bucket.RedirectURL and bucket.CDNSigning
+func (bucket *BucketConfig) validateRedirect() error {
+	var errs []error
+	if bucket.RedirectURL != "" {
+		if err := validateBaseURL(bucket.RedirectURL); err != nil {
+			errs = append(errs, fmt.Errorf("redirectURL: %w", err))
+		} else if bucket.RedirectURL == bucket.URL {
+			errs = append(errs, errors.New("redirectURL: must differ from url"))
+		}
+		if bucket.Type == BackendOCI {
+			errs = append(errs, fmt.Errorf("redirectURL: not supported for type %q", bucket.Type))
+		}
+	}
+	if c := bucket.CDNSigning; c != nil {
+		if bucket.RedirectURL == "" {
+			errs = append(errs, errors.New("cdnSigning: redirectURL must be set"))
+		}
+		if c.KeyPairID == "" {
+			errs = append(errs, errors.New("cdnSigning: keyPairID must be set"))
+		}
+		if c.PrivateKeyFile == "" {
+			errs = append(errs, errors.New("cdnSigning: privateKeyFile must be set"))
+		}
+		if _, err := parseSigningExpiry(c.Expiry); err != nil {
+			errs = append(errs, fmt.Errorf("cdnSigning: expiry: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// signingRegion returns the AWS region to sign S3 URLs for
+func (bucket *BucketConfig) signingRegion() string {
+	if bucket.Signing.Region != "" {
+		return bucket.Signing.Region
+	}
+	return bucket.Region
+}
+
+// defaultSigningExpiry is the default for BucketSigningConfig.Expiry
+const defaultSigningExpiry = 5 * time.Minute
+
+// maxSigningExpiry is the longest S3 and GCS allow signed URLs to be valid
+const maxSigningExpiry = 7 * 24 * time.Hour
+
+// expiry returns the parsed Expiry or the default
+func (c *BucketSigningConfig) expiry() (time.Duration, error) {
+	return parseSigningExpiry(c.Expiry)
+}
+
+// parseSigningExpiry parses a signed URL expiry or returns the default
+func parseSigningExpiry(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultSigningExpiry, nil
+	}
+	expiry, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	// signed URLs expire in whole seconds
+	if expiry < time.Second || expiry > maxSigningExpiry {
+		return 0, fmt.Errorf("%q must be between 1s and %s", s, maxSigningExpiry)
+	}
+	return expiry, nil
+}
+
+// validateBaseURL ensures u is an absolute http(s) URL we can append paths to
+func validateBaseURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("%q must be an http or https URL", u)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("%q must include a host", u)
+	}
+	if strings.HasSuffix(u, "/") || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return fmt.Errorf("%q must not have a trailing slash, query, or fragment", u)
+	}
+	return nil
+}
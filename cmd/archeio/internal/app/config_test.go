@@ -0,0 +1,1000 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultRegistryConfig(t *testing.T) {
+	rc := DefaultRegistryConfig()
+	if err := rc.Validate(); err != nil {
+		t.Fatalf("default config is not valid: %v", err)
+	}
+	if rc.DefaultBucket != "us-east-1" {
+		t.Fatalf("unexpected default bucket: %q", rc.DefaultBucket)
+	}
+	// ensure we get a fresh copy each time
+	rc.RegionToBucket["eu-west-3"] = "bogus"
+	if DefaultRegistryConfig().RegionToBucket["eu-west-3"] != "eu-west-1" {
+		t.Fatal("DefaultRegistryConfig returned shared state")
+	}
+}
+
+func TestMustParseRegistryConfig(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic parsing invalid config")
+		}
+	}()
+	mustParseRegistryConfig([]byte("{"))
+}
+
+func TestParseRegistryConfig(t *testing.T) {
+	testCases := []struct {
+		Name        string
+		Contents    string
+		ExpectError bool
+	}{
+		{
+			Name: "valid YAML",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+upstreamRegistryPath: images
+buckets:
+- name: a
+  url: https://a.example
+regionToBucket:
+  us-east-1: a
+defaultBucket: a
+`,
+		},
+		{
+			Name:     "valid JSON",
+			Contents: `{"upstreamRegistryEndpoint": "https://registry.example", "buckets": [{"name": "a", "url": "http://a.example/prefix"}]}`,
+		},
+		{
+			Name:        "unknown field",
+			Contents:    `{"upstreamRegistryEndpoint": "https://registry.example", "defaultBuckets": "a"}`,
+			ExpectError: true,
+		},
+		{
+			Name:        "not YAML",
+			Contents:    `{`,
+			ExpectError: true,
+		},
+		{
+			Name:        "missing upstream",
+			Contents:    `{"buckets": []}`,
+			ExpectError: true,
+		},
+		{
+			Name:        "unparsable upstream",
+			Contents:    `{"upstreamRegistryEndpoint": "https://[::1"}`,
+			ExpectError: true,
+		},
+		{
+			Name:        "upstream without host",
+			Contents:    `{"upstreamRegistryEndpoint": "https://"}`,
+			ExpectError: true,
+		},
+		{
+			Name:        "upstream with trailing slash",
+			Contents:    `{"upstreamRegistryEndpoint": "https://registry.example/"}`,
+			ExpectError: true,
+		},
+		{
+			Name: "bucket inventories",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  inventory:
+    file: /inventory/a.txt
+- name: b
+  url: https://b.example
+  inventory:
+    listBucket: true
+`,
+		},
+		{
+			Name: "empty bucket inventory",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  inventory: {}
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "ambiguous bucket inventory",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  inventory:
+    file: /inventory/a.txt
+    listBucket: true
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "bucket fallbacks",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+fallbackBudget: 500ms
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b, c]
+- name: b
+  url: https://b.example
+  fallbacks: [a]
+- name: c
+  url: https://c.example
+  region: us-east-1
+`,
+		},
+		{
+			Name: "bucket types",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: s3
+  type: s3
+  url: https://s3.example
+  inventory:
+    listBucket: true
+- name: gcs
+  type: gcs
+  url: https://storage.googleapis.com/bucket
+  inventory:
+    file: /inventory/gcs.txt
+- name: azure
+  type: azure
+  url: https://account.blob.core.windows.net/container
+- name: http
+  type: http
+  url: https://mirror.example
+- name: oci
+  type: oci
+  url: https://registry.example/mirror
+`,
+		},
+		{
+			Name: "unknown bucket type",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  type: ftp
+  url: https://a.example
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "oci bucket inventory",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  type: oci
+  url: https://a.example
+  inventory:
+    file: /inventory/a.txt
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "gcs bucket listing",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  type: gcs
+  url: https://storage.googleapis.com/a
+  inventory:
+    listBucket: true
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "signed buckets",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  region: us-east-1
+  signing: {}
+- name: b
+  type: s3
+  url: https://b.example
+  signing:
+    region: auto
+    expiry: 30s
+- name: c
+  type: gcs
+  url: https://storage.googleapis.com/c
+  signing:
+    expiry: 168h
+`,
+		},
+		{
+			Name: "signed bucket without region",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  signing: {}
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "signed gcs bucket with region",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  type: gcs
+  url: https://storage.googleapis.com/a
+  signing:
+    region: us-east-1
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "signed http bucket",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  type: http
+  url: https://a.example
+  signing: {}
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "unparsable signing expiry",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  type: gcs
+  url: https://storage.googleapis.com/a
+  signing:
+    expiry: soon
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "too long signing expiry",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  type: gcs
+  url: https://storage.googleapis.com/a
+  signing:
+    expiry: 169h
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "cdn redirects",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  redirectURL: https://cdn.example
+  cdnSigning:
+    keyPairID: K2JCJMDEHXQW5F
+    privateKeyFile: /keys/cdn.pem
+    expiry: 10m
+- name: b
+  type: gcs
+  url: https://storage.googleapis.com/b
+  redirectURL: https://cdn.example/b
+- name: c
+  type: azure
+  url: https://account.blob.core.windows.net/c
+  redirectURL: https://cdn.example/c
+  cdnSigning:
+    keyPairID: K2JCJMDEHXQW5F
+    privateKeyFile: /keys/cdn.pem
+`,
+		},
+		{
+			Name: "invalid cdn redirects",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  redirectURL: cdn.example
+- name: b
+  url: https://b.example
+  redirectURL: https://b.example
+- name: c
+  type: oci
+  url: https://c.example
+  redirectURL: https://cdn.example
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "invalid cdn signing",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  cdnSigning:
+    expiry: forever
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "unknown bucket region",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  region: us-central1
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "unknown bucket fallback",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "duplicate bucket fallback",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b, b]
+- name: b
+  url: https://b.example
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "bucket falls back to itself",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [a]
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "unparsable fallback budget",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+fallbackBudget: soon
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "negative fallback budget",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+fallbackBudget: -1s
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "unnamed bucket",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- url: https://a.example
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "duplicate bucket",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+- name: a
+  url: https://b.example
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "bad bucket URL",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: s3://a
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "region to unknown bucket",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+regionToBucket:
+  us-east-1: a
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "traffic splits",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+- name: b
+  url: https://b.example
+trafficSplits:
+  us-east-1:
+  - bucket: a
+    weight: 90
+  - bucket: b
+    weight: 10
+  eu-west-1:
+  - bucket: a
+    weight: 0
+  - bucket: b
+    weight: 1
+`,
+		},
+		{
+			Name: "invalid traffic splits",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+trafficSplits:
+  us-east-1:
+  - bucket: a
+    weight: -1
+  - bucket: a
+    weight: 1
+  - bucket: c
+    weight: 1
+  eu-west-1: []
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "traffic split without weights",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+trafficSplits:
+  us-east-1:
+  - bucket: a
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "unknown regions",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+regionToBucket:
+  us-east-9: a
+trafficSplits:
+  useast:
+  - bucket: a
+    weight: 1
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "azure regions",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+- name: b
+  url: https://b.example
+regionToBucket:
+  westeurope: a
+trafficSplits:
+  eastus:
+  - bucket: a
+    weight: 1
+  - bucket: b
+    weight: 1
+`,
+		},
+		{
+			Name: "unknown default bucket",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+defaultBucket: a
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rules",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  prefix: team
+  stripPrefix: true
+  upstreamRegistryEndpoint: https://other.example
+  upstreamRegistryPath: team/images
+  buckets: [a, b]
+  regionToBucket:
+    us-east-1: b
+  defaultBucket: a
+  trafficSplits:
+    eu-west-1:
+    - bucket: a
+      weight: 9
+    - bucket: b
+      weight: 1
+- name: tools
+  glob: "tools-*"
+  upstreamRegistryEndpoint: https://other.example
+`,
+		},
+		{
+			Name: "routing rule without name",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- prefix: team
+  upstreamRegistryEndpoint: https://other.example
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "duplicate routing rule name",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  prefix: team
+  upstreamRegistryEndpoint: https://other.example
+- name: team
+  prefix: other
+  upstreamRegistryEndpoint: https://other.example
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule without prefix or glob",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  upstreamRegistryEndpoint: https://other.example
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule with prefix and glob",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  prefix: team
+  glob: "team/*"
+  upstreamRegistryEndpoint: https://other.example
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule prefix with slash",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  prefix: team/
+  upstreamRegistryEndpoint: https://other.example
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule invalid glob",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  glob: "team/["
+  upstreamRegistryEndpoint: https://other.example
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule strip prefix without prefix",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  glob: "team/*"
+  stripPrefix: true
+  upstreamRegistryEndpoint: https://other.example
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule without upstream",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  prefix: team
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule unknown bucket",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  prefix: team
+  upstreamRegistryEndpoint: https://other.example
+  buckets: [d]
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule duplicate bucket",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  prefix: team
+  upstreamRegistryEndpoint: https://other.example
+  buckets: [b, b]
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule bucket fallback not in buckets",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  prefix: team
+  upstreamRegistryEndpoint: https://other.example
+  buckets: [a]
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule region to bucket not in buckets",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  prefix: team
+  upstreamRegistryEndpoint: https://other.example
+  buckets: [c]
+  regionToBucket:
+    us-east-1: b
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule unknown regions",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+routingRules:
+- name: team
+  prefix: team
+  upstreamRegistryEndpoint: https://other.example
+  buckets: [a]
+  regionToBucket:
+    us-east-9: a
+  trafficSplits:
+    useast:
+    - bucket: a
+      weight: 1
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule traffic split not in buckets",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+- name: b
+  url: https://b.example
+routingRules:
+- name: team
+  prefix: team
+  upstreamRegistryEndpoint: https://other.example
+  buckets: [a]
+  trafficSplits:
+    us-east-1:
+    - bucket: b
+      weight: 1
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "routing rule default bucket not in buckets",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+buckets:
+- name: a
+  url: https://a.example
+  fallbacks: [b]
+- name: b
+  url: https://b.example
+- name: c
+  url: https://c.example
+routingRules:
+- name: team
+  prefix: team
+  upstreamRegistryEndpoint: https://other.example
+  buckets: [c]
+  defaultBucket: b
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "rate limits",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+rateLimits:
+  requestsPerSecond: 10
+  burst: 20
+  prefixRequestsPerSecond: 100
+  prefixBurst: 200
+  ipv4PrefixLength: 16
+  ipv6PrefixLength: 48
+  clouds:
+    AWS:
+      requestsPerSecond: 50
+      burst: 100
+      regions:
+        us-east-1:
+          requestsPerSecond: 100
+          burst: 200
+  allowlist: [10.0.0.0/8, "2001:db8::/32"]
+`,
+			ExpectError: false,
+		},
+		{
+			Name: "invalid rate limits",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+rateLimits:
+  requestsPerSecond: -1
+  prefixRequestsPerSecond: 1
+  ipv4PrefixLength: 33
+  ipv6PrefixLength: 129
+  clouds:
+    AWS:
+      requestsPerSecond: 1
+      regions:
+        mars-1: {}
+        us-east-1:
+          prefixRequestsPerSecond: 1
+    Moon: {}
+  allowlist: [10.0.0.0]
+`,
+			ExpectError: true,
+		},
+		{
+			Name: "unknown rate limit field",
+			Contents: `
+upstreamRegistryEndpoint: https://registry.example
+rateLimits:
+  requestPerSecond: 1
+`,
+			ExpectError: true,
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			_, err := ParseRegistryConfig([]byte(tc.Contents))
+			if err != nil && !tc.ExpectError {
+				t.Fatalf("unexpected error: %v", err)
+			} else if err == nil && tc.ExpectError {
+				t.Fatal("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestLoadRegistryConfig(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	if err := os.WriteFile(valid, defaultConfigYAML, 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte("defaultBucket: nope\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := LoadRegistryConfig(valid)
+	if err != nil {
+		t.Fatalf("unexpected error loading valid config: %v", err)
+	}
+	if len(rc.Buckets) != len(DefaultRegistryConfig().Buckets) {
+		t.Fatal("loaded config does not match default")
+	}
+	if _, err := LoadRegistryConfig(invalid); err == nil {
+		t.Fatal("expected error loading invalid config but got none")
+	}
+	if _, err := LoadRegistryConfig(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Fatal("expected error loading missing config but got none")
+	}
+}
+
+func TestSetDefaultBucketURL(t *testing.T) {
+	rc := DefaultRegistryConfig()
+	numBuckets := len(rc.Buckets)
+	// existing bucket
+	rc.SetDefaultBucketURL("https://prod-registry-k8s-io-eu-west-1.s3.dualstack.eu-west-1.amazonaws.com")
+	if rc.DefaultBucket != "eu-west-1" || len(rc.Buckets) != numBuckets {
+		t.Fatalf("expected existing bucket to become default, got: %q", rc.DefaultBucket)
+	}
+	// new bucket
+	rc.SetDefaultBucketURL("https://mirror.example")
+	if rc.DefaultBucket != "default" || len(rc.Buckets) != numBuckets+1 {
+		t.Fatalf("expected new default bucket, got: %q", rc.DefaultBucket)
+	}
+	if err := rc.Validate(); err != nil {
+		t.Fatalf("config invalid after SetDefaultBucketURL: %v", err)
+	}
+}
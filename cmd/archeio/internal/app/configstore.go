@@ -0,0 +1,196 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ConfigStore holds the RegistryConfig requests are currently served with,
+// which may be atomically swapped at runtime with Update.
+//
+// Each request loads the current config once, so in-flight requests finish
+// with the config they started with.
+//
+// Use NewConfigStore to instantiate
+type ConfigStore struct {
+	current atomic.Pointer[routingConfig]
+}
+
+// routingConfig is a validated RegistryConfig with lookups derived from it
+type routingConfig struct {
+	RegistryConfig
+	// buckets are all the buckets, selected from by the catch-all rule
+	buckets *regionBuckets
+	// rules are the RoutingRules followed by the catch-all rule
+	rules []*routingRule
+	// fallbackBudget is the parsed FallbackBudget
+	fallbackBudget time.Duration
+	// rateLimits is nil unless RateLimits is set
+	rateLimits *rateLimits
+	// hash identifies this config in logs
+	hash string
+}
+
+func newRoutingConfig(rc RegistryConfig) (*routingConfig, error) {
+	if err := rc.Validate(); err != nil {
+		return nil, err
+	}
+	// encoding/json sorts map keys, so this is stable for equivalent configs
+	// and marshalling cannot fail for RegistryConfig
+	b, _ := json.Marshal(rc)
+	h := sha256.Sum256(b)
+	// validation does not read files, so check the CDN signing keys here
+	// to reject configs that could not sign any redirects
+	var errs []error
+	for i, bucket := range rc.Buckets {
+		if bucket.CDNSigning == nil {
+			continue
+		}
+		if _, err := loadRSAPrivateKey(bucket.CDNSigning.PrivateKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("buckets[%d] (%q): cdnSigning: %w", i, bucket.Name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	// this was already validated
+	fallbackBudget, _ := rc.fallbackBudget()
+	buckets := newRegionBuckets(rc)
+	return &routingConfig{
+		RegistryConfig: rc,
+		buckets:        buckets,
+		rules:          newRoutingRules(rc, buckets),
+		fallbackBudget: fallbackBudget,
+		rateLimits:     newRateLimits(rc.RateLimits),
+		hash:           hex.EncodeToString(h[:]),
+	}, nil
+}
+
+// NewConfigStore returns a ConfigStore serving rc, or an error if rc is invalid
+func NewConfigStore(rc RegistryConfig) (*ConfigStore, error) {
+	c, err := newRoutingConfig(rc)
+	if err != nil {
+		return nil, err
+	}
+	s := &ConfigStore{}
+	s.current.Store(c)
+	recordTrafficSplits(c.RegistryConfig)
+	return s, nil
+}
+
+// load returns the current config, callers should load once per request
+func (s *ConfigStore) load() *routingConfig {
+	return s.current.Load()
+}
+
+// Hash returns an identifier for the current config
+func (s *ConfigStore) Hash() string {
+	return s.load().hash
+}
+
+// Update validates rc and then swaps it in for new requests.
+//
+// If rc is invalid the error is returned and the current config keeps serving.
+func (s *ConfigStore) Update(rc RegistryConfig) error {
+	c, err := newRoutingConfig(rc)
+	if err != nil {
+		klog.ErrorS(err, "rejected invalid config, keeping current config", "hash", s.Hash())
+		return err
+	}
+	previous := s.current.Swap(c)
+	if previous.hash == c.hash {
+		klog.V(2).InfoS("config unchanged", "hash", c.hash)
+		return nil
+	}
+	klog.InfoS("reloaded config", "hash", c.hash, "previousHash", previous.hash)
+	recordTrafficSplits(c.RegistryConfig)
+	return nil
+}
+
+// ConfigWatcher reloads a ConfigStore on signals or when a config file changes
+type ConfigWatcher struct {
+	// Store is updated with the result of Load on each reload
+	Store *ConfigStore
+	Load  func() (RegistryConfig, error)
+	// Path is checked for changes every PollInterval, if set
+	Path         string
+	PollInterval time.Duration
+	// Signals triggers a reload on every receive, typically SIGHUP
+	Signals <-chan os.Signal
+}
+
+// Run reloads until ctx is done
+func (w *ConfigWatcher) Run(ctx context.Context) {
+	var poll <-chan time.Time
+	lastStat := ""
+	if w.Path != "" {
+		ticker := time.NewTicker(w.PollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+		lastStat = statKey(w.Path)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-w.Signals:
+			klog.InfoS("reloading config", "signal", sig)
+			w.reload()
+		case <-poll:
+			// only reload when the file looks different, to avoid
+			// re-parsing it and re-logging any errors constantly
+			if stat := statKey(w.Path); stat != lastStat {
+				lastStat = stat
+				klog.InfoS("reloading config", "path", w.Path)
+				w.reload()
+			}
+		}
+	}
+}
+
+func (w *ConfigWatcher) reload() {
+	rc, err := w.Load()
+	if err != nil {
+		klog.ErrorS(err, "failed to load config, keeping current config", "hash", w.Store.Hash())
+		return
+	}
+	// Update logs the result
+	_ = w.Store.Update(rc)
+}
+
+// statKey summarizes the file at path such that changes are detectable
+//
+// os.Stat follows symlinks, so this also detects kubernetes ConfigMap
+// volume updates which swap a symlink
+func statKey(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return fmt.Sprintf("%v/%d", info.ModTime(), info.Size())
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewConfigStore(t *testing.T) {
+	if _, err := NewConfigStore(RegistryConfig{}); err == nil {
+		t.Fatal("expected error for invalid config but got none")
+	}
+	s, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Hash() == "" {
+		t.Fatal("expected config hash to be set")
+	}
+	// equivalent configs should hash the same
+	other, _ := NewConfigStore(DefaultRegistryConfig())
+	if other.Hash() != s.Hash() {
+		t.Fatalf("hash is not stable: %q != %q", other.Hash(), s.Hash())
+	}
+}
+
+func TestConfigStoreUpdate(t *testing.T) {
+	s, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// a request in flight holds the config it loaded
+	inFlight := s.load()
+	originalHash := s.Hash()
+
+	// invalid configs are rejected and the current config remains
+	invalid := DefaultRegistryConfig()
+	invalid.DefaultBucket = "does-not-exist"
+	if err := s.Update(invalid); err == nil {
+		t.Fatal("expected error updating to invalid config")
+	}
+	if s.Hash() != originalHash {
+		t.Fatal("invalid config replaced current config")
+	}
+
+	// unchanged configs are fine
+	if err := s.Update(DefaultRegistryConfig()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Hash() != originalHash {
+		t.Fatal("hash changed for identical config")
+	}
+
+	// valid configs are swapped in
+	updated := DefaultRegistryConfig()
+	updated.RegionToBucket["us-east-1"] = "eu-west-1"
+	if err := s.Update(updated); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Hash() == originalHash {
+		t.Fatal("hash did not change for updated config")
+	}
+	if url := s.load().buckets.ForRegion("us-east-1").URL(); url != "https://prod-registry-k8s-io-eu-west-1.s3.dualstack.eu-west-1.amazonaws.com" {
+		t.Fatalf("updated config not in use, got: %q", url)
+	}
+	if url := inFlight.buckets.ForRegion("us-east-1").URL(); url != "https://prod-registry-k8s-io-us-east-1.s3.dualstack.us-east-1.amazonaws.com" {
+		t.Fatalf("in-flight config changed, got: %q", url)
+	}
+}
+
+func TestConfigWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, defaultConfigYAML, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	originalHash := s.Hash()
+	loads := make(chan struct{}, 10)
+	signals := make(chan os.Signal)
+	w := &ConfigWatcher{
+		Store: s,
+		Load: func() (RegistryConfig, error) {
+			defer func() { loads <- struct{}{} }()
+			return LoadRegistryConfig(path)
+		},
+		Path:         path,
+		PollInterval: time.Millisecond,
+		Signals:      signals,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	// a signal reloads the unchanged file
+	signals <- syscall.SIGHUP
+	<-loads
+	if s.Hash() != originalHash {
+		t.Fatal("hash changed for unchanged file")
+	}
+
+	// a broken file is rejected
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	<-loads
+	if s.Hash() != originalHash {
+		t.Fatal("invalid config file replaced current config")
+	}
+
+	// a changed file is picked up without a signal
+	updated := strings.Replace(string(defaultConfigYAML), "defaultBucket: us-east-1", "defaultBucket: eu-west-1", 1)
+	if err := os.WriteFile(path, []byte(updated), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Load returns before the store is updated, so wait for that too
+	<-loads
+	for deadline := time.Now().Add(5 * time.Second); s.load().DefaultBucket != "eu-west-1"; {
+		if time.Now().After(deadline) {
+			t.Fatalf("updated config file not loaded, hash: %q", s.Hash())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestConfigWatcherLoadError(t *testing.T) {
+	s, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := &ConfigWatcher{
+		Store: s,
+		Load: func() (RegistryConfig, error) {
+			return RegistryConfig{}, errors.New("nope")
+		},
+	}
+	// without a path this only reloads on signals
+	signals := make(chan os.Signal)
+	w.Signals = signals
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	signals <- syscall.SIGHUP
+	cancel()
+	<-done
+	if s.load().DefaultBucket != "us-east-1" {
+		t.Fatal("failed load replaced current config")
+	}
+}
+
+func TestStatKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	missing := statKey(path)
+	if err := os.WriteFile(path, []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if statKey(path) == missing {
+		t.Fatal("expected stat to change after creating file")
+	}
+}
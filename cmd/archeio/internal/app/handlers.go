@@ -18,22 +18,25 @@ package app
 
 import (
 	"net/http"
-	"path"
+	"net/netip"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"k8s.io/klog/v2"
 
+	"k8s.io/registry.k8s.io/pkg/net/cidrs"
 	"k8s.io/registry.k8s.io/pkg/net/clientip"
 	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs"
 )
 
-type RegistryConfig struct {
-	UpstreamRegistryEndpoint string
-	UpstreamRegistryPath     string
-	InfoURL                  string
-	PrivacyURL               string
-	DefaultAWSBaseURL        string
+// HandlerOptions configures optional MakeHandler behavior
+type HandlerOptions struct {
+	// AccessLog receives an entry for every registry API request, if set
+	AccessLog *AccessLogger
+	// Health serves /healthz and /readyz, if set
+	Health *Health
 }
 
 // MakeHandler returns the root archeio HTTP handler
@@ -41,16 +44,24 @@ type RegistryConfig struct {
 // upstream registry should be the url to the primary registry
 // archeio is fronting.
 //
+// router decides how registry API requests are served, see Router
+//
 // Exact behavior should be documented in docs/request-handling.md
-func MakeHandler(rc RegistryConfig) http.Handler {
-	blobs := newCachedBlobChecker()
-	doV2 := makeV2Handler(rc, blobs)
+func MakeHandler(router *Router, opts HandlerOptions) http.Handler {
+	configs := router.configs
+	doV2 := makeV2Handler(router, opts.AccessLog)
+	var doHealthz, doReadyz func(w http.ResponseWriter, r *http.Request)
+	if opts.Health != nil {
+		doHealthz = makeHealthzHandler()
+		doReadyz = makeReadyzHandler(opts.Health)
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// only allow GET, HEAD
 		// this is all a client needs to pull images
 		// we do *not* support mutation
 		if r.Method != http.MethodGet && r.Method != http.MethodHead {
-			http.Error(w, "Only GET and HEAD are allowed.", http.StatusMethodNotAllowed)
+			w.Header().Set("Allow", "GET, HEAD")
+			writeOCIError(w, http.StatusMethodNotAllowed, ociErrorUnsupported, "Only GET and HEAD are allowed.", r.Method)
 			return
 		}
 		// all valid registry requests should be at /v2/
@@ -60,29 +71,146 @@ func MakeHandler(rc RegistryConfig) http.Handler {
 		case strings.HasPrefix(path, "/v2"):
 			doV2(w, r)
 		case path == "/":
-			http.Redirect(w, r, rc.InfoURL, http.StatusTemporaryRedirect)
+			http.Redirect(w, r, configs.load().InfoURL, http.StatusTemporaryRedirect)
 		case strings.HasPrefix(path, "/privacy"):
-			http.Redirect(w, r, rc.PrivacyURL, http.StatusTemporaryRedirect)
+			http.Redirect(w, r, configs.load().PrivacyURL, http.StatusTemporaryRedirect)
+		case path == "/healthz" && doHealthz != nil:
+			doHealthz(w, r)
+		case path == "/readyz" && doReadyz != nil:
+			doReadyz(w, r)
 		default:
 			klog.V(2).InfoS("unknown request", "path", path)
-			http.NotFound(w, r)
+			writeOCIError(w, http.StatusNotFound, ociErrorUnsupported, "not found", path)
 		}
 	})
 }
 
-func makeV2Handler(rc RegistryConfig, blobs blobChecker) func(w http.ResponseWriter, r *http.Request) {
-	// matches blob requests, captures the requested blob hash
+// routeDecision describes how a registry API request is handled
+//
+// See makeV2Router
+type routeDecision struct {
+	// Status is the HTTP status code to serve
+	Status int `json:"status"`
+	// Error and ErrorCode are served as an OCI error body for error statuses
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+	// Redirect is the redirect target, if any
+	Redirect string `json:"redirect,omitempty"`
+	// Route is the routing outcome for redirects, see requestsTotal
+	Route string `json:"route,omitempty"`
+	// Backend is the bucket name or "upstream" for redirects
+	Backend string `json:"backend,omitempty"`
+	// RoutingRule is the name of the RoutingRuleConfig the request matched,
+	// if any, see RegistryConfig.RoutingRules
+	RoutingRule string `json:"routingRule,omitempty"`
+	// client info, only detected when needed for routing or metrics
+	ClientIP string `json:"clientIP,omitempty"`
+	Cloud    string `json:"cloud,omitempty"`
+	Region   string `json:"region,omitempty"`
+	// MatchedPrefix is the cloud IP range the client IP matched, if any
+	MatchedPrefix string `json:"matchedPrefix,omitempty"`
+	// BucketURL is the base URL of the bucket selected for blob requests, if any
+	BucketURL string `json:"bucketURL,omitempty"`
+	// TrafficSplit is the weights of the buckets the client's region is split
+	// between, if any, see RegistryConfig.TrafficSplits
+	TrafficSplit string `json:"trafficSplit,omitempty"`
+	// CheckedBuckets are the names of the buckets checked for the blob in order
+	CheckedBuckets []string `json:"checkedBuckets,omitempty"`
+	// BlobCacheHit is set if the blob existence check was made
+	BlobCacheHit *bool `json:"blobCacheHit,omitempty"`
+	// ManifestURL is the upstream URL of manifests served from the manifest cache
+	ManifestURL string `json:"manifestURL,omitempty"`
+	// ManifestCache is the manifest cache result, see manifestCacheTotal
+	ManifestCache string `json:"manifestCache,omitempty"`
+	// BlobFillURL is where blobs missing from the blob disk cache are downloaded from
+	BlobFillURL string `json:"blobFillURL,omitempty"`
+	// BlobDiskCache is the blob disk cache result, see blobDiskCacheTotal
+	BlobDiskCache string `json:"blobDiskCache,omitempty"`
+	// ReferrersURL is the upstream URL of referrers API requests served by archeio
+	ReferrersURL string `json:"referrersURL,omitempty"`
+	// Referrers is the referrers result, see referrersTotal
+	Referrers string `json:"referrers,omitempty"`
+	// RateLimit is the scope of the rate limit throttled requests exceeded,
+	// see RegistryConfig.RateLimits
+	RateLimit string `json:"rateLimit,omitempty"`
+	// RetryAfter is when throttled requests may be retried in seconds
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// backendUpstream is the routeDecision.Backend for the upstream registry
+const backendUpstream = "upstream"
+
+func makeV2Handler(router *Router, accessLog *AccessLogger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// the config may be swapped at any time, use a consistent
+		// config for the entirety of this request
+		rc := router.configs.load()
+		d, throttled := router.throttle(r, rc)
+		if !throttled {
+			d = router.route(r, rc)
+		}
+		switch {
+		case d.Route == routeCachedManifest:
+			d = router.manifests.serve(w, r, d)
+		case d.Route == routeReferrers:
+			d = router.referrers.serve(w, r, d)
+		case d.Route == routeCachedBlob || d.BlobFillURL != "":
+			d = router.serveDiskBlob(w, r, rc, d)
+		default:
+			writeRouteDecision(w, r, d)
+		}
+		if d.Route != "" {
+			recordRoute(d.Route, cloudcidrs.IPInfo{Cloud: d.Cloud, Region: d.Region})
+		}
+		accessLog.Log(r, d, time.Since(start))
+	}
+}
+
+// writeRouteDecision serves d for requests that archeio does not serve content for
+func writeRouteDecision(w http.ResponseWriter, r *http.Request, d routeDecision) {
+	switch {
+	case d.Redirect != "":
+		http.Redirect(w, r, d.Redirect, d.Status)
+	case d.Error != "":
+		if d.RetryAfter != 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(d.RetryAfter))
+		}
+		writeOCIError(w, d.Status, d.ErrorCode, d.Error, "")
+	default:
+		// this can only be the /v2/ API check, see makeV2Router
+		//
+		// NOTE: OCI does not require this, but the docker v2 spec include it, and GCR sets this
+		// Docker distribution v2 clients may fallback to an older version if this is not set.
+		w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+		w.WriteHeader(d.Status)
+	}
+}
+
+// makeV2Router returns a function that decides how to handle registry API
+// requests given the current config, without actually serving them
+//
+// Clients are mapped to their cloud and region with regionMapper.
+func makeV2Router(blobs blobChecker, regionMapper cidrs.PrefixMapper[cloudcidrs.IPInfo]) func(r *http.Request, rc *routingConfig) routeDecision {
+	// matches blob requests, captures the requested repository name and blob hash
 	// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pull
 	// Blobs are at `/v2/<name>/blobs/<digest>`
 	// Note that ':' cannot be contained in <name> but *must* be contained in <digest>
 	// <digest> also cannot contain `/` so we can use a relatively simple and cheap regex
 	// to match blob requests and capture the digest
-	reBlob := regexp.MustCompile("^/v2/.*/blobs/([^/]+:[a-zA-Z0-9=_-]+)$")
-	// initialize map of clientIP to AWS region
-	regionMapper := cloudcidrs.NewIPMapper()
-	// capture these in a http handler lambda
-	return func(w http.ResponseWriter, r *http.Request) {
+	reBlob := regexp.MustCompile("^/v2/(.*)/blobs/([^/]+:[a-zA-Z0-9=_-]+)$")
+	// capture these in a routing lambda
+	return func(r *http.Request, rc *routingConfig) routeDecision {
 		rPath := r.URL.Path
+		// requests for some repositories may be routed differently
+		rule, repo := routingRuleFor(rc.rules, rPath)
+		upstream := func(route string, d routeDecision) routeDecision {
+			d.Status = http.StatusTemporaryRedirect
+			d.Redirect = rule.upstreamRedirectURL(rPath, repo)
+			d.Route = route
+			d.Backend = backendUpstream
+			return d
+		}
 
 		// we only care about publicly readable GCR as the backing registry
 		// or publicly readable blob storage
@@ -98,71 +226,116 @@ func makeV2Handler(rc RegistryConfig, blobs blobChecker) func(w http.ResponseWri
 		// returning 401, prompting token auth
 		if rPath == "/v2/" || rPath == "/v2" {
 			klog.V(2).InfoS("serving 200 OK for /v2/ check", "path", rPath)
-			// NOTE: OCI does not require this, but the docker v2 spec include it, and GCR sets this
-			// Docker distribution v2 clients may fallback to an older version if this is not set.
-			w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
-			w.WriteHeader(http.StatusOK)
-			return
+			return routeDecision{Status: http.StatusOK}
 		}
 		// we don't support the non-standard _catalog API
 		// https://github.com/kubernetes/registry.k8s.io/issues/162
 		if rPath == "/v2/_catalog" {
-			http.Error(w, "_catalog is not supported", http.StatusNotFound)
-			return
+			return routeDecision{Status: http.StatusNotFound, Error: "_catalog is not supported", ErrorCode: ociErrorUnsupported}
+		}
+		// everything below redirects based on the request path, which must
+		// not be able to escape the upstream registry path
+		if d, invalid := validateRequest(rPath); invalid {
+			klog.V(2).InfoS("rejecting invalid request", "path", rPath, "error", d.Error)
+			return d
 		}
 
 		// check if blob request
 		matches := reBlob.FindStringSubmatch(rPath)
-		if len(matches) != 2 {
+		if len(matches) != 3 {
 			// not a blob request so forward it to the main upstream registry
-			redirectURL := upstreamRedirectURL(rc, rPath)
-			klog.V(2).InfoS("redirecting manifest request to upstream registry", "path", rPath, "redirect", redirectURL)
-			http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
-			return
+			// client cloud info is only for metrics and logs here, so this is best-effort
+			d := routeDecision{}
+			if clientIP, err := clientip.Get(r); err == nil {
+				d = clientDecision(regionMapper, clientIP)
+			}
+			d.RoutingRule = rule.name
+			if reReferrers.MatchString(rPath) {
+				// served by archeio so that registries without the referrers API work
+				d.Status = http.StatusOK
+				d.Route = routeReferrers
+				d.Backend = backendUpstream
+				d.ReferrersURL = rule.upstreamRedirectURL(rPath, repo)
+				return d
+			}
+			d = upstream(routeUpstreamManifest, d)
+			klog.V(2).InfoS("redirecting manifest request to upstream registry", "path", rPath, "redirect", d.Redirect)
+			return d
 		}
 		// it is a blob request, grab the hash for later
-		digest := matches[1]
+		// backends store blobs under the repository name we redirect to
+		digest, backendRepo := matches[2], rule.repository(repo)
 
 		// for blob requests, check the client IP and determine the best backend
 		clientIP, err := clientip.Get(r)
 		if err != nil {
 			// this should not happen
 			klog.ErrorS(err, "failed to get client IP")
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+			return routeDecision{Status: http.StatusBadRequest, Error: err.Error(), ErrorCode: ociErrorDenied}
 		}
 
 		// if client is coming from GCP, stay in GCP
-		ipInfo, ipIsKnown := regionMapper.GetIP(clientIP)
-		if ipIsKnown && ipInfo.Cloud == cloudcidrs.GCP {
-			redirectURL := upstreamRedirectURL(rc, rPath)
-			klog.V(2).InfoS("redirecting GCP blob request to upstream registry", "path", rPath, "redirect", redirectURL)
-			http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
-			return
+		d := clientDecision(regionMapper, clientIP)
+		d.RoutingRule = rule.name
+		if d.Cloud == cloudcidrs.GCP {
+			d = upstream(routeGCPBlob, d)
+			klog.V(2).InfoS("redirecting GCP blob request to upstream registry", "path", rPath, "redirect", d.Redirect)
+			return d
 		}
 
 		// check if blob is available in our AWS layer storage for the region
-		region := ""
-		if ipIsKnown {
-			region = ipInfo.Region
+		candidates := rule.buckets.Candidates(d.Region, clientIP)
+		d.TrafficSplit = rule.buckets.TrafficSplit(d.Region)
+		if len(candidates) == 0 {
+			// no bucket configured for this client, serve from upstream
+			d = upstream(routeUnmappedBlob, d)
+			klog.V(2).InfoS("redirecting unmapped blob request to upstream registry", "path", rPath, "redirect", d.Redirect)
+			return d
 		}
-		bucketURL := awsRegionToHostURL(region, rc.DefaultAWSBaseURL)
-		// this matches GCR's GCS layout, which we will use for other buckets
-		blobURL := bucketURL + "/containers/images/" + digest
-		if blobs.BlobExists(blobURL) {
-			// blob known to be available in AWS, redirect client there
-			klog.V(2).InfoS("redirecting blob request to AWS", "path", rPath)
-			http.Redirect(w, r, blobURL, http.StatusTemporaryRedirect)
-			return
+		d.BucketURL = candidates[0].URL()
+		// we would rather serve from another nearby bucket than go cross-cloud,
+		// but only as long as the client isn't left waiting too long
+		start := time.Now()
+		for i, bucket := range candidates {
+			if i > 0 && time.Since(start) >= rc.fallbackBudget {
+				klog.V(2).InfoS("skipping fallback buckets, latency budget exceeded", "path", rPath, "checked", d.CheckedBuckets)
+				break
+			}
+			exists, cached := blobs.BlobExists(bucket, backendRepo, digest)
+			d.BlobCacheHit = &cached
+			d.CheckedBuckets = append(d.CheckedBuckets, bucket.Name())
+			if exists {
+				// private buckets need the redirect signed for the client's request
+				redirect, err := bucket.SignURL(r.Context(), r.Method, bucket.BlobURL(backendRepo, digest))
+				if err != nil {
+					klog.ErrorS(err, "failed to sign blob redirect", "bucket", bucket.Name())
+					continue
+				}
+				// blob known to be available in the bucket, redirect client there
+				klog.V(2).InfoS("redirecting blob request to bucket", "path", rPath, "bucket", bucket.Name())
+				d.Status = http.StatusTemporaryRedirect
+				d.Redirect = redirect
+				d.Route = routeS3Blob
+				if i > 0 {
+					d.Route = routeS3FallbackBlob
+				}
+				d.Backend = bucket.Name()
+				return d
+			}
 		}
 
 		// fall back to redirect to upstream
-		redirectURL := upstreamRedirectURL(rc, rPath)
-		klog.V(2).InfoS("redirecting blob request to upstream registry", "path", rPath, "redirect", redirectURL)
-		http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
+		d = upstream(routeS3Fallback, d)
+		klog.V(2).InfoS("redirecting blob request to upstream registry", "path", rPath, "redirect", d.Redirect)
+		return d
 	}
 }
 
-func upstreamRedirectURL(rc RegistryConfig, originalPath string) string {
-	return rc.UpstreamRegistryEndpoint + path.Join("/v2/", rc.UpstreamRegistryPath, strings.TrimPrefix(originalPath, "/v2"))
+// clientDecision returns a routeDecision populated with the client info for clientIP
+func clientDecision(regionMapper cidrs.PrefixMapper[cloudcidrs.IPInfo], clientIP netip.Addr) routeDecision {
+	d := routeDecision{ClientIP: clientIP.String()}
+	if ipInfo, prefix, matched := regionMapper.GetIPPrefix(clientIP); matched {
+		d.Cloud, d.Region, d.MatchedPrefix = ipInfo.Cloud, ipInfo.Region, prefix.String()
+	}
+	return d
 }
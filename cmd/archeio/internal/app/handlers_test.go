@@ -17,26 +17,32 @@ limitations under the License.
 package app
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestMakeHandler(t *testing.T) {
-	registryConfig := RegistryConfig{
-		// the v2 test below tests being redirected to k8s.gcr.io as that one doesn't have UpstreamRegistryPath
-		UpstreamRegistryEndpoint: "https://us.gcr.io",
-		UpstreamRegistryPath:     "k8s-artifacts-prod",
-		InfoURL:                  "https://github.com/kubernetes/k8s.io/tree/main/registry.k8s.io",
-		PrivacyURL:               "https://www.linuxfoundation.org/privacy-policy/",
+	registryConfig := DefaultRegistryConfig()
+	// the v2 test below tests being redirected to k8s.gcr.io as that one doesn't have UpstreamRegistryPath
+	registryConfig.UpstreamRegistryEndpoint = "https://us.gcr.io"
+	registryConfig.UpstreamRegistryPath = "k8s-artifacts-prod"
+	registryConfig.InfoURL = "https://github.com/kubernetes/k8s.io/tree/main/registry.k8s.io"
+	configs, err := NewConfigStore(registryConfig)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
 	}
-	handler := MakeHandler(registryConfig)
+	handler := MakeHandler(mustNewRouter(t, configs), HandlerOptions{})
 	testCases := []struct {
-		Name           string
-		Request        *http.Request
-		ExpectedStatus int
-		ExpectedURL    string
+		Name              string
+		Request           *http.Request
+		ExpectedStatus    int
+		ExpectedURL       string
+		ExpectedErrorCode string
 	}{
 		{
 			Name:           "/",
@@ -51,9 +57,10 @@ func TestMakeHandler(t *testing.T) {
 			ExpectedURL:    registryConfig.PrivacyURL,
 		},
 		{
-			Name:           "/v3/",
-			Request:        httptest.NewRequest("GET", "http://localhost:8080/v3/", nil),
-			ExpectedStatus: http.StatusNotFound,
+			Name:              "/v3/",
+			Request:           httptest.NewRequest("GET", "http://localhost:8080/v3/", nil),
+			ExpectedStatus:    http.StatusNotFound,
+			ExpectedErrorCode: ociErrorUnsupported,
 		},
 		{
 			Name:           "/v2/",
@@ -71,9 +78,10 @@ func TestMakeHandler(t *testing.T) {
 			ExpectedStatus: http.StatusOK,
 		},
 		{
-			Name:           "/v2/",
-			Request:        httptest.NewRequest("POST", "http://localhost:8080/v2/", nil),
-			ExpectedStatus: http.StatusMethodNotAllowed,
+			Name:              "/v2/",
+			Request:           httptest.NewRequest("POST", "http://localhost:8080/v2/", nil),
+			ExpectedStatus:    http.StatusMethodNotAllowed,
+			ExpectedErrorCode: ociErrorUnsupported,
 		},
 		{
 			Name:           "/v2/pause/manifests/latest",
@@ -125,6 +133,9 @@ func TestMakeHandler(t *testing.T) {
 					http.StatusText(response.StatusCode),
 				)
 			}
+			if tc.ExpectedErrorCode != "" {
+				expectOCIError(t, response, tc.ExpectedErrorCode)
+			}
 			location, err := response.Location()
 			if err != nil {
 				if !errors.Is(err, http.ErrNoLocation) {
@@ -143,21 +154,34 @@ func TestMakeHandler(t *testing.T) {
 	}
 }
 
+// expectOCIError expects response to have an OCI error body with code
+func expectOCIError(t *testing.T, response *http.Response, code string) {
+	t.Helper()
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("expected Content-Type application/json, got: %q", contentType)
+	}
+	var body ociErrors
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode OCI error body: %v", err)
+	}
+	if len(body.Errors) != 1 || body.Errors[0].Code != code || body.Errors[0].Message == "" {
+		t.Fatalf("expected an OCI error with code %q, got: %+v", code, body)
+	}
+}
+
 type fakeBlobsChecker struct {
 	knownURLs map[string]bool
 }
 
-func (f *fakeBlobsChecker) BlobExists(blobURL string) bool {
-	return f.knownURLs[blobURL]
+func (f *fakeBlobsChecker) BlobExists(bucket Backend, repo, digest string) (exists, cached bool) {
+	return f.knownURLs[bucket.CheckURL(repo, digest)], false
 }
 
 func TestMakeV2Handler(t *testing.T) {
-	registryConfig := RegistryConfig{
-		UpstreamRegistryEndpoint: "https://k8s.gcr.io",
-		UpstreamRegistryPath:     "",
-		InfoURL:                  "https://github.com/kubernetes/k8s.io/tree/main/registry.k8s.io",
-		PrivacyURL:               "https://www.linuxfoundation.org/privacy-policy/",
-	}
+	registryConfig := DefaultRegistryConfig()
+	registryConfig.UpstreamRegistryEndpoint = "https://k8s.gcr.io"
+	registryConfig.UpstreamRegistryPath = ""
+	registryConfig.InfoURL = "https://github.com/kubernetes/k8s.io/tree/main/registry.k8s.io"
 	blobs := fakeBlobsChecker{
 		knownURLs: map[string]bool{
 			"https://prod-registry-k8s-io-ap-south-1.s3.dualstack.ap-south-1.amazonaws.com/containers/images/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e":         true,
@@ -169,12 +193,17 @@ func TestMakeV2Handler(t *testing.T) {
 			"https://prod-registry-k8s-io-us-west-1.s3.dualstack.us-west-1.amazonaws.com/containers/images/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e":           true,
 		},
 	}
-	handler := makeV2Handler(registryConfig, &blobs)
+	configs, err := NewConfigStore(registryConfig)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	handler := makeV2Handler(newRouter(configs, &blobs), nil)
 	testCases := []struct {
-		Name           string
-		Request        *http.Request
-		ExpectedStatus int
-		ExpectedURL    string
+		Name              string
+		Request           *http.Request
+		ExpectedStatus    int
+		ExpectedURL       string
+		ExpectedErrorCode string
 	}{
 		{
 			Name:           "/v2/pause/blobs/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e",
@@ -185,9 +214,9 @@ func TestMakeV2Handler(t *testing.T) {
 		{
 			// future-proofing tests for other digest algorithms, even though we only have sha256 content as of March 2023
 			Name:           "/v2/pause/blobs/sha512:3b0998121425143be7164ea1555efbdf5b8a02ceedaa26e01910e7d017ff78ddbba27877bd42510a06cc14ac1bc6c451128ca3f0d0afba28b695e29b2702c9c7",
-			Request:        httptest.NewRequest("GET", "http://localhost:8080/v2/pause/blobs/sha256:3b0998121425143be7164ea1555efbdf5b8a02ceedaa26e01910e7d017ff78ddbba27877bd42510a06cc14ac1bc6c451128ca3f0d0afba28b695e29b2702c9c7", nil),
+			Request:        httptest.NewRequest("GET", "http://localhost:8080/v2/pause/blobs/sha512:3b0998121425143be7164ea1555efbdf5b8a02ceedaa26e01910e7d017ff78ddbba27877bd42510a06cc14ac1bc6c451128ca3f0d0afba28b695e29b2702c9c7", nil),
 			ExpectedStatus: http.StatusTemporaryRedirect,
-			ExpectedURL:    "https://k8s.gcr.io/v2/pause/blobs/sha256:3b0998121425143be7164ea1555efbdf5b8a02ceedaa26e01910e7d017ff78ddbba27877bd42510a06cc14ac1bc6c451128ca3f0d0afba28b695e29b2702c9c7",
+			ExpectedURL:    "https://k8s.gcr.io/v2/pause/blobs/sha512:3b0998121425143be7164ea1555efbdf5b8a02ceedaa26e01910e7d017ff78ddbba27877bd42510a06cc14ac1bc6c451128ca3f0d0afba28b695e29b2702c9c7",
 		},
 		{
 			Name: "Somehow bogus remote addr, /v2/pause/blobs/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e",
@@ -198,7 +227,8 @@ func TestMakeV2Handler(t *testing.T) {
 			}(),
 			// NOTE: this one really shouldn't happen, but we want full test coverage
 			// This should only happen with a bug in the stdlib http server ...
-			ExpectedStatus: http.StatusBadRequest,
+			ExpectedStatus:    http.StatusBadRequest,
+			ExpectedErrorCode: ociErrorDenied,
 		},
 		{
 			Name: "/v2/_catalog",
@@ -207,7 +237,8 @@ func TestMakeV2Handler(t *testing.T) {
 				r.RemoteAddr = "35.180.1.1:888"
 				return r
 			}(),
-			ExpectedStatus: http.StatusNotFound,
+			ExpectedStatus:    http.StatusNotFound,
+			ExpectedErrorCode: ociErrorUnsupported,
 		},
 		{
 			Name: "AWS IP, /v2/pause/blobs/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e",
@@ -253,6 +284,9 @@ func TestMakeV2Handler(t *testing.T) {
 					http.StatusText(response.StatusCode),
 				)
 			}
+			if tc.ExpectedErrorCode != "" {
+				expectOCIError(t, response, tc.ExpectedErrorCode)
+			}
 			location, err := response.Location()
 			if err != nil {
 				if !errors.Is(err, http.ErrNoLocation) {
@@ -270,3 +304,36 @@ func TestMakeV2Handler(t *testing.T) {
 		})
 	}
 }
+
+func TestMakeV2HandlerNoDefaultBucket(t *testing.T) {
+	registryConfig := DefaultRegistryConfig()
+	registryConfig.UpstreamRegistryEndpoint = "https://k8s.gcr.io"
+	registryConfig.UpstreamRegistryPath = ""
+	registryConfig.DefaultBucket = ""
+	// every bucket URL exists, so only an unmapped client should go upstream
+	blobs := fakeBlobsChecker{knownURLs: map[string]bool{}}
+	for _, bucket := range registryConfig.Buckets {
+		blobs.knownURLs[bucket.URL+"/containers/images/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e"] = true
+	}
+	configs, err := NewConfigStore(registryConfig)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	handler := makeV2Handler(newRouter(configs, &blobs), nil)
+	unmappedBefore := testutil.ToFloat64(requestsTotal.WithLabelValues(routeUnmappedBlob, "", ""))
+	// default httptest RemoteAddr is not a known cloud IP
+	r := httptest.NewRequest("GET", "http://localhost:8080/v2/pause/blobs/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e", nil)
+	recorder := httptest.NewRecorder()
+	handler(recorder, r)
+	response := recorder.Result()
+	if response.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("expected status: %v, but got status: %v", http.StatusText(http.StatusTemporaryRedirect), http.StatusText(response.StatusCode))
+	}
+	const expectedURL = "https://k8s.gcr.io/v2/pause/blobs/sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e"
+	if location := response.Header.Get("Location"); location != expectedURL {
+		t.Fatalf("expected url: %q, but got: %q", expectedURL, location)
+	}
+	if unmapped := testutil.ToFloat64(requestsTotal.WithLabelValues(routeUnmappedBlob, "", "")); unmapped != unmappedBefore+1 {
+		t.Fatalf("expected %s route to be counted once, got: %v", routeUnmappedBlob, unmapped-unmappedBefore)
+	}
+}
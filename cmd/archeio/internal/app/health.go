@@ -0,0 +1,212 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Health tracks archeio readiness by periodically probing the upstream
+// registry and each configured bucket, see Run
+//
+// Use NewHealth to instantiate
+type Health struct {
+	configs      *ConfigStore
+	client       *http.Client
+	shuttingDown atomic.Bool
+	lastProbe    atomic.Pointer[probeResult]
+}
+
+// NewHealth returns a Health probing the backends in the current config in configs
+func NewHealth(configs *ConfigStore) *Health {
+	return &Health{
+		configs: configs,
+		client: &http.Client{
+			// ensure sensible timeouts
+			Timeout: time.Second * 5,
+			// a redirect is still a response from the backend
+			CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// probeResult is the result of probing all backends once
+type probeResult struct {
+	Time       time.Time
+	ConfigHash string
+	Backends   []backendStatus
+}
+
+// backendStatus is the result of probing one backend
+type backendStatus struct {
+	Name           string  `json:"name"`
+	URL            string  `json:"url"`
+	Healthy        bool    `json:"healthy"`
+	StatusCode     int     `json:"statusCode,omitempty"`
+	Error          string  `json:"error,omitempty"`
+	LatencySeconds float64 `json:"latencySeconds"`
+}
+
+// healthStatus is the /readyz response, see docs/admin.md
+type healthStatus struct {
+	Ready        bool            `json:"ready"`
+	ShuttingDown bool            `json:"shuttingDown"`
+	ConfigHash   string          `json:"configHash,omitempty"`
+	LastProbe    string          `json:"lastProbe,omitempty"`
+	Backends     []backendStatus `json:"backends"`
+}
+
+// Run probes the backends immediately and then every interval until ctx is done
+func (h *Health) Run(ctx context.Context, interval time.Duration) {
+	h.probe(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.probe(ctx)
+		}
+	}
+}
+
+// SetShuttingDown permanently marks archeio as not ready, this should be
+// called at the start of graceful shutdown so load balancers drain traffic
+func (h *Health) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// status returns the current health status
+//
+// archeio is ready once the upstream registry has been probed successfully
+// and until shutdown starts. Buckets are reported but do not affect
+// readiness, as blob requests fall back to the upstream registry.
+func (h *Health) status() healthStatus {
+	s := healthStatus{
+		ShuttingDown: h.shuttingDown.Load(),
+		Backends:     []backendStatus{},
+	}
+	result := h.lastProbe.Load()
+	if result == nil {
+		return s
+	}
+	s.ConfigHash = result.ConfigHash
+	s.LastProbe = result.Time.UTC().Format(time.RFC3339Nano)
+	s.Backends = result.Backends
+	// the upstream is always probed first
+	s.Ready = !s.ShuttingDown && result.Backends[0].Healthy
+	return s
+}
+
+// probe probes all backends in the current config concurrently
+func (h *Health) probe(ctx context.Context) {
+	rc := h.configs.load()
+	targets := []BucketConfig{{Name: backendUpstream, URL: rc.UpstreamRegistryEndpoint + "/v2/"}}
+	for _, rule := range rc.RoutingRules {
+		targets = append(targets, BucketConfig{Name: backendUpstream + ":" + rule.Name, URL: rule.UpstreamRegistryEndpoint + "/v2/"})
+	}
+	for _, bucket := range rc.buckets.backends {
+		targets = append(targets, BucketConfig{Name: bucket.Name(), URL: bucket.HealthURL()})
+	}
+	results := make([]backendStatus, len(targets))
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = h.probeBackend(ctx, targets[i])
+		}(i)
+	}
+	wg.Wait()
+	// the results are not meaningful if we were interrupted
+	if ctx.Err() != nil {
+		return
+	}
+	// drop backends that are no longer configured
+	backendUp.Reset()
+	for _, result := range results {
+		up := 0.0
+		if result.Healthy {
+			up = 1
+		} else {
+			klog.InfoS("backend probe failed", "backend", result.Name, "url", result.URL, "statusCode", result.StatusCode, "error", result.Error)
+		}
+		backendUp.WithLabelValues(result.Name).Set(up)
+	}
+	h.lastProbe.Store(&probeResult{
+		Time:       time.Now(),
+		ConfigHash: rc.hash,
+		Backends:   results,
+	})
+}
+
+// probeBackend checks that target responds to HEAD without a server error
+//
+// any other response is healthy, the upstream registry will typically
+// respond 401 and buckets 403, which still shows they are serving
+func (h *Health) probeBackend(ctx context.Context, target BucketConfig) backendStatus {
+	s := backendStatus{Name: target.Name, URL: target.URL}
+	r, err := http.NewRequestWithContext(ctx, http.MethodHead, target.URL, nil)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	start := time.Now()
+	resp, err := h.client.Do(r)
+	s.LatencySeconds = time.Since(start).Seconds()
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	resp.Body.Close()
+	s.StatusCode = resp.StatusCode
+	s.Healthy = resp.StatusCode < http.StatusInternalServerError
+	return s
+}
+
+// makeHealthzHandler serves liveness, which only requires that we are serving
+func makeHealthzHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("ok\n"))
+	}
+}
+
+// makeReadyzHandler serves h's readiness and backend status as JSON
+func makeReadyzHandler(h *Health) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		s := h.status()
+		w.Header().Set("Content-Type", "application/json")
+		if s.Ready {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		// this can only fail writing to the client, which we can't report
+		_ = json.NewEncoder(w).Encode(s)
+	}
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newHealthTestConfig returns a config with an upstream and bucket served
+// by the given status codes, and a bucket that is not reachable at all
+func newHealthTestConfig(t *testing.T, upstreamStatus, bucketStatus int) RegistryConfig {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/v2/" {
+			t.Errorf("unexpected upstream probe: %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(upstreamStatus)
+	}))
+	t.Cleanup(upstream.Close)
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		// only used for redirect statuses, which should not be followed
+		w.Header().Set("Location", "/elsewhere")
+		w.WriteHeader(bucketStatus)
+	}))
+	t.Cleanup(bucket.Close)
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	rc := DefaultRegistryConfig()
+	rc.UpstreamRegistryEndpoint = upstream.URL
+	rc.Buckets = []BucketConfig{
+		{Name: "bucket", URL: bucket.URL},
+		{Name: "unreachable", URL: unreachable.URL},
+	}
+	rc.RegionToBucket = map[string]string{}
+	rc.DefaultBucket = "bucket"
+	return rc
+}
+
+func TestHealthStatus(t *testing.T) {
+	testCases := []struct {
+		Name           string
+		UpstreamStatus int
+		BucketStatus   int
+		ExpectReady    bool
+	}{
+		{
+			Name:           "upstream requires auth",
+			UpstreamStatus: http.StatusUnauthorized,
+			BucketStatus:   http.StatusForbidden,
+			ExpectReady:    true,
+		},
+		{
+			Name:           "redirecting bucket",
+			UpstreamStatus: http.StatusOK,
+			BucketStatus:   http.StatusTemporaryRedirect,
+			ExpectReady:    true,
+		},
+		{
+			Name:           "unhealthy bucket",
+			UpstreamStatus: http.StatusOK,
+			BucketStatus:   http.StatusServiceUnavailable,
+			ExpectReady:    true,
+		},
+		{
+			Name:           "unhealthy upstream",
+			UpstreamStatus: http.StatusInternalServerError,
+			BucketStatus:   http.StatusOK,
+			ExpectReady:    false,
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			configs, err := NewConfigStore(newHealthTestConfig(t, tc.UpstreamStatus, tc.BucketStatus))
+			if err != nil {
+				t.Fatalf("unexpected error creating config store: %v", err)
+			}
+			h := NewHealth(configs)
+			if s := h.status(); s.Ready || len(s.Backends) != 0 {
+				t.Fatalf("expected not ready before probing, got: %+v", s)
+			}
+
+			h.probe(context.Background())
+			s := h.status()
+			if s.Ready != tc.ExpectReady || s.ShuttingDown || s.ConfigHash != configs.Hash() || s.LastProbe == "" {
+				t.Fatalf("unexpected status: %+v", s)
+			}
+			if len(s.Backends) != 3 {
+				t.Fatalf("expected upstream and two buckets, got: %+v", s.Backends)
+			}
+			upstream, bucket, unreachable := s.Backends[0], s.Backends[1], s.Backends[2]
+			if upstream.Name != backendUpstream || upstream.StatusCode != tc.UpstreamStatus || upstream.Healthy != tc.ExpectReady {
+				t.Errorf("unexpected upstream status: %+v", upstream)
+			}
+			if bucket.Name != "bucket" || bucket.StatusCode != tc.BucketStatus || bucket.Healthy != (tc.BucketStatus < 500) {
+				t.Errorf("unexpected bucket status: %+v", bucket)
+			}
+			if unreachable.Name != "unreachable" || unreachable.Healthy || unreachable.Error == "" {
+				t.Errorf("unexpected unreachable bucket status: %+v", unreachable)
+			}
+
+			h.SetShuttingDown()
+			if s := h.status(); s.Ready || !s.ShuttingDown {
+				t.Fatalf("expected not ready after shutdown starts, got: %+v", s)
+			}
+		})
+	}
+}
+
+func TestHealthProbeMetrics(t *testing.T) {
+	configs, err := NewConfigStore(newHealthTestConfig(t, http.StatusOK, http.StatusForbidden))
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	NewHealth(configs).probe(context.Background())
+	if v := testutil.ToFloat64(backendUp.WithLabelValues(backendUpstream)); v != 1 {
+		t.Errorf("expected upstream to be up, got: %v", v)
+	}
+	if v := testutil.ToFloat64(backendUp.WithLabelValues("unreachable")); v != 0 {
+		t.Errorf("expected unreachable bucket to be down, got: %v", v)
+	}
+}
+
+func TestHealthProbeRoutingRules(t *testing.T) {
+	rc := newHealthTestConfig(t, http.StatusOK, http.StatusOK)
+	rc.RoutingRules = []RoutingRuleConfig{{
+		Name:                     "team",
+		Prefix:                   "team",
+		UpstreamRegistryEndpoint: rc.UpstreamRegistryEndpoint,
+	}}
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	h := NewHealth(configs)
+	h.probe(context.Background())
+	s := h.status()
+	if len(s.Backends) != 4 {
+		t.Fatalf("expected upstreams and two buckets, got: %+v", s.Backends)
+	}
+	// routing rule upstreams are probed after the main upstream
+	if upstream := s.Backends[1]; upstream.Name != "upstream:team" || !upstream.Healthy {
+		t.Fatalf("unexpected routing rule upstream status: %+v", upstream)
+	}
+}
+
+func TestHealthProbeBackendInvalidURL(t *testing.T) {
+	configs, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	s := NewHealth(configs).probeBackend(context.Background(), BucketConfig{Name: "invalid", URL: "http://%zz"})
+	if s.Healthy || s.Error == "" {
+		t.Fatalf("expected invalid URL to be unhealthy with an error, got: %+v", s)
+	}
+}
+
+func TestHealthRun(t *testing.T) {
+	probes := make(chan struct{}, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		probes <- struct{}{}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer upstream.Close()
+	rc := DefaultRegistryConfig()
+	rc.UpstreamRegistryEndpoint = upstream.URL
+	rc.Buckets = nil
+	rc.RegionToBucket = map[string]string{}
+	rc.DefaultBucket = ""
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	h := NewHealth(configs)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+	// the initial probe and at least one periodic probe
+	for i := 0; i < 2; i++ {
+		select {
+		case <-probes:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for probe")
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for Run to return")
+	}
+	if !h.status().Ready {
+		t.Fatalf("expected ready, got: %+v", h.status())
+	}
+}
+
+func TestMakeHandlerHealth(t *testing.T) {
+	configs, err := NewConfigStore(newHealthTestConfig(t, http.StatusUnauthorized, http.StatusOK))
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	h := NewHealth(configs)
+	handler := MakeHandler(mustNewRouter(t, configs), HandlerOptions{Health: h})
+	get := func(path string) *http.Response {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "http://localhost:8080"+path, nil))
+		return recorder.Result()
+	}
+
+	if response := get("/healthz"); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected healthz to be OK, got: %v", response.Status)
+	}
+	if response := get("/readyz"); response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected readyz to be unavailable before probing, got: %v", response.Status)
+	}
+	h.probe(context.Background())
+	response := get("/readyz")
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected readyz to be OK after probing, got: %v", response.Status)
+	}
+	body, _ := io.ReadAll(response.Body)
+	s := healthStatus{}
+	if err := json.Unmarshal(body, &s); err != nil {
+		t.Fatalf("failed to decode readyz response %q: %v", body, err)
+	}
+	if !s.Ready || len(s.Backends) != 3 {
+		t.Fatalf("unexpected readyz response: %s", body)
+	}
+	h.SetShuttingDown()
+	if response := get("/readyz"); response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected readyz to be unavailable after shutdown starts, got: %v", response.Status)
+	}
+
+	// not served without Health
+	handler = MakeHandler(mustNewRouter(t, configs), HandlerOptions{})
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if response := get(path); response.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected %s to be not found without Health, got: %v", path, response.Status)
+		}
+	}
+}
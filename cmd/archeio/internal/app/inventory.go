@@ -0,0 +1,209 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// blobInventory holds the blobs known to exist in each bucket,
+// see BlobInventoryConfig
+//
+// A nil *blobInventory contains nothing.
+type blobInventory struct {
+	// bucket URL to a bucketInventory, each is replaced as a whole
+	buckets sync.Map
+}
+
+// bucketInventory is the set of blob digests in the bucket named name
+type bucketInventory struct {
+	name    string
+	digests map[string]struct{}
+}
+
+// Contains returns true if blobURL is in the inventory for its bucket
+func (i *blobInventory) Contains(blobURL string) bool {
+	if i == nil {
+		return false
+	}
+	bucketURL, digest, found := strings.Cut(blobURL, blobPathPrefix)
+	if !found {
+		return false
+	}
+	inventory, ok := i.buckets.Load(bucketURL)
+	if !ok {
+		return false
+	}
+	_, ok = inventory.(*bucketInventory).digests[digest]
+	return ok
+}
+
+// replace sets the inventory for the bucket named name at bucketURL
+func (i *blobInventory) replace(name, bucketURL string, digests map[string]struct{}) {
+	if previous, loaded := i.buckets.Swap(bucketURL, &bucketInventory{name: name, digests: digests}); loaded && previous.(*bucketInventory).name != name {
+		blobInventoryBlobs.DeleteLabelValues(previous.(*bucketInventory).name)
+	}
+	blobInventoryBlobs.WithLabelValues(name).Set(float64(len(digests)))
+}
+
+// retain drops the inventory for buckets not in bucketURLs
+func (i *blobInventory) retain(bucketURLs map[string]bool) {
+	i.buckets.Range(func(k, v any) bool {
+		if !bucketURLs[k.(string)] {
+			i.buckets.Delete(k)
+			blobInventoryBlobs.DeleteLabelValues(v.(*bucketInventory).name)
+		}
+		return true
+	})
+}
+
+// refresh loads the inventory for every bucket in rc that has one configured
+//
+// If loading fails for a bucket, the previous inventory for it is kept.
+func (i *blobInventory) refresh(ctx context.Context, client *http.Client, rc *routingConfig) {
+	configured := map[string]bool{}
+	for _, bucket := range rc.Buckets {
+		if bucket.Inventory == nil {
+			continue
+		}
+		configured[bucket.URL] = true
+		digests, err := loadBlobInventory(ctx, client, bucket)
+		if err != nil {
+			klog.ErrorS(err, "failed to load blob inventory", "bucket", bucket.Name)
+			blobInventoryErrors.WithLabelValues(bucket.Name).Inc()
+			continue
+		}
+		klog.V(2).InfoS("loaded blob inventory", "bucket", bucket.Name, "blobs", len(digests))
+		i.replace(bucket.Name, bucket.URL, digests)
+	}
+	i.retain(configured)
+}
+
+// RunInventory loads the blob inventories configured for each bucket immediately
+// and then every interval until ctx is done, see BlobInventoryConfig
+func (rt *Router) RunInventory(ctx context.Context, interval time.Duration) {
+	rt.LoadInventory(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rt.LoadInventory(ctx)
+		}
+	}
+}
+
+// LoadInventory loads the blob inventories configured for each bucket once
+func (rt *Router) LoadInventory(ctx context.Context) {
+	client := &http.Client{
+		// listing may take many requests, but each should be quick
+		Timeout: time.Second * 30,
+	}
+	rt.inventory.refresh(ctx, client, rt.configs.load())
+}
+
+// loadBlobInventory returns the set of blob digests in bucket's inventory
+func loadBlobInventory(ctx context.Context, client *http.Client, bucket BucketConfig) (map[string]struct{}, error) {
+	if bucket.Inventory.ListBucket {
+		return listBucketBlobs(ctx, client, bucket.URL)
+	}
+	contents, err := os.ReadFile(bucket.Inventory.File)
+	if err != nil {
+		return nil, err
+	}
+	return parseBlobInventory(contents)
+}
+
+// parseBlobInventory parses an inventory file
+//
+// Each line is a blob digest, optionally prefixed by the blob path in the bucket,
+// so both `sha256:$hash` and `containers/images/sha256:$hash` are accepted.
+// Empty lines and lines starting with # are ignored.
+func parseBlobInventory(contents []byte) (map[string]struct{}, error) {
+	digests := map[string]struct{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest := strings.TrimPrefix(strings.TrimPrefix(line, "/"), blobKeyPrefix)
+		if !strings.Contains(digest, ":") || strings.Contains(digest, "/") {
+			return nil, fmt.Errorf("line %d: %q is not a blob digest", lineNumber, line)
+		}
+		digests[digest] = struct{}{}
+	}
+	return digests, scanner.Err()
+}
+
+// listBucketResult is the subset of the S3 ListObjectsV2 response we need
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+}
+
+// listBucketBlobs lists the blob digests in the S3 bucket at bucketURL
+func listBucketBlobs(ctx context.Context, client *http.Client, bucketURL string) (map[string]struct{}, error) {
+	digests := map[string]struct{}{}
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", blobKeyPrefix)
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, bucketURL+"/?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		result := listBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("listing bucket failed with status %s", resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bucket listing: %w", err)
+		}
+		for _, object := range result.Contents {
+			digests[strings.TrimPrefix(object.Key, blobKeyPrefix)] = struct{}{}
+		}
+		if !result.IsTruncated {
+			return digests, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseBlobInventory(t *testing.T) {
+	testCases := []struct {
+		Name            string
+		Contents        string
+		ExpectedDigests []string
+		ExpectError     bool
+	}{
+		{
+			Name: "digests and keys",
+			Contents: `# comment
+
+sha256:aaaa
+containers/images/sha256:bbbb
+  /containers/images/sha256:cccc  
+`,
+			ExpectedDigests: []string{"sha256:aaaa", "sha256:bbbb", "sha256:cccc"},
+		},
+		{
+			Name:            "empty",
+			Contents:        "",
+			ExpectedDigests: []string{},
+		},
+		{
+			Name:        "not a digest",
+			Contents:    "sha256:aaaa\nlatest\n",
+			ExpectError: true,
+		},
+		{
+			Name:        "other path",
+			Contents:    "geranos/uploaded-images/sha256:aaaa\n",
+			ExpectError: true,
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			digests, err := parseBlobInventory([]byte(tc.Contents))
+			if err != nil != tc.ExpectError {
+				t.Fatalf("expected error: %v, got: %v", tc.ExpectError, err)
+			}
+			if tc.ExpectError {
+				return
+			}
+			if len(digests) != len(tc.ExpectedDigests) {
+				t.Fatalf("expected digests %v, got: %v", tc.ExpectedDigests, digests)
+			}
+			for _, digest := range tc.ExpectedDigests {
+				if _, ok := digests[digest]; !ok {
+					t.Fatalf("expected digests %v, got: %v", tc.ExpectedDigests, digests)
+				}
+			}
+		})
+	}
+}
+
+func TestBlobInventoryContains(t *testing.T) {
+	var nilInventory *blobInventory
+	if nilInventory.Contains("https://a.example/containers/images/sha256:aaaa") {
+		t.Fatal("nil inventory should not contain anything")
+	}
+	i := &blobInventory{}
+	i.replace(t.Name(), "https://a.example", map[string]struct{}{"sha256:aaaa": {}})
+	testCases := map[string]bool{
+		"https://a.example/containers/images/sha256:aaaa": true,
+		"https://a.example/containers/images/sha256:bbbb": false,
+		"https://b.example/containers/images/sha256:aaaa": false,
+		"https://a.example/sha256:aaaa":                   false,
+	}
+	for blobURL, expected := range testCases {
+		if contains := i.Contains(blobURL); contains != expected {
+			t.Errorf("expected Contains(%q) to be %v", blobURL, expected)
+		}
+	}
+	// renaming the bucket drops the metric for the old name
+	i.replace(t.Name()+"-renamed", "https://a.example", map[string]struct{}{"sha256:aaaa": {}})
+	if blobInventoryBlobs.DeleteLabelValues(t.Name()) {
+		t.Fatal("expected the old bucket name to be dropped from metrics")
+	}
+	if !blobInventoryBlobs.DeleteLabelValues(t.Name() + "-renamed") {
+		t.Fatal("expected the new bucket name in metrics")
+	}
+}
+
+// newFakeS3ListServer serves a ListObjectsV2 listing of keys, one key per page,
+// and counts HEAD requests in heads
+func newFakeS3ListServer(t *testing.T, heads *atomic.Int32, keys ...string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+			return
+		}
+		query := r.URL.Query()
+		if r.URL.Path != "/" || query.Get("list-type") != "2" || query.Get("prefix") != blobKeyPrefix {
+			t.Errorf("unexpected listing request: %s", r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		page := 0
+		if token := query.Get("continuation-token"); token != "" {
+			fmt.Sscanf(token, "page-%d", &page)
+		}
+		truncated := page+1 < len(keys)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+<IsTruncated>%v</IsTruncated>`, truncated)
+		if page < len(keys) {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>1</Size></Contents>", keys[page])
+		}
+		if truncated {
+			fmt.Fprintf(w, "<NextContinuationToken>page-%d</NextContinuationToken>", page+1)
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestListBucketBlobs(t *testing.T) {
+	server := newFakeS3ListServer(t, &atomic.Int32{}, "containers/images/sha256:aaaa", "containers/images/sha256:bbbb", "containers/images/sha256:cccc")
+	digests, err := listBucketBlobs(context.Background(), http.DefaultClient, server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(digests) != 3 {
+		t.Fatalf("expected three digests across pages, got: %v", digests)
+	}
+	for _, digest := range []string{"sha256:aaaa", "sha256:bbbb", "sha256:cccc"} {
+		if _, ok := digests[digest]; !ok {
+			t.Fatalf("expected %q in digests, got: %v", digest, digests)
+		}
+	}
+}
+
+func TestListBucketBlobsErrors(t *testing.T) {
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code></Error>`)
+	}))
+	defer denied.Close()
+	garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "<ListBucketResult>")
+	}))
+	defer garbage.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	for _, bucketURL := range []string{denied.URL, garbage.URL, unreachable.URL, "http://%zz"} {
+		if _, err := listBucketBlobs(context.Background(), http.DefaultClient, bucketURL); err == nil {
+			t.Errorf("expected error listing %q but got none", bucketURL)
+		}
+	}
+}
+
+func TestRouterLoadInventory(t *testing.T) {
+	const digest = "sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e"
+	inventoryFile := filepath.Join(t.TempDir(), "inventory.txt")
+	if err := os.WriteFile(inventoryFile, []byte(digest+"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write inventory file: %v", err)
+	}
+	rc := DefaultRegistryConfig()
+	rc.Buckets = []BucketConfig{
+		{Name: "file", URL: "https://file.example", Inventory: &BlobInventoryConfig{File: inventoryFile}},
+	}
+	rc.RegionToBucket = map[string]string{}
+	rc.DefaultBucket = "file"
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	router := mustNewRouter(t, configs)
+	// inventories are loaded before returning
+	router.LoadInventory(context.Background())
+	if !router.inventory.Contains("https://file.example" + blobPathPrefix + digest) {
+		t.Fatal("expected file inventory to be loaded")
+	}
+}
+
+func TestRouterRunInventory(t *testing.T) {
+	const digest = "sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e"
+	// the listed bucket should never be checked with HEAD
+	var heads atomic.Int32
+	listedURL := newFakeS3ListServer(t, &heads, blobKeyPrefix+digest).URL
+	inventoryFile := filepath.Join(t.TempDir(), "inventory.txt")
+	if err := os.WriteFile(inventoryFile, []byte(digest+"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write inventory file: %v", err)
+	}
+
+	rc := DefaultRegistryConfig()
+	rc.Buckets = []BucketConfig{
+		{Name: "listed", URL: listedURL, Inventory: &BlobInventoryConfig{ListBucket: true}},
+		{Name: "file", URL: "https://file.example", Inventory: &BlobInventoryConfig{File: inventoryFile}},
+		{Name: "missing-file", URL: "https://missing-file.example", Inventory: &BlobInventoryConfig{File: inventoryFile + ".missing"}},
+		{Name: "none", URL: "https://none.example"},
+	}
+	rc.RegionToBucket = map[string]string{"eu-west-3": "listed"}
+	rc.DefaultBucket = "file"
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	router := mustNewRouter(t, configs)
+	errorsBefore := testutil.ToFloat64(blobInventoryErrors.WithLabelValues("missing-file"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		router.RunInventory(ctx, time.Millisecond)
+		close(done)
+	}()
+	// wait for the inventories to load
+	deadline := time.Now().Add(10 * time.Second)
+	for !router.inventory.Contains(listedURL + blobPathPrefix + digest) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for inventory to load")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !router.inventory.Contains("https://file.example" + blobPathPrefix + digest) {
+		t.Fatal("expected file inventory to be loaded")
+	}
+	if router.inventory.Contains("https://none.example" + blobPathPrefix + digest) {
+		t.Fatal("expected no inventory for bucket without one")
+	}
+	if errs := testutil.ToFloat64(blobInventoryErrors.WithLabelValues("missing-file")) - errorsBefore; errs < 1 {
+		t.Fatalf("expected errors loading missing inventory file, got: %v", errs)
+	}
+
+	// blobs in the inventory are redirected to without a HEAD
+	explanation, err := router.Explain("35.180.1.1", "/v2/pause/blobs/"+digest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if explanation.Route != routeS3Blob || explanation.Backend != "listed" ||
+		explanation.BlobCacheHit == nil || !*explanation.BlobCacheHit || heads.Load() != 0 {
+		t.Fatalf("unexpected explanation: %+v", explanation)
+	}
+
+	// buckets removed from the config are dropped from the inventory
+	rc.Buckets = rc.Buckets[1:]
+	rc.RegionToBucket = map[string]string{}
+	if err := configs.Update(rc); err != nil {
+		t.Fatalf("unexpected error updating config: %v", err)
+	}
+	deadline = time.Now().Add(10 * time.Second)
+	for router.inventory.Contains(listedURL + blobPathPrefix + digest) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for removed bucket inventory to be dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for RunInventory to return")
+	}
+}
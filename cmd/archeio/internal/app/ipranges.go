@@ -0,0 +1,97 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"k8s.io/registry.k8s.io/pkg/net/cidrs"
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs"
+)
+
+// ipRanges maps client IPs to their cloud and region, using the compiled in
+// IP ranges until ranges are loaded from files, see Router.RunIPRanges
+//
+// It is safe for concurrent use, loaded ranges are swapped in atomically.
+type ipRanges struct {
+	current atomic.Pointer[ipRangesMapper]
+}
+
+// ipRangesMapper wraps the interface so it can be stored in an atomic.Pointer
+type ipRangesMapper struct {
+	cidrs.PrefixMapper[cloudcidrs.IPInfo]
+}
+
+var _ cidrs.PrefixMapper[cloudcidrs.IPInfo] = &ipRanges{}
+
+func newIPRanges() *ipRanges {
+	r := &ipRanges{}
+	r.store(cloudcidrs.NewIPMapper())
+	return r
+}
+
+func (r *ipRanges) store(mapper cidrs.PrefixMapper[cloudcidrs.IPInfo]) {
+	r.current.Store(&ipRangesMapper{mapper})
+}
+
+func (r *ipRanges) GetIP(ip netip.Addr) (cloudcidrs.IPInfo, bool) {
+	return r.current.Load().GetIP(ip)
+}
+
+func (r *ipRanges) GetIPPrefix(ip netip.Addr) (cloudcidrs.IPInfo, netip.Prefix, bool) {
+	return r.current.Load().GetIPPrefix(ip)
+}
+
+// reload loads the IP ranges from files, keeping the current ranges on failure
+func (r *ipRanges) reload(files map[string]string) {
+	mapper, err := cloudcidrs.LoadIPMapper(files)
+	if err != nil {
+		klog.ErrorS(err, "failed to load IP ranges, keeping the current ranges")
+		ipRangesReloads.WithLabelValues(ipRangesReloadError).Inc()
+		return
+	}
+	klog.V(2).InfoS("loaded IP ranges", "files", files)
+	ipRangesReloads.WithLabelValues(ipRangesReloadSuccess).Inc()
+	r.store(mapper)
+}
+
+// RunIPRanges loads the cloud IP ranges from RouterOptions.IPRangeFiles
+// immediately and then every interval until ctx is done
+//
+// If no files are configured the compiled in IP ranges are used and
+// RunIPRanges returns immediately.
+func (rt *Router) RunIPRanges(ctx context.Context, interval time.Duration) {
+	if len(rt.ipRangeFiles) == 0 {
+		return
+	}
+	rt.ipRanges.reload(rt.ipRangeFiles)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rt.ipRanges.reload(rt.ipRangeFiles)
+		}
+	}
+}
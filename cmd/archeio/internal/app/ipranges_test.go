@@ -0,0 +1,122 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs"
+)
+
+func TestRouterRunIPRanges(t *testing.T) {
+	awsFile := filepath.Join(t.TempDir(), "aws.json")
+	writeRanges := func(contents string) {
+		t.Helper()
+		if err := os.WriteFile(awsFile, []byte(contents), 0o600); err != nil {
+			t.Fatalf("failed to write IP ranges file: %v", err)
+		}
+	}
+	writeRanges(`{"prefixes": [{"ip_prefix": "192.0.2.0/24", "region": "eu-west-3"}]}`)
+
+	configs, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	opts := DefaultRouterOptions()
+	opts.IPRangeFiles = map[string]string{cloudcidrs.AWS: awsFile}
+	router, err := NewRouter(configs, opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating router: %v", err)
+	}
+	explainRegion := func() string {
+		t.Helper()
+		explanation, err := router.Explain("192.0.2.1", "/v2/pause/manifests/latest")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return explanation.Region
+	}
+	// the compiled in ranges are used until loaded
+	if region := explainRegion(); region != "" {
+		t.Fatalf("expected no region before loading IP ranges, got: %q", region)
+	}
+
+	successesBefore := testutil.ToFloat64(ipRangesReloads.WithLabelValues(ipRangesReloadSuccess))
+	errorsBefore := testutil.ToFloat64(ipRangesReloads.WithLabelValues(ipRangesReloadError))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		router.RunIPRanges(ctx, time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for explainRegion() != "eu-west-3" {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for IP ranges to load")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if successes := testutil.ToFloat64(ipRangesReloads.WithLabelValues(ipRangesReloadSuccess)) - successesBefore; successes < 1 {
+		t.Fatalf("expected successful IP ranges loads, got: %v", successes)
+	}
+
+	// invalid ranges are not loaded, the previous ranges are kept
+	writeRanges(`not json`)
+	deadline = time.Now().Add(10 * time.Second)
+	for testutil.ToFloat64(ipRangesReloads.WithLabelValues(ipRangesReloadError)) == errorsBefore {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for IP ranges to fail to load")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if region := explainRegion(); region != "eu-west-3" {
+		t.Fatalf("expected previous IP ranges to be kept, got region: %q", region)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for RunIPRanges to return")
+	}
+}
+
+func TestRouterRunIPRangesNoFiles(t *testing.T) {
+	t.Parallel()
+	configs, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	// returns immediately without files, even though ctx is never done
+	mustNewRouter(t, configs).RunIPRanges(context.Background(), time.Millisecond)
+}
+
+func TestIPRanges(t *testing.T) {
+	t.Parallel()
+	// starts with the compiled in ranges
+	ranges := newIPRanges()
+	if info, matched := ranges.GetIP(netip.MustParseAddr("35.180.1.1")); !matched || info.Region != "eu-west-3" {
+		t.Fatalf("expected compiled in IP ranges, got: (%+v, %t)", info, matched)
+	}
+}
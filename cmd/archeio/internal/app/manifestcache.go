@@ -0,0 +1,411 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"k8s.io/klog/v2"
+)
+
+// ManifestCacheOptions configures serving manifests from archeio instead of
+// redirecting manifest requests to the upstream registry
+type ManifestCacheOptions struct {
+	// Enabled fetches and caches manifests from the upstream registry
+	Enabled bool
+	// Dir stores manifests fetched by digest on local disk if set,
+	// otherwise they are cached in memory
+	Dir string
+	// TagTTL is how long tag resolutions are cached before they are fetched
+	// again, stale tags are still served if the upstream registry fails
+	TagTTL time.Duration
+	// MaxTags bounds the number of cached tag resolutions,
+	// the least recently used are evicted first
+	MaxTags int
+}
+
+// DefaultManifestCacheOptions returns the default ManifestCacheOptions
+func DefaultManifestCacheOptions() ManifestCacheOptions {
+	return ManifestCacheOptions{
+		TagTTL:  time.Minute,
+		MaxTags: 10000,
+	}
+}
+
+// Validate returns an error if o is not usable
+func (o ManifestCacheOptions) Validate() error {
+	var errs []error
+	if o.TagTTL < 0 {
+		errs = append(errs, errors.New("manifest cache tag TTL must not be negative"))
+	}
+	if o.MaxTags < 1 {
+		errs = append(errs, errors.New("manifest cache max tags must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
+
+// maxManifestSize bounds fetched manifests, registries should accept
+// manifests of at least 4 MiB so we allow that much
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pushing-manifests
+const maxManifestSize = 4 * 1024 * 1024
+
+// manifestAccept is the Accept header for fetching manifests, we cache
+// whichever of these the upstream registry stored and serve it to clients
+// that accept it
+var manifestAccept = strings.Join([]string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}, ", ")
+
+// reManifest matches manifest requests and captures the reference,
+// which is a tag or digest
+var reManifest = regexp.MustCompile("^/v2/.+/manifests/([^/]+)$")
+
+// cachedManifest is a manifest fetched from the upstream registry
+type cachedManifest struct {
+	mediaType string
+	// digest is the sha256 digest of content
+	digest  string
+	content []byte
+}
+
+func newCachedManifest(mediaType string, content []byte) *cachedManifest {
+	h := sha256.Sum256(content)
+	return &cachedManifest{
+		mediaType: mediaType,
+		digest:    "sha256:" + hex.EncodeToString(h[:]),
+		content:   content,
+	}
+}
+
+// cachedTag is the resolution of the tag at manifestURL and when it was fetched
+type cachedTag struct {
+	manifestURL string
+	manifest    *cachedManifest
+	fetched     time.Time
+}
+
+// manifestStore stores manifests fetched by digest, keyed by upstream URL
+type manifestStore interface {
+	get(key string) (*cachedManifest, bool)
+	put(key string, m *cachedManifest)
+}
+
+// manifestCache fetches manifests from the upstream registry and caches them,
+// manifests fetched by digest never change so they are cached indefinitely
+//
+// Use newManifestCache to instantiate
+type manifestCache struct {
+	opts     ManifestCacheOptions
+	registry *registryClient
+	// now is time.Now, except in tests
+	now func() time.Time
+	// digests holds manifests fetched by digest
+	digests manifestStore
+	// inflight coalesces concurrent fetches by upstream URL
+	inflight singleflight.Group
+
+	mu sync.Mutex
+	// tags holds tag resolutions by upstream URL, most recently used at the
+	// front of tagLRU
+	tagLRU *list.List
+	tags   map[string]*list.Element
+}
+
+func newManifestCache(opts ManifestCacheOptions) (*manifestCache, error) {
+	var digests manifestStore = &memoryManifestStore{manifests: map[string]*cachedManifest{}}
+	if opts.Dir != "" {
+		if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create manifest cache dir: %w", err)
+		}
+		digests = &diskManifestStore{dir: opts.Dir}
+	}
+	return &manifestCache{
+		opts: opts,
+		registry: &registryClient{client: &http.Client{
+			// ensure sensible timeouts
+			Timeout: time.Second * 10,
+		}},
+		now:     time.Now,
+		digests: digests,
+		tagLRU:  list.New(),
+		tags:    map[string]*list.Element{},
+	}, nil
+}
+
+// serve serves the manifest request r decided by d, see Router.route
+//
+// If the manifest is neither cached nor fetched, or the client does not
+// accept its media type, the client is redirected to the upstream registry
+// as when the cache is disabled.
+func (c *manifestCache) serve(w http.ResponseWriter, r *http.Request, d routeDecision) routeDecision {
+	// Router.route only decides to serve matching requests
+	reference := reManifest.FindStringSubmatch(r.URL.Path)[1]
+	m, result, err := c.get(d.ManifestURL, reference)
+	if err == nil && !acceptsMediaType(r.Header.Values("Accept"), m.mediaType) {
+		// the upstream registry may have another representation for the client
+		result = manifestCacheNotAccepted
+		err = fmt.Errorf("client does not accept %q", m.mediaType)
+	}
+	manifestCacheTotal.WithLabelValues(result).Inc()
+	d.ManifestCache = result
+	if err != nil {
+		klog.V(2).InfoS("failed to serve cached manifest, redirecting to upstream registry", "url", d.ManifestURL, "error", err)
+		d.Status = http.StatusTemporaryRedirect
+		d.Redirect = d.ManifestURL
+		d.Route = routeUpstreamManifest
+		writeRouteDecision(w, r, d)
+		return d
+	}
+	w.Header().Set("Content-Type", m.mediaType)
+	w.Header().Set("Docker-Content-Digest", m.digest)
+	w.Header().Set("Content-Length", strconv.Itoa(len(m.content)))
+	w.WriteHeader(d.Status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(m.content)
+	}
+	return d
+}
+
+// acceptsMediaType returns true if a client with the Accept header values
+// accept accepts mediaType, clients without an Accept header accept anything
+func acceptsMediaType(accept []string, mediaType string) bool {
+	if len(accept) == 0 {
+		return true
+	}
+	if base, _, err := mime.ParseMediaType(mediaType); err == nil {
+		mediaType = base
+	}
+	for _, value := range accept {
+		for _, item := range strings.Split(value, ",") {
+			accepted, params, err := mime.ParseMediaType(item)
+			if err != nil {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			if accepted == mediaType || accepted == "*/*" ||
+				strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(accepted, "*")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// get returns the manifest at the upstream manifestURL for reference,
+// which is a tag or digest, and the cache result
+func (c *manifestCache) get(manifestURL, reference string) (*cachedManifest, string, error) {
+	if strings.Contains(reference, ":") {
+		return c.getDigest(manifestURL, reference)
+	}
+	return c.getTag(manifestURL)
+}
+
+func (c *manifestCache) getDigest(manifestURL, digest string) (*cachedManifest, string, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, manifestCacheError, fmt.Errorf("unsupported digest %q", digest)
+	}
+	// the digest is checked again in case the disk cache was corrupted
+	if m, ok := c.digests.get(manifestURL); ok && m.digest == digest {
+		return m, manifestCacheHit, nil
+	}
+	m, err := c.fetch(manifestURL)
+	if err != nil {
+		return nil, manifestCacheError, err
+	}
+	if m.digest != digest {
+		return nil, manifestCacheError, fmt.Errorf("upstream manifest has digest %q", m.digest)
+	}
+	c.digests.put(manifestURL, m)
+	return m, manifestCacheMiss, nil
+}
+
+func (c *manifestCache) getTag(manifestURL string) (*cachedManifest, string, error) {
+	tag, cached := c.cachedTag(manifestURL)
+	if cached && c.now().Sub(tag.fetched) < c.opts.TagTTL {
+		return tag.manifest, manifestCacheHit, nil
+	}
+	m, err := c.fetch(manifestURL)
+	if err != nil {
+		// a missing tag is authoritative, but otherwise keep serving the
+		// last resolution while the upstream registry is having problems
+		var statusErr *upstreamStatusError
+		if cached && !(errors.As(err, &statusErr) && statusErr.status == http.StatusNotFound) {
+			klog.V(2).InfoS("serving stale tag resolution", "url", manifestURL, "error", err)
+			return tag.manifest, manifestCacheStale, nil
+		}
+		return nil, manifestCacheError, err
+	}
+	c.putTag(manifestURL, m)
+	return m, manifestCacheMiss, nil
+}
+
+// cachedTag returns the cached resolution of the tag at manifestURL
+func (c *manifestCache) cachedTag(manifestURL string) (cachedTag, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.tags[manifestURL]
+	if !ok {
+		return cachedTag{}, false
+	}
+	c.tagLRU.MoveToFront(e)
+	return *e.Value.(*cachedTag), true
+}
+
+// putTag caches m as the resolution of the tag at manifestURL, evicting
+// the least recently used tags beyond opts.MaxTags
+func (c *manifestCache) putTag(manifestURL string, m *cachedManifest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tag := &cachedTag{manifestURL: manifestURL, manifest: m, fetched: c.now()}
+	if e, ok := c.tags[manifestURL]; ok {
+		e.Value = tag
+		c.tagLRU.MoveToFront(e)
+		return
+	}
+	c.tags[manifestURL] = c.tagLRU.PushFront(tag)
+	for c.tagLRU.Len() > c.opts.MaxTags {
+		e := c.tagLRU.Back()
+		c.tagLRU.Remove(e)
+		delete(c.tags, e.Value.(*cachedTag).manifestURL)
+	}
+}
+
+// upstreamStatusError is returned when the upstream registry responds
+// with an unexpected status
+type upstreamStatusError struct {
+	status int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream registry responded with status %d", e.status)
+}
+
+// fetch fetches the manifest at manifestURL, concurrent fetches of the
+// same manifest share one request
+func (c *manifestCache) fetch(manifestURL string) (*cachedManifest, error) {
+	v, err, _ := c.inflight.Do(manifestURL, func() (any, error) {
+		return c.fetchManifest(context.Background(), manifestURL)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*cachedManifest), nil
+}
+
+func (c *manifestCache) fetchManifest(ctx context.Context, manifestURL string) (*cachedManifest, error) {
+	resp, err := c.registry.get(ctx, manifestURL, manifestAccept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upstreamStatusError{status: resp.StatusCode}
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxManifestSize {
+		return nil, errors.New("upstream manifest is too large")
+	}
+	return newCachedManifest(resp.Header.Get("Content-Type"), content), nil
+}
+
+// memoryManifestStore is a manifestStore in memory
+type memoryManifestStore struct {
+	mu        sync.Mutex
+	manifests map[string]*cachedManifest
+}
+
+func (s *memoryManifestStore) get(key string) (*cachedManifest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.manifests[key]
+	return m, ok
+}
+
+func (s *memoryManifestStore) put(key string, m *cachedManifest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.manifests[key] = m
+}
+
+// diskManifestStore is a manifestStore in files under dir, each file is
+// the media type on the first line followed by the manifest
+//
+// The manifest digest is not trusted from disk, see cachedManifest.digest
+type diskManifestStore struct {
+	dir string
+}
+
+// path returns the file key is stored at
+func (s *diskManifestStore) path(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(h[:]))
+}
+
+func (s *diskManifestStore) get(key string) (*cachedManifest, bool) {
+	contents, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, false
+	}
+	mediaType, content, ok := bytes.Cut(contents, []byte("\n"))
+	if !ok {
+		return nil, false
+	}
+	return newCachedManifest(string(mediaType), content), true
+}
+
+func (s *diskManifestStore) put(key string, m *cachedManifest) {
+	// write to a temporary file and rename it so readers never see partial files
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		klog.ErrorS(err, "failed to write manifest cache file")
+		return
+	}
+	_, err = f.Write(append([]byte(m.mediaType+"\n"), m.content...))
+	err = errors.Join(err, f.Close())
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(key))
+	}
+	if err != nil {
+		klog.ErrorS(err, "failed to write manifest cache file")
+		os.Remove(f.Name())
+	}
+}
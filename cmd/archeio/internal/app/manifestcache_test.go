@@ -0,0 +1,388 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testManifestType = "application/vnd.oci.image.index.v1+json"
+const testManifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+
+// testManifestDigest is the digest of testManifest
+var testManifestDigest = newCachedManifest(testManifestType, []byte(testManifest)).digest
+
+// fakeRegistry serves testManifest for every manifest except in the missing
+// repository, requiring an anonymous bearer token like Artifact Registry
+type fakeRegistry struct {
+	*httptest.Server
+	// requests counts authorized manifest requests
+	requests atomic.Int32
+	// status fails manifest requests with this status if set
+	status atomic.Int32
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	f := &fakeRegistry{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("service") != "registry.example" || r.URL.Query().Get("scope") == "" {
+			t.Errorf("unexpected token request: %s", r.URL)
+		}
+		_, _ = w.Write([]byte(`{"token": "anonymous"}`))
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer anonymous" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.example",scope="repository:images/pause:pull"`, f.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.requests.Add(1)
+		if r.Header.Get("Accept") != manifestAccept {
+			t.Errorf("unexpected Accept header: %q", r.Header.Get("Accept"))
+		}
+		if status := f.status.Load(); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		if strings.Contains(r.URL.Path, "/missing/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", testManifestType)
+		_, _ = w.Write([]byte(testManifest))
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestManifestCacheOptionsValidate(t *testing.T) {
+	if err := DefaultManifestCacheOptions().Validate(); err != nil {
+		t.Fatalf("unexpected error validating default options: %v", err)
+	}
+	if err := (ManifestCacheOptions{TagTTL: -1, MaxTags: 1}).Validate(); err == nil {
+		t.Fatal("expected error for negative tag TTL")
+	}
+	if err := (ManifestCacheOptions{}).Validate(); err == nil {
+		t.Fatal("expected error for no max tags")
+	}
+}
+
+func TestRouterManifestCache(t *testing.T) {
+	registry := newFakeRegistry(t)
+	rc := DefaultRegistryConfig()
+	rc.UpstreamRegistryEndpoint = registry.URL
+	rc.UpstreamRegistryPath = "images"
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	opts := DefaultRouterOptions()
+	opts.ManifestCache.Enabled = true
+	router, err := NewRouter(configs, opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating router: %v", err)
+	}
+	now := time.Now()
+	router.manifests.now = func() time.Time { return now }
+	handler := MakeHandler(router, HandlerOptions{})
+
+	accept := ""
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, "http://localhost:8080"+path, nil)
+		r.RemoteAddr = "127.0.0.1:8888"
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	expectManifest := func(w *httptest.ResponseRecorder, expectBody bool, expectedRequests int32) {
+		t.Helper()
+		if w.Code != http.StatusOK ||
+			w.Header().Get("Content-Type") != testManifestType ||
+			w.Header().Get("Docker-Content-Digest") != testManifestDigest ||
+			w.Header().Get("Content-Length") != strconv.Itoa(len(testManifest)) {
+			t.Fatalf("unexpected response: %d %v", w.Code, w.Header())
+		}
+		if body := w.Body.String(); (body == testManifest) != expectBody {
+			t.Fatalf("unexpected response body: %q", body)
+		}
+		if requests := registry.requests.Load(); requests != expectedRequests {
+			t.Fatalf("expected %d upstream requests, got: %d", expectedRequests, requests)
+		}
+	}
+	expectRedirect := func(w *httptest.ResponseRecorder, expectedURL string) {
+		t.Helper()
+		if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != expectedURL {
+			t.Fatalf("expected redirect to %q, got: %d %q", expectedURL, w.Code, w.Header().Get("Location"))
+		}
+	}
+	staleBefore := testutil.ToFloat64(manifestCacheTotal.WithLabelValues(manifestCacheStale))
+
+	// tags are fetched and then cached
+	expectManifest(serve(http.MethodGet, "/v2/pause/manifests/3.9"), true, 1)
+	expectManifest(serve(http.MethodGet, "/v2/pause/manifests/3.9"), true, 1)
+
+	// digests are fetched and then cached
+	digestPath := "/v2/pause/manifests/" + testManifestDigest
+	expectManifest(serve(http.MethodHead, digestPath), false, 2)
+	expectManifest(serve(http.MethodGet, digestPath), true, 2)
+
+	// only to clients that accept the cached media type
+	accept = "application/vnd.oci.image.manifest.v1+json, " + testManifestType
+	expectManifest(serve(http.MethodGet, digestPath), true, 2)
+	accept = "application/vnd.docker.distribution.manifest.v2+json"
+	notAcceptedBefore := testutil.ToFloat64(manifestCacheTotal.WithLabelValues(manifestCacheNotAccepted))
+	expectRedirect(serve(http.MethodGet, digestPath), registry.URL+"/v2/images"+strings.TrimPrefix(digestPath, "/v2"))
+	if notAccepted := testutil.ToFloat64(manifestCacheTotal.WithLabelValues(manifestCacheNotAccepted)) - notAcceptedBefore; notAccepted != 1 {
+		t.Fatalf("expected a manifest not to be accepted, got: %v", notAccepted)
+	}
+	accept = ""
+
+	// expired tags are served stale if the upstream registry fails
+	now = now.Add(opts.ManifestCache.TagTTL)
+	registry.status.Store(http.StatusServiceUnavailable)
+	expectManifest(serve(http.MethodGet, "/v2/pause/manifests/3.9"), true, 3)
+	if stale := testutil.ToFloat64(manifestCacheTotal.WithLabelValues(manifestCacheStale)) - staleBefore; stale != 1 {
+		t.Fatalf("expected a stale tag to be served, got: %v", stale)
+	}
+	// but digests are still served from the cache
+	expectManifest(serve(http.MethodGet, digestPath), true, 3)
+	// and uncached manifests are redirected
+	expectRedirect(serve(http.MethodGet, "/v2/pause/manifests/3.10"), registry.URL+"/v2/images/pause/manifests/3.10")
+
+	// deleted tags are not served stale
+	registry.status.Store(http.StatusNotFound)
+	expectRedirect(serve(http.MethodGet, "/v2/pause/manifests/3.9"), registry.URL+"/v2/images/pause/manifests/3.9")
+	registry.status.Store(0)
+
+	// missing manifests are redirected
+	expectRedirect(serve(http.MethodGet, "/v2/missing/manifests/"+testManifestDigest), registry.URL+"/v2/images/missing/manifests/"+testManifestDigest)
+	if _, _, err := router.manifests.get(registry.URL+"/v2/images/missing/manifests/3.9", "3.9"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected error with upstream status, got: %v", err)
+	}
+
+	// manifests must match the requested digest
+	wrongDigest := "sha256:" + strings.Repeat("0", 64)
+	expectRedirect(serve(http.MethodGet, "/v2/pause/manifests/"+wrongDigest), registry.URL+"/v2/images/pause/manifests/"+wrongDigest)
+	unsupportedDigest := "sha512:" + strings.Repeat("0", 128)
+	expectRedirect(serve(http.MethodGet, "/v2/pause/manifests/"+unsupportedDigest), registry.URL+"/v2/images/pause/manifests/"+unsupportedDigest)
+
+	// other requests are still redirected
+	expectRedirect(serve(http.MethodGet, "/v2/pause/tags/list"), registry.URL+"/v2/images/pause/tags/list")
+
+	// explaining does not fetch the manifest
+	requests := registry.requests.Load()
+	explanation, err := router.Explain("127.0.0.1", "/v2/pause/manifests/3.11")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if explanation.Status != http.StatusOK || explanation.Route != routeCachedManifest ||
+		explanation.Redirect != "" || explanation.ManifestURL != registry.URL+"/v2/images/pause/manifests/3.11" ||
+		registry.requests.Load() != requests {
+		t.Fatalf("unexpected explanation: %+v", explanation)
+	}
+}
+
+func TestNewRouterManifestCacheDirError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	configs, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	opts := DefaultRouterOptions()
+	opts.ManifestCache.Enabled = true
+	opts.ManifestCache.Dir = filepath.Join(file, "manifests")
+	if _, err := NewRouter(configs, opts); err == nil {
+		t.Fatal("expected error creating manifest cache dir under a file")
+	}
+}
+
+func TestAcceptsMediaType(t *testing.T) {
+	testCases := []struct {
+		Name      string
+		Accept    []string
+		MediaType string
+		Expected  bool
+	}{
+		{Name: "no accept header", MediaType: testManifestType, Expected: true},
+		{Name: "exact", Accept: []string{testManifestType}, MediaType: testManifestType, Expected: true},
+		{Name: "one of many", Accept: []string{"application/vnd.oci.image.manifest.v1+json, " + testManifestType}, MediaType: testManifestType, Expected: true},
+		{Name: "one of many headers", Accept: []string{"application/vnd.oci.image.manifest.v1+json", testManifestType}, MediaType: testManifestType, Expected: true},
+		{Name: "with parameters", Accept: []string{testManifestType + ";q=0.5"}, MediaType: testManifestType + "; charset=utf-8", Expected: true},
+		{Name: "any", Accept: []string{"*/*"}, MediaType: testManifestType, Expected: true},
+		{Name: "any application", Accept: []string{"application/*"}, MediaType: testManifestType, Expected: true},
+		{Name: "other", Accept: []string{"application/vnd.docker.distribution.manifest.v2+json"}, MediaType: testManifestType, Expected: false},
+		{Name: "any text", Accept: []string{"text/*"}, MediaType: testManifestType, Expected: false},
+		{Name: "not acceptable", Accept: []string{testManifestType + ";q=0"}, MediaType: testManifestType, Expected: false},
+		{Name: "invalid", Accept: []string{"/"}, MediaType: testManifestType, Expected: false},
+	}
+	for _, tc := range testCases {
+		if accepted := acceptsMediaType(tc.Accept, tc.MediaType); accepted != tc.Expected {
+			t.Errorf("%s: expected %v for %q accepting %q, got: %v", tc.Name, tc.Expected, tc.Accept, tc.MediaType, accepted)
+		}
+	}
+}
+
+func TestManifestCacheMaxTags(t *testing.T) {
+	registry := newFakeRegistry(t)
+	opts := DefaultManifestCacheOptions()
+	opts.MaxTags = 2
+	c, err := newManifestCache(opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating manifest cache: %v", err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	get := func(tag, expectedResult string) {
+		t.Helper()
+		if _, result, err := c.get(registry.URL+"/v2/pause/manifests/"+tag, tag); err != nil || result != expectedResult {
+			t.Fatalf("expected %q for tag %q, got: %q %v", expectedResult, tag, result, err)
+		}
+	}
+	get("a", manifestCacheMiss)
+	get("b", manifestCacheMiss)
+	// a is now the most recently used, so b is evicted
+	get("a", manifestCacheHit)
+	get("c", manifestCacheMiss)
+	get("a", manifestCacheHit)
+	get("b", manifestCacheMiss)
+	// expired tags are replaced in place
+	now = now.Add(opts.TagTTL)
+	get("b", manifestCacheMiss)
+	if len(c.tags) != 2 || c.tagLRU.Len() != 2 {
+		t.Fatalf("expected two cached tags, got: %d %d", len(c.tags), c.tagLRU.Len())
+	}
+}
+
+func TestManifestCacheDisk(t *testing.T) {
+	registry := newFakeRegistry(t)
+	dir := filepath.Join(t.TempDir(), "manifests")
+	manifestURL := registry.URL + "/v2/pause/manifests/" + testManifestDigest
+	newCache := func() *manifestCache {
+		t.Helper()
+		c, err := newManifestCache(ManifestCacheOptions{Dir: dir})
+		if err != nil {
+			t.Fatalf("unexpected error creating manifest cache: %v", err)
+		}
+		return c
+	}
+	get := func(c *manifestCache, expectedResult string) {
+		t.Helper()
+		m, result, err := c.get(manifestURL, testManifestDigest)
+		if err != nil || result != expectedResult || m.mediaType != testManifestType || string(m.content) != testManifest {
+			t.Fatalf("unexpected result: %q %+v %v", result, m, err)
+		}
+	}
+
+	get(newCache(), manifestCacheMiss)
+	// manifests persist across restarts
+	get(newCache(), manifestCacheHit)
+	if requests := registry.requests.Load(); requests != 1 {
+		t.Fatalf("expected one upstream request, got: %d", requests)
+	}
+
+	// corrupted files are fetched again
+	store := &diskManifestStore{dir: dir}
+	if err := os.WriteFile(store.path(manifestURL), []byte(testManifestType+"\n{}"), 0o600); err != nil {
+		t.Fatalf("failed to corrupt manifest file: %v", err)
+	}
+	get(newCache(), manifestCacheMiss)
+	if err := os.WriteFile(store.path(manifestURL), []byte(testManifest), 0o600); err != nil {
+		t.Fatalf("failed to corrupt manifest file: %v", err)
+	}
+	if _, ok := store.get(manifestURL); ok {
+		t.Fatal("expected file without a media type to be ignored")
+	}
+
+	// failing to write files is not fatal
+	m := newCachedManifest(testManifestType, []byte(testManifest))
+	const key = "https://registry.example/v2/pause/manifests/sha256:aaaa"
+	if err := os.Mkdir(store.path(key), 0o755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	store.put(key, m)
+	if _, ok := store.get(key); ok {
+		t.Fatal("expected manifest not to be stored over a directory")
+	}
+	missing := &diskManifestStore{dir: filepath.Join(dir, "missing")}
+	missing.put(key, m)
+	if _, ok := missing.get(key); ok {
+		t.Fatal("expected manifest not to be stored in a missing directory")
+	}
+}
+
+func TestManifestCacheFetchErrors(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	newServer := func(handler http.HandlerFunc) string {
+		s := httptest.NewServer(handler)
+		t.Cleanup(s.Close)
+		return s.URL
+	}
+	testCases := []struct {
+		Name        string
+		ManifestURL string
+	}{
+		{Name: "unreachable", ManifestURL: unreachable.URL + "/v2/pause/manifests/3.9"},
+		{
+			Name: "truncated manifest",
+			ManifestURL: newServer(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Length", "100")
+				_, _ = w.Write([]byte("{"))
+			}),
+		},
+		{
+			Name: "manifest too large",
+			ManifestURL: newServer(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write(make([]byte, maxManifestSize+1))
+			}),
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			c, err := newManifestCache(DefaultManifestCacheOptions())
+			if err != nil {
+				t.Fatalf("unexpected error creating manifest cache: %v", err)
+			}
+			if m, err := c.fetchManifest(context.Background(), tc.ManifestURL); err == nil {
+				t.Fatalf("expected error but got manifest: %+v", m)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs"
+)
+
+// routing outcomes for registry API requests, see requestsTotal
+const (
+	// non-blob requests redirected to the upstream registry
+	routeUpstreamManifest = "upstream-manifest"
+	// blob requests from GCP redirected to the upstream registry
+	routeGCPBlob = "gcp-blob"
+	// blob requests redirected to a bucket
+	routeS3Blob = "s3-blob"
+	// blob requests redirected to a fallback bucket after not being found in
+	// the nearest bucket
+	routeS3FallbackBlob = "s3-fallback-blob"
+	// blob requests redirected upstream after not being found in any bucket
+	routeS3Fallback = "s3-fallback"
+	// blob requests redirected upstream because no bucket is configured
+	routeUnmappedBlob = "unmapped-blob"
+	// manifest requests served from the manifest cache
+	routeCachedManifest = "cached-manifest"
+	// blob requests served from the blob disk cache
+	routeCachedBlob = "cached-blob"
+	// referrers API requests served by archeio
+	routeReferrers = "referrers"
+	// requests rejected for exceeding rate limits
+	routeThrottled = "throttled"
+)
+
+// blobChecker cache results, see blobCacheTotal
+const (
+	blobCacheHit         = "hit"
+	blobCacheNegativeHit = "negative-hit"
+	blobCacheInventory   = "inventory"
+	blobCacheMiss        = "miss"
+	blobCacheError       = "error"
+)
+
+// ipRanges reload results, see ipRangesReloads
+const (
+	ipRangesReloadSuccess = "success"
+	ipRangesReloadError   = "error"
+)
+
+// manifestCache results, see manifestCacheTotal
+const (
+	manifestCacheHit = "hit"
+	// tag resolutions served after failing to fetch them again
+	manifestCacheStale = "stale"
+	manifestCacheMiss  = "miss"
+	// manifests that could not be fetched, these are redirected upstream
+	manifestCacheError = "error"
+	// manifests of a media type the client does not accept,
+	// these are redirected upstream
+	manifestCacheNotAccepted = "not-accepted"
+)
+
+// blobDiskCache results, see blobDiskCacheTotal
+const (
+	blobDiskCacheHit = "hit"
+	// blobs not on disk, these are streamed while they are downloaded
+	blobDiskCacheMiss = "miss"
+	// blobs removed from disk after routing or that could not be downloaded,
+	// these are redirected unless part of the blob was served already
+	blobDiskCacheError = "error"
+)
+
+// blobDiskCache fill results, see blobDiskCacheFills
+const (
+	blobDiskCacheFillSuccess = "success"
+	blobDiskCacheFillError   = "error"
+)
+
+// referrersProxy results, see referrersTotal
+const (
+	// served from the upstream referrers API
+	referrersUpstream = "upstream"
+	// served from the referrers tag schema fallback
+	referrersTagSchema = "tag-schema"
+	// served as an empty index as there are no referrers
+	referrersEmpty = "empty"
+	// served from referrers fetched recently
+	referrersCached = "cached"
+	// referrers that could not be fetched, these are redirected upstream
+	referrersError = "error"
+)
+
+// blobCache eviction reasons, see blobCacheEvictions
+const (
+	blobCacheEvictCapacity = "capacity"
+	blobCacheEvictExpired  = "expired"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_requests_total",
+		Help: "Registry API requests redirected or served, by routing outcome and the client's cloud and region.",
+	}, []string{"route", "cloud", "region"})
+
+	blobCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_blob_cache_total",
+		Help: "Blob existence checks by bucket name and result. Inventory results are blobs found in the bucket's blob inventory. Negative hits are cached misses. Errors are HEAD requests that failed outright, they are also counted as misses.",
+	}, []string{"bucket", "result"})
+
+	blobCacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_blob_cache_evictions_total",
+		Help: "Blob existence cache evictions by reason, either capacity or expired.",
+	}, []string{"reason"})
+
+	blobCacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "archeio_blob_cache_entries",
+		Help: "Number of entries in the blob existence cache.",
+	})
+
+	blobHeadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "archeio_blob_head_duration_seconds",
+		Help:    "Latency of blob existence HEAD requests by bucket name.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"bucket"})
+
+	blobHeadCoalesced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_blob_head_coalesced_total",
+		Help: "Blob existence checks by bucket name that shared the result of a concurrent HEAD for the same blob.",
+	}, []string{"bucket"})
+
+	blobHeadRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_blob_head_rejected_total",
+		Help: "Blob existence checks by bucket name that were not made because too many HEADs to the bucket were outstanding, these are treated as misses.",
+	}, []string{"bucket"})
+
+	blobHeadShortCircuited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_blob_head_short_circuited_total",
+		Help: "Blob existence checks by bucket name that were not made because the bucket's circuit breaker was open, these are treated as misses.",
+	}, []string{"bucket"})
+
+	bucketCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "archeio_bucket_circuit_state",
+		Help: "Circuit breaker state for blob existence checks by bucket name, 0 for closed, 1 for open and 2 for half-open.",
+	}, []string{"bucket"})
+
+	bucketCircuitTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_bucket_circuit_transitions_total",
+		Help: "Circuit breaker state changes by bucket name and the new state.",
+	}, []string{"bucket", "state"})
+
+	blobInventoryBlobs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "archeio_blob_inventory_blobs",
+		Help: "Number of blobs in the last successfully loaded blob inventory by bucket name.",
+	}, []string{"bucket"})
+
+	blobInventoryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_blob_inventory_errors_total",
+		Help: "Failed blob inventory loads by bucket name, the previous inventory is kept.",
+	}, []string{"bucket"})
+
+	manifestCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_manifest_cache_total",
+		Help: "Manifest requests served by the manifest cache by result. Stale results are tag resolutions served after failing to fetch them again. Errors are manifests that could not be fetched, and not accepted are manifests of a media type the client does not accept, these requests are redirected to the upstream registry.",
+	}, []string{"result"})
+
+	blobDiskCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_blob_disk_cache_total",
+		Help: "Blob requests served by the blob disk cache by result. Misses are blobs not on disk, these are streamed to the client while they are downloaded. Errors are blobs removed from disk after routing or that could not be downloaded, these requests are redirected as if the blob disk cache were disabled unless part of the blob was served already.",
+	}, []string{"result"})
+
+	blobDiskCacheFills = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_blob_disk_cache_fills_total",
+		Help: "Downloads of missing blobs into the blob disk cache by result.",
+	}, []string{"result"})
+
+	blobDiskCacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "archeio_blob_disk_cache_bytes",
+		Help: "Total size of the blobs stored in the blob disk cache.",
+	})
+
+	referrersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_referrers_total",
+		Help: "Referrers API requests served by archeio by result. Tag schema results are served from the referrers tag schema fallback. Cached results are served from referrers fetched recently. Errors are referrers that could not be fetched, these requests are redirected to the upstream registry.",
+	}, []string{"result"})
+
+	rateLimitBuckets = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "archeio_rate_limit_buckets",
+		Help: "Number of client IP and prefix token buckets tracked for rate limiting.",
+	})
+
+	ipRangesReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "archeio_ip_ranges_reloads_total",
+		Help: "Loads of cloud IP ranges from files by result, the previous ranges are kept on error.",
+	}, []string{"result"})
+
+	backendUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "archeio_backend_up",
+		Help: "Whether the last readiness probe of each backend by name succeeded, 1 for healthy and 0 otherwise.",
+	}, []string{"backend"})
+
+	trafficSplitWeight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "archeio_traffic_split_weight",
+		Help: "Weight of each bucket by name in the traffic split of each region and routing rule in the current config.",
+	}, []string{"rule", "region", "bucket"})
+)
+
+// recordRoute counts a routed registry API request
+func recordRoute(route string, ipInfo cloudcidrs.IPInfo) {
+	requestsTotal.WithLabelValues(route, ipInfo.Cloud, ipInfo.Region).Inc()
+}
@@ -0,0 +1,34 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs"
+)
+
+func TestRecordRoute(t *testing.T) {
+	ipInfo := cloudcidrs.IPInfo{Cloud: "test-cloud", Region: "test-region"}
+	recordRoute(routeS3Blob, ipInfo)
+	recordRoute(routeS3Blob, ipInfo)
+	if count := testutil.ToFloat64(requestsTotal.WithLabelValues(routeS3Blob, "test-cloud", "test-region")); count != 2 {
+		t.Fatalf("expected 2 requests counted, got: %v", count)
+	}
+}
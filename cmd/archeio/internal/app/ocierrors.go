@@ -0,0 +1,58 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// OCI distribution error codes
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#error-codes
+const (
+	// requests archeio does not serve, such as pushes
+	ociErrorUnsupported = "UNSUPPORTED"
+	// requests archeio refuses to serve
+	ociErrorDenied          = "DENIED"
+	ociErrorTooManyRequests = "TOOMANYREQUESTS"
+	// requests that are not valid OCI grammar, see validateRequest
+	ociErrorNameInvalid     = "NAME_INVALID"
+	ociErrorDigestInvalid   = "DIGEST_INVALID"
+	ociErrorManifestUnknown = "MANIFEST_UNKNOWN"
+)
+
+// ociErrors is the OCI distribution error response body
+type ociErrors struct {
+	Errors []ociError `json:"errors"`
+}
+
+type ociError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Detail is unstructured, we use a string when set
+	Detail string `json:"detail,omitempty"`
+}
+
+// writeOCIError serves status with an OCI error body with code, message
+// and optionally detail
+func writeOCIError(w http.ResponseWriter, status int, code, message, detail string) {
+	// marshalling cannot fail for ociErrors
+	body, _ := json.Marshal(ociErrors{Errors: []ociError{{Code: code, Message: message, Detail: detail}}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
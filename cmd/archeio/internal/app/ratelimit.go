@@ -0,0 +1,234 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"k8s.io/registry.k8s.io/pkg/net/clientip"
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs"
+)
+
+// default client prefix lengths, see RateLimitConfig.IPv4PrefixLength
+const (
+	defaultIPv4RateLimitPrefix = 24
+	defaultIPv6RateLimitPrefix = 64
+)
+
+// rate limit scopes, see routeDecision.RateLimit
+const (
+	rateLimitIP     = "ip"
+	rateLimitPrefix = "prefix"
+)
+
+// rateLimitSweepInterval is how often idle token buckets are dropped
+const rateLimitSweepInterval = time.Minute
+
+// rateLimits is a validated RateLimitConfig with lookups derived from it
+type rateLimits struct {
+	config           *RateLimitConfig
+	allowlist        []netip.Prefix
+	ipv4PrefixLength int
+	ipv6PrefixLength int
+}
+
+// newRateLimits returns the rateLimits for c, or nil if c is nil
+func newRateLimits(c *RateLimitConfig) *rateLimits {
+	if c == nil {
+		return nil
+	}
+	l := &rateLimits{
+		config:           c,
+		ipv4PrefixLength: defaultIPv4RateLimitPrefix,
+		ipv6PrefixLength: defaultIPv6RateLimitPrefix,
+	}
+	if c.IPv4PrefixLength != 0 {
+		l.ipv4PrefixLength = c.IPv4PrefixLength
+	}
+	if c.IPv6PrefixLength != 0 {
+		l.ipv6PrefixLength = c.IPv6PrefixLength
+	}
+	for _, prefix := range c.Allowlist {
+		// this was already validated
+		p, _ := netip.ParsePrefix(prefix)
+		l.allowlist = append(l.allowlist, p.Masked())
+	}
+	return l
+}
+
+// allowed returns true if clientIP is never throttled
+func (l *rateLimits) allowed(clientIP netip.Addr) bool {
+	for _, prefix := range l.allowlist {
+		if prefix.Contains(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitFor returns the limits for clients from ipInfo
+func (l *rateLimits) limitFor(ipInfo cloudcidrs.IPInfo) RateLimit {
+	cloud, ok := l.config.Clouds[ipInfo.Cloud]
+	if !ok {
+		return l.config.RateLimit
+	}
+	if region, ok := cloud.Regions[ipInfo.Region]; ok {
+		return region
+	}
+	return cloud.RateLimit
+}
+
+// prefix returns the client prefix clientIP is limited with
+func (l *rateLimits) prefix(clientIP netip.Addr) netip.Prefix {
+	bits := l.ipv6PrefixLength
+	if clientIP.Is4() {
+		bits = l.ipv4PrefixLength
+	}
+	// the lengths were validated to fit
+	prefix, _ := clientIP.Prefix(bits)
+	return prefix
+}
+
+// rateLimiter holds the token buckets of recent clients, which are kept
+// across config reloads
+//
+// Use newRateLimiter to instantiate
+type rateLimiter struct {
+	// now is time.Now, except in tests
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		now:     time.Now,
+		buckets: map[string]*rate.Limiter{},
+	}
+}
+
+// allow takes a token for clientIP from its prefix and IP buckets, or
+// returns the scope of the limit it exceeded and when to retry
+//
+// the prefix is checked first, so that clients rotating through the
+// addresses of a throttled prefix do not each get a bucket
+func (rl *rateLimiter) allow(l *rateLimits, clientIP netip.Addr, limit RateLimit) (string, time.Duration) {
+	now := rl.now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.sweep(now)
+	taken := []*rate.Reservation{}
+	for _, b := range []struct {
+		scope string
+		key   string
+		rps   float64
+		burst int
+	}{
+		{rateLimitPrefix, l.prefix(clientIP).String(), limit.PrefixRequestsPerSecond, limit.PrefixBurst},
+		{rateLimitIP, clientIP.String(), limit.RequestsPerSecond, limit.Burst},
+	} {
+		if b.rps == 0 {
+			continue
+		}
+		// validation ensures burst is at least 1, so reservations are always ok
+		r := rl.bucket(b.scope+"/"+b.key, now, rate.Limit(b.rps), b.burst).ReserveN(now, 1)
+		if delay := r.DelayFrom(now); delay > 0 {
+			// throttled requests do not count against any bucket
+			r.CancelAt(now)
+			for _, t := range taken {
+				t.CancelAt(now)
+			}
+			return b.scope, delay
+		}
+		taken = append(taken, r)
+	}
+	return "", 0
+}
+
+// bucket returns the token bucket for key with limit and burst,
+// rl.mu must be held
+func (rl *rateLimiter) bucket(key string, now time.Time, limit rate.Limit, burst int) *rate.Limiter {
+	lim, ok := rl.buckets[key]
+	if !ok {
+		lim = rate.NewLimiter(limit, burst)
+		rl.buckets[key] = lim
+		rateLimitBuckets.Set(float64(len(rl.buckets)))
+		return lim
+	}
+	// the config may have been reloaded
+	if lim.Limit() != limit {
+		lim.SetLimitAt(now, limit)
+	}
+	if lim.Burst() != burst {
+		lim.SetBurstAt(now, burst)
+	}
+	return lim
+}
+
+// sweep drops full token buckets, which behave the same as new buckets,
+// at most every rateLimitSweepInterval, rl.mu must be held
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	for key, lim := range rl.buckets {
+		if lim.TokensAt(now) >= float64(lim.Burst()) {
+			delete(rl.buckets, key)
+		}
+	}
+	rateLimitBuckets.Set(float64(len(rl.buckets)))
+}
+
+// throttle returns a throttled routeDecision and true if r exceeds the
+// rate limits in rc, which takes a token from the client's buckets otherwise
+func (rt *Router) throttle(r *http.Request, rc *routingConfig) (routeDecision, bool) {
+	if rc.rateLimits == nil {
+		return routeDecision{}, false
+	}
+	// requests without a client IP are rejected by routing
+	clientIP, err := clientip.Get(r)
+	if err != nil {
+		return routeDecision{}, false
+	}
+	// so that IPv4 clients are limited by IPv4 prefixes
+	clientIP = clientIP.Unmap()
+	if rc.rateLimits.allowed(clientIP) {
+		return routeDecision{}, false
+	}
+	d := clientDecision(rt.ipRanges, clientIP)
+	limit := rc.rateLimits.limitFor(cloudcidrs.IPInfo{Cloud: d.Cloud, Region: d.Region})
+	scope, retryAfter := rt.rateLimiter.allow(rc.rateLimits, clientIP, limit)
+	if scope == "" {
+		return routeDecision{}, false
+	}
+	d.Status = http.StatusTooManyRequests
+	d.Error = "too many requests"
+	d.ErrorCode = ociErrorTooManyRequests
+	d.Route = routeThrottled
+	d.RateLimit = scope
+	d.RetryAfter = int(math.Ceil(retryAfter.Seconds()))
+	return d, true
+}
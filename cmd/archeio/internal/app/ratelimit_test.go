@@ -0,0 +1,147 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRouterRateLimits(t *testing.T) {
+	rc := DefaultRegistryConfig()
+	rc.RateLimits = &RateLimitConfig{
+		RateLimit: RateLimit{
+			RequestsPerSecond:       1,
+			Burst:                   2,
+			PrefixRequestsPerSecond: 3,
+			PrefixBurst:             3,
+		},
+		Clouds: map[string]CloudRateLimit{
+			"AWS": {
+				RateLimit: RateLimit{RequestsPerSecond: 1, Burst: 3},
+				Regions: map[string]RateLimit{
+					"eu-west-3": {RequestsPerSecond: 1, Burst: 4},
+				},
+			},
+		},
+		IPv4PrefixLength: 24,
+		IPv6PrefixLength: 48,
+		Allowlist:        []string{"198.51.100.1/24"},
+	}
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	router := newRouter(configs, &fakeBlobsChecker{})
+	now := time.Now()
+	router.rateLimiter.now = func() time.Time { return now }
+	handler := MakeHandler(router, HandlerOptions{})
+
+	// expectRequests expects n requests from remoteAddr to be allowed,
+	// and then the next to be throttled by scope if set
+	expectRequests := func(remoteAddr string, n int, scope string) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost:8080/v2/", nil)
+			r.RemoteAddr = remoteAddr
+			if d, throttled := router.throttle(r, configs.load()); throttled {
+				t.Fatalf("expected request %d from %s to be allowed, got: %+v", i, remoteAddr, d)
+			}
+		}
+		if scope == "" {
+			return
+		}
+		r := httptest.NewRequest(http.MethodGet, "http://localhost:8080/v2/", nil)
+		r.RemoteAddr = remoteAddr
+		d, throttled := router.throttle(r, configs.load())
+		if !throttled || d.RateLimit != scope || d.Status != http.StatusTooManyRequests || d.Route != routeThrottled {
+			t.Fatalf("expected request from %s to be throttled by %s, got: %+v", remoteAddr, scope, d)
+		}
+	}
+
+	// each IP is limited
+	expectRequests("192.0.2.1:80", 2, rateLimitIP)
+	// and so is each /24, which throttled requests do not count against
+	expectRequests("192.0.2.2:80", 1, rateLimitPrefix)
+	// including IPv4-mapped IPv6 clients
+	expectRequests("[::ffff:192.0.2.3]:80", 0, rateLimitPrefix)
+	// which do not get a bucket of their own once their prefix is throttled
+	if _, ok := router.rateLimiter.buckets[rateLimitIP+"/192.0.2.3"]; ok {
+		t.Fatal("expected no bucket for a client of a throttled prefix")
+	}
+	// IPv6 prefixes are limited separately
+	expectRequests("[2001:db8::1]:80", 2, rateLimitIP)
+	expectRequests("[2001:db8:0:1::1]:80", 1, rateLimitPrefix)
+	expectRequests("[2001:db8:1::1]:80", 2, rateLimitIP)
+
+	// allowlisted clients are never throttled
+	expectRequests("198.51.100.2:80", 10, "")
+	// clients use their region's limits over their cloud's, which replace
+	// all the default limits so there is no prefix limit here
+	expectRequests("35.180.1.1:80", 4, rateLimitIP)
+	expectRequests("35.180.1.2:80", 4, rateLimitIP)
+	expectRequests("3.5.140.1:80", 3, rateLimitIP)
+
+	// throttled requests are served a 429 with an OCI error
+	r := httptest.NewRequest(http.MethodGet, "http://localhost:8080/v2/pause/manifests/latest", nil)
+	r.RemoteAddr = "192.0.2.1:80"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" ||
+		w.Header().Get("Content-Type") != "application/json" ||
+		w.Body.String() != `{"errors":[{"code":"TOOMANYREQUESTS","message":"too many requests"}]}` {
+		t.Fatalf("unexpected response: %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+
+	// buckets refill over time
+	now = now.Add(time.Second)
+	expectRequests("192.0.2.1:80", 1, rateLimitIP)
+
+	// reloaded limits apply to existing buckets
+	rc.RateLimits = &RateLimitConfig{RateLimit: RateLimit{RequestsPerSecond: 0.5, Burst: 1}}
+	if err := configs.Update(rc); err != nil {
+		t.Fatalf("unexpected error updating config: %v", err)
+	}
+	now = now.Add(time.Second)
+	expectRequests("192.0.2.1:80", 1, rateLimitIP)
+	now = now.Add(time.Second)
+	expectRequests("192.0.2.1:80", 0, rateLimitIP)
+	now = now.Add(time.Second)
+	expectRequests("192.0.2.1:80", 1, rateLimitIP)
+
+	// full buckets are dropped
+	now = now.Add(rateLimitSweepInterval)
+	expectRequests("192.0.2.4:80", 1, rateLimitIP)
+	if buckets := len(router.rateLimiter.buckets); buckets != 1 {
+		t.Fatalf("expected only the latest client's bucket to remain, got: %d", buckets)
+	}
+
+	// requests without a client IP are left to routing
+	r = httptest.NewRequest(http.MethodGet, "http://localhost:8080/v2/", nil)
+	r.RemoteAddr = "invalid"
+	if _, throttled := router.throttle(r, configs.load()); throttled {
+		t.Fatal("expected request without a client IP not to be throttled")
+	}
+	// and nothing is throttled without rate limits
+	rc.RateLimits = nil
+	if err := configs.Update(rc); err != nil {
+		t.Fatalf("unexpected error updating config: %v", err)
+	}
+	expectRequests("192.0.2.1:80", 10, "")
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// OCI distribution grammar for repository names and references
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pulling-manifests
+//
+// Names and references can never contain `.` or `..` path segments,
+// so paths built from them cannot escape the path they are joined to.
+const (
+	nameComponentGrammar = `[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*`
+	nameGrammar          = nameComponentGrammar + `(?:/` + nameComponentGrammar + `)*`
+	tagGrammar           = `[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}`
+)
+
+var (
+	reName   = regexp.MustCompile("^" + nameGrammar + "$")
+	reTag    = regexp.MustCompile("^" + tagGrammar + "$")
+	reDigest = regexp.MustCompile("^([a-z0-9]+(?:[.+_-][a-z0-9]+)*):([a-f0-9]+)$")
+)
+
+// digestHexLengths are the registered digest algorithms we accept,
+// and the length of their hex encoded digests
+// https://github.com/opencontainers/image-spec/blob/main/descriptor.md#registered-algorithms
+var digestHexLengths = map[string]int{
+	"sha256": 64,
+	"sha512": 128,
+}
+
+// validDigest returns true if digest uses a registered algorithm
+// and is encoded with the right length for it
+func validDigest(digest string) bool {
+	matches := reDigest.FindStringSubmatch(digest)
+	return matches != nil && digestHexLengths[matches[1]] == len(matches[2])
+}
+
+// validateRequest returns an error routeDecision and true if the registry
+// API request rPath is not for a valid repository name and reference
+//
+// rPath must not be /v2/ or /v2/_catalog, which are handled separately.
+func validateRequest(rPath string) (routeDecision, bool) {
+	invalid := func(status int, code, err string) (routeDecision, bool) {
+		return routeDecision{Status: status, Error: err, ErrorCode: code}, true
+	}
+	matches := reRepository.FindStringSubmatch(rPath)
+	if matches == nil {
+		return invalid(http.StatusNotFound, ociErrorUnsupported, "unsupported registry API request")
+	}
+	name, api, value := matches[1], matches[2], matches[3]
+	if !reName.MatchString(name) {
+		return invalid(http.StatusBadRequest, ociErrorNameInvalid, "invalid repository name")
+	}
+	switch {
+	case api == "tags" && value != "list":
+		return invalid(http.StatusNotFound, ociErrorUnsupported, "unsupported registry API request")
+	// manifest references are tags unless they contain a digest's :
+	case api == "manifests" && !strings.Contains(value, ":"):
+		if !reTag.MatchString(value) {
+			// no manifest can ever be tagged with it
+			return invalid(http.StatusNotFound, ociErrorManifestUnknown, "invalid tag")
+		}
+	case api != "tags" && !validDigest(value):
+		return invalid(http.StatusBadRequest, ociErrorDigestInvalid, "invalid digest")
+	}
+	return routeDecision{}, false
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidDigest(t *testing.T) {
+	testCases := []struct {
+		Digest   string
+		Expected bool
+	}{
+		{Digest: "sha256:" + strings.Repeat("a", 64), Expected: true},
+		{Digest: "sha512:" + strings.Repeat("0", 128), Expected: true},
+		{Digest: "sha256:" + strings.Repeat("a", 63), Expected: false},
+		{Digest: "sha256:" + strings.Repeat("a", 128), Expected: false},
+		{Digest: "sha512:" + strings.Repeat("a", 64), Expected: false},
+		{Digest: "sha256:" + strings.Repeat("A", 64), Expected: false},
+		{Digest: "md5:" + strings.Repeat("a", 32), Expected: false},
+		{Digest: "sha256+b64u:" + strings.Repeat("a", 64), Expected: false},
+		{Digest: strings.Repeat("a", 64), Expected: false},
+		{Digest: "sha256:", Expected: false},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Digest, func(t *testing.T) {
+			t.Parallel()
+			if valid := validDigest(tc.Digest); valid != tc.Expected {
+				t.Fatalf("expected validDigest to be %v, got: %v", tc.Expected, valid)
+			}
+		})
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	testCases := []struct {
+		Path              string
+		ExpectedStatus    int
+		ExpectedErrorCode string
+	}{
+		{Path: "/v2/pause/manifests/latest"},
+		{Path: "/v2/pause/manifests/3.9_rc.1-x"},
+		{Path: "/v2/pause/manifests/" + digest},
+		{Path: "/v2/pause/blobs/" + digest},
+		{Path: "/v2/pause/referrers/" + digest},
+		{Path: "/v2/pause/tags/list"},
+		{Path: "/v2/a.b_c__d--e/f/manifests/latest"},
+		{
+			Path:              "/v2/pause",
+			ExpectedStatus:    http.StatusNotFound,
+			ExpectedErrorCode: ociErrorUnsupported,
+		},
+		{
+			Path:              "/v2/pause/blobs/uploads/",
+			ExpectedStatus:    http.StatusNotFound,
+			ExpectedErrorCode: ociErrorUnsupported,
+		},
+		{
+			Path:              "/v2/pause/tags/other",
+			ExpectedStatus:    http.StatusNotFound,
+			ExpectedErrorCode: ociErrorUnsupported,
+		},
+		{
+			Path:              "/v2/../manifests/latest",
+			ExpectedStatus:    http.StatusBadRequest,
+			ExpectedErrorCode: ociErrorNameInvalid,
+		},
+		{
+			Path:              "/v2/pause/../../other/manifests/latest",
+			ExpectedStatus:    http.StatusBadRequest,
+			ExpectedErrorCode: ociErrorNameInvalid,
+		},
+		{
+			Path:              "/v2/Pause/manifests/latest",
+			ExpectedStatus:    http.StatusBadRequest,
+			ExpectedErrorCode: ociErrorNameInvalid,
+		},
+		{
+			Path:              "/v2/pause//other/manifests/latest",
+			ExpectedStatus:    http.StatusBadRequest,
+			ExpectedErrorCode: ociErrorNameInvalid,
+		},
+		{
+			Path:              "/v2/pause/manifests/..",
+			ExpectedStatus:    http.StatusNotFound,
+			ExpectedErrorCode: ociErrorManifestUnknown,
+		},
+		{
+			Path:              "/v2/pause/manifests/" + strings.Repeat("a", 129),
+			ExpectedStatus:    http.StatusNotFound,
+			ExpectedErrorCode: ociErrorManifestUnknown,
+		},
+		{
+			Path:              "/v2/pause/manifests/sha256:aaaa",
+			ExpectedStatus:    http.StatusBadRequest,
+			ExpectedErrorCode: ociErrorDigestInvalid,
+		},
+		{
+			Path:              "/v2/pause/blobs/..",
+			ExpectedStatus:    http.StatusBadRequest,
+			ExpectedErrorCode: ociErrorDigestInvalid,
+		},
+		{
+			Path:              "/v2/pause/referrers/latest",
+			ExpectedStatus:    http.StatusBadRequest,
+			ExpectedErrorCode: ociErrorDigestInvalid,
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Path, func(t *testing.T) {
+			t.Parallel()
+			d, invalid := validateRequest(tc.Path)
+			if invalid != (tc.ExpectedErrorCode != "") || d.Status != tc.ExpectedStatus || d.ErrorCode != tc.ExpectedErrorCode {
+				t.Fatalf("expected status %d and error code %q, got: %v %+v", tc.ExpectedStatus, tc.ExpectedErrorCode, invalid, d)
+			}
+		})
+	}
+}
+
+func TestRouterRedirectsStayUnderUpstreamPath(t *testing.T) {
+	rc := DefaultRegistryConfig()
+	rc.UpstreamRegistryEndpoint = "https://registry.example"
+	rc.UpstreamRegistryPath = "images"
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	handler := MakeHandler(newRouter(configs, &fakeBlobsChecker{}), HandlerOptions{})
+	for _, path := range []string{
+		"/v2/pause/manifests/latest",
+		"/v2/../manifests/latest",
+		"/v2/pause/../../../manifests/latest",
+		"/v2/%2e%2e/%2e%2e/blobs/sha256:" + strings.Repeat("a", 64),
+		"/v2/pause/manifests/..",
+		"/v2/pause/tags/..",
+		"/v2/..",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost:8080"+path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		location := w.Header().Get("Location")
+		if location != "" && !strings.HasPrefix(location, "https://registry.example/v2/images/") {
+			t.Fatalf("expected %q to redirect under the upstream path, got: %q", path, location)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// reReferrers matches referrers API requests and captures the digest
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers
+var reReferrers = regexp.MustCompile("^/v2/.+/referrers/([a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+)$")
+
+const ociIndexMediaType = "application/vnd.oci.image.index.v1+json"
+
+// referrersIndex is the OCI image index listing referrers
+type referrersIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Manifests     []json.RawMessage `json:"manifests"`
+}
+
+// referrersTag returns the referrers tag schema tag for digest
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#referrers-tag-schema
+func referrersTag(digest string) string {
+	alg, ref, _ := strings.Cut(digest, ":")
+	return alg[:min(len(alg), 32)] + "-" + ref[:min(len(ref), 64)]
+}
+
+// referrersTTL is how long referrers are cached, artifacts such as signatures
+// may be attached to images at any time so this is kept short
+const referrersTTL = time.Minute
+
+// maxCachedReferrers bounds the number of cached referrers,
+// the least recently used are evicted first
+const maxCachedReferrers = 10000
+
+// cachedReferrers are the referrers at key, see referrersProxy.get
+type cachedReferrers struct {
+	key      string
+	content  []byte
+	filtered bool
+	result   string
+	fetched  time.Time
+}
+
+// referrersProxy serves the referrers API from the upstream registry,
+// falling back to the referrers tag schema for registries without it
+//
+// Use newReferrersProxy to instantiate
+type referrersProxy struct {
+	registry *registryClient
+	// now is time.Now, except in tests
+	now func() time.Time
+	// maxCached is maxCachedReferrers, except in tests
+	maxCached int
+
+	mu sync.Mutex
+	// cached holds referrers by upstream URL and artifactType, most
+	// recently used at the front of lru
+	lru    *list.List
+	cached map[string]*list.Element
+}
+
+func newReferrersProxy() *referrersProxy {
+	return &referrersProxy{
+		registry: &registryClient{client: &http.Client{
+			// ensure sensible timeouts
+			Timeout: time.Second * 10,
+		}},
+		now:       time.Now,
+		maxCached: maxCachedReferrers,
+		lru:       list.New(),
+		cached:    map[string]*list.Element{},
+	}
+}
+
+// serve serves the referrers request r decided by d, see makeV2Router
+//
+// If the referrers cannot be fetched, the client is redirected to the
+// upstream registry.
+func (p *referrersProxy) serve(w http.ResponseWriter, r *http.Request, d routeDecision) routeDecision {
+	// makeV2Router only decides to serve matching requests
+	digest := reReferrers.FindStringSubmatch(r.URL.Path)[1]
+	artifactType := r.URL.Query().Get("artifactType")
+	content, filtered, result, err := p.get(r.Context(), d.ReferrersURL, digest, artifactType)
+	referrersTotal.WithLabelValues(result).Inc()
+	d.Referrers = result
+	if err != nil {
+		klog.V(2).InfoS("failed to get referrers, redirecting to upstream registry", "url", d.ReferrersURL, "error", err)
+		d.Status = http.StatusTemporaryRedirect
+		d.Redirect = d.ReferrersURL
+		d.Route = routeUpstreamManifest
+		writeRouteDecision(w, r, d)
+		return d
+	}
+	w.Header().Set("Content-Type", ociIndexMediaType)
+	if filtered {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(d.Status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(content)
+	}
+	return d
+}
+
+// get returns the referrers index for digest at the upstream referrersURL,
+// whether it was filtered by artifactType, and the referrers result
+//
+// Referrers that were fetched are cached for referrersTTL.
+func (p *referrersProxy) get(ctx context.Context, referrersURL, digest, artifactType string) ([]byte, bool, string, error) {
+	fetchURL := referrersURL
+	if artifactType != "" {
+		fetchURL += "?" + url.Values{"artifactType": {artifactType}}.Encode()
+	}
+	if cached, ok := p.getCached(fetchURL); ok {
+		return cached.content, cached.filtered, referrersCached, nil
+	}
+	content, filtered, result, err := p.fetchReferrers(ctx, fetchURL, referrersURL, digest, artifactType)
+	if err == nil {
+		p.putCached(&cachedReferrers{key: fetchURL, content: content, filtered: filtered, result: result, fetched: p.now()})
+	}
+	return content, filtered, result, err
+}
+
+// getCached returns the unexpired referrers cached at key
+func (p *referrersProxy) getCached(key string) (*cachedReferrers, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.cached[key]
+	if !ok {
+		return nil, false
+	}
+	cached := e.Value.(*cachedReferrers)
+	if p.now().Sub(cached.fetched) >= referrersTTL {
+		p.lru.Remove(e)
+		delete(p.cached, key)
+		return nil, false
+	}
+	p.lru.MoveToFront(e)
+	return cached, true
+}
+
+// putCached caches referrers, evicting the least recently used
+// beyond maxCached
+func (p *referrersProxy) putCached(referrers *cachedReferrers) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.cached[referrers.key]; ok {
+		e.Value = referrers
+		p.lru.MoveToFront(e)
+		return
+	}
+	p.cached[referrers.key] = p.lru.PushFront(referrers)
+	for p.lru.Len() > p.maxCached {
+		e := p.lru.Back()
+		p.lru.Remove(e)
+		delete(p.cached, e.Value.(*cachedReferrers).key)
+	}
+}
+
+// fetchReferrers is get without the cache, fetchURL is referrersURL
+// with the artifactType filter
+func (p *referrersProxy) fetchReferrers(ctx context.Context, fetchURL, referrersURL, digest, artifactType string) ([]byte, bool, string, error) {
+	content, header, err := p.fetch(ctx, fetchURL)
+	if err == nil {
+		return content, header.Get("OCI-Filters-Applied") == "artifactType", referrersUpstream, nil
+	}
+	// registries supporting the referrers API never respond 404
+	var statusErr *upstreamStatusError
+	if !errors.As(err, &statusErr) || statusErr.status != http.StatusNotFound {
+		return nil, false, referrersError, err
+	}
+	tagURL := strings.TrimSuffix(referrersURL, "/referrers/"+digest) + "/manifests/" + referrersTag(digest)
+	content, _, err = p.fetch(ctx, tagURL)
+	if errors.As(err, &statusErr) && statusErr.status == http.StatusNotFound {
+		content, err = json.Marshal(referrersIndex{SchemaVersion: 2, MediaType: ociIndexMediaType, Manifests: []json.RawMessage{}})
+		return content, artifactType != "", referrersEmpty, err
+	}
+	if err != nil {
+		return nil, false, referrersError, err
+	}
+	content, err = filterReferrers(content, artifactType)
+	if err != nil {
+		return nil, false, referrersError, err
+	}
+	return content, artifactType != "", referrersTagSchema, nil
+}
+
+// filterReferrers returns the referrers index content with only the
+// descriptors for artifactType, or all descriptors if it is empty
+func filterReferrers(content []byte, artifactType string) ([]byte, error) {
+	index := referrersIndex{}
+	if err := json.Unmarshal(content, &index); err != nil {
+		return nil, err
+	}
+	manifests := []json.RawMessage{}
+	for _, manifest := range index.Manifests {
+		descriptor := struct {
+			ArtifactType string `json:"artifactType"`
+		}{}
+		if err := json.Unmarshal(manifest, &descriptor); err != nil {
+			return nil, err
+		}
+		if artifactType == "" || descriptor.ArtifactType == artifactType {
+			manifests = append(manifests, manifest)
+		}
+	}
+	// the tag may have been pushed without these
+	index.SchemaVersion, index.MediaType, index.Manifests = 2, ociIndexMediaType, manifests
+	return json.Marshal(index)
+}
+
+// fetch fetches the referrers index at fetchURL
+func (p *referrersProxy) fetch(ctx context.Context, fetchURL string) ([]byte, http.Header, error) {
+	resp, err := p.registry.get(ctx, fetchURL, ociIndexMediaType)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &upstreamStatusError{status: resp.StatusCode}
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(content) > maxManifestSize {
+		return nil, nil, errors.New("upstream referrers index is too large")
+	}
+	return content, resp.Header, nil
+}
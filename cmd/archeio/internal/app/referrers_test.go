@@ -0,0 +1,300 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReferrersTag(t *testing.T) {
+	testCases := []struct {
+		Digest      string
+		ExpectedTag string
+	}{
+		{
+			Digest:      "sha256:" + strings.Repeat("a", 64),
+			ExpectedTag: "sha256-" + strings.Repeat("a", 64),
+		},
+		{
+			Digest:      "sha512:" + strings.Repeat("b", 128),
+			ExpectedTag: "sha512-" + strings.Repeat("b", 64),
+		},
+		{
+			Digest:      strings.Repeat("c", 40) + ":d",
+			ExpectedTag: strings.Repeat("c", 32) + "-d",
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Digest, func(t *testing.T) {
+			t.Parallel()
+			if tag := referrersTag(tc.Digest); tag != tc.ExpectedTag {
+				t.Fatalf("expected tag %q, got: %q", tc.ExpectedTag, tag)
+			}
+		})
+	}
+}
+
+func TestRouterReferrers(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	const signature = `{"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/vnd.dev.cosign.artifact.sig.v1+json","digest":"sha256:1","size":1}`
+	const sbom = `{"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/spdx+json","digest":"sha256:2","size":1}`
+	const upstreamIndex = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[` + signature + `]}`
+	// repositories are named for how the fake registry behaves
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != ociIndexMediaType {
+			t.Errorf("unexpected Accept header: %q", r.Header.Get("Accept"))
+		}
+		switch r.URL.Path {
+		case "/v2/images/supported/referrers/" + digest:
+			if r.URL.Query().Get("artifactType") != "" {
+				w.Header().Set("OCI-Filters-Applied", "artifactType")
+			}
+			_, _ = w.Write([]byte(upstreamIndex))
+		case "/v2/images/tagged/manifests/" + referrersTag(digest):
+			_, _ = w.Write([]byte(`{"manifests":[` + signature + `,` + sbom + `]}`))
+		case "/v2/images/invalid/manifests/" + referrersTag(digest):
+			_, _ = w.Write([]byte(`{"manifests":"invalid"}`))
+		case "/v2/images/invalid-descriptor/manifests/" + referrersTag(digest):
+			_, _ = w.Write([]byte(`{"manifests":["invalid"]}`))
+		case "/v2/images/large/manifests/" + referrersTag(digest):
+			_, _ = w.Write([]byte(strings.Repeat(" ", maxManifestSize+1)))
+		case "/v2/images/broken/referrers/" + digest, "/v2/images/broken-tag/manifests/" + referrersTag(digest):
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	rc := DefaultRegistryConfig()
+	rc.UpstreamRegistryEndpoint = upstream.URL
+	rc.UpstreamRegistryPath = "images"
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	router := newRouter(configs, &fakeBlobsChecker{})
+	handler := MakeHandler(router, HandlerOptions{})
+
+	testCases := []struct {
+		Name                 string
+		Method               string
+		Path                 string
+		ExpectedStatus       int
+		ExpectedBody         string
+		ExpectedFilters      string
+		ExpectedRedirectPath string
+		ExpectedErrorCode    string
+	}{
+		{
+			Name:           "upstream referrers API",
+			Path:           "/v2/supported/referrers/" + digest,
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   upstreamIndex,
+		},
+		{
+			Name:            "upstream referrers API filtered",
+			Path:            "/v2/supported/referrers/" + digest + "?artifactType=application/vnd.dev.cosign.artifact.sig.v1%2Bjson",
+			ExpectedStatus:  http.StatusOK,
+			ExpectedBody:    upstreamIndex,
+			ExpectedFilters: "artifactType",
+		},
+		{
+			Name:           "HEAD",
+			Method:         http.MethodHead,
+			Path:           "/v2/supported/referrers/" + digest,
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Name:           "tag schema",
+			Path:           "/v2/tagged/referrers/" + digest,
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[` + signature + `,` + sbom + `]}`,
+		},
+		{
+			Name:            "tag schema filtered",
+			Path:            "/v2/tagged/referrers/" + digest + "?artifactType=application/spdx%2Bjson",
+			ExpectedStatus:  http.StatusOK,
+			ExpectedBody:    `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[` + sbom + `]}`,
+			ExpectedFilters: "artifactType",
+		},
+		{
+			Name:           "no referrers",
+			Path:           "/v2/none/referrers/" + digest,
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`,
+		},
+		{
+			Name:                 "upstream error",
+			Path:                 "/v2/broken/referrers/" + digest,
+			ExpectedStatus:       http.StatusTemporaryRedirect,
+			ExpectedRedirectPath: "/v2/images/broken/referrers/" + digest,
+		},
+		{
+			Name:                 "tag schema error",
+			Path:                 "/v2/broken-tag/referrers/" + digest,
+			ExpectedStatus:       http.StatusTemporaryRedirect,
+			ExpectedRedirectPath: "/v2/images/broken-tag/referrers/" + digest,
+		},
+		{
+			Name:                 "invalid tag schema index",
+			Path:                 "/v2/invalid/referrers/" + digest,
+			ExpectedStatus:       http.StatusTemporaryRedirect,
+			ExpectedRedirectPath: "/v2/images/invalid/referrers/" + digest,
+		},
+		{
+			Name:                 "invalid tag schema descriptor",
+			Path:                 "/v2/invalid-descriptor/referrers/" + digest,
+			ExpectedStatus:       http.StatusTemporaryRedirect,
+			ExpectedRedirectPath: "/v2/images/invalid-descriptor/referrers/" + digest,
+		},
+		{
+			Name:                 "too large tag schema index",
+			Path:                 "/v2/large/referrers/" + digest,
+			ExpectedStatus:       http.StatusTemporaryRedirect,
+			ExpectedRedirectPath: "/v2/images/large/referrers/" + digest,
+		},
+		{
+			Name:              "not a digest",
+			Path:              "/v2/supported/referrers/latest",
+			ExpectedStatus:    http.StatusBadRequest,
+			ExpectedErrorCode: ociErrorDigestInvalid,
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			method := tc.Method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "http://localhost:8080"+tc.Path, nil)
+			r.RemoteAddr = "127.0.0.1:8888"
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.ExpectedStatus {
+				t.Fatalf("expected status %d, got: %d", tc.ExpectedStatus, w.Code)
+			}
+			if tc.ExpectedErrorCode != "" {
+				expectOCIError(t, w.Result(), tc.ExpectedErrorCode)
+				return
+			}
+			if tc.ExpectedRedirectPath != "" {
+				if location := w.Header().Get("Location"); location != upstream.URL+tc.ExpectedRedirectPath {
+					t.Fatalf("expected redirect to %q, got: %q", upstream.URL+tc.ExpectedRedirectPath, location)
+				}
+				return
+			}
+			if w.Header().Get("Content-Type") != ociIndexMediaType || w.Header().Get("OCI-Filters-Applied") != tc.ExpectedFilters {
+				t.Fatalf("unexpected headers: %v", w.Header())
+			}
+			if body := w.Body.String(); body != tc.ExpectedBody {
+				t.Fatalf("expected body %q, got: %q", tc.ExpectedBody, body)
+			}
+			if tc.Method == http.MethodHead && w.Header().Get("Content-Length") != strconv.Itoa(len(upstreamIndex)) {
+				t.Fatalf("unexpected Content-Length: %q", w.Header().Get("Content-Length"))
+			}
+		})
+	}
+
+	// explaining does not fetch referrers
+	explanation, err := router.Explain("127.0.0.1", "/v2/unreachable/referrers/"+digest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if explanation.Status != http.StatusOK || explanation.Route != routeReferrers || explanation.Backend != backendUpstream ||
+		explanation.ReferrersURL != upstream.URL+"/v2/images/unreachable/referrers/"+digest || explanation.Referrers != "" {
+		t.Fatalf("unexpected explanation: %+v", explanation)
+	}
+}
+
+func TestReferrersProxyCache(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if strings.HasPrefix(r.URL.Path, "/v2/broken/") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`))
+	}))
+	t.Cleanup(upstream.Close)
+	p := newReferrersProxy()
+	p.maxCached = 2
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	get := func(ctx context.Context, repo, artifactType, expectedResult string, expectedRequests int32) {
+		t.Helper()
+		_, _, result, _ := p.get(ctx, upstream.URL+"/v2/"+repo+"/referrers/"+digest, digest, artifactType)
+		if result != expectedResult || requests.Load() != expectedRequests {
+			t.Fatalf("expected %q after %d requests, got: %q after %d", expectedResult, expectedRequests, result, requests.Load())
+		}
+	}
+
+	// referrers are fetched and then cached, by artifactType
+	get(context.Background(), "a", "", referrersUpstream, 1)
+	get(context.Background(), "a", "", referrersCached, 1)
+	get(context.Background(), "a", "application/spdx+json", referrersUpstream, 2)
+	// until they expire
+	now = now.Add(referrersTTL)
+	get(context.Background(), "a", "", referrersUpstream, 3)
+	// errors are not cached
+	get(context.Background(), "broken", "", referrersError, 4)
+	get(context.Background(), "broken", "", referrersError, 5)
+	// nor are requests from clients that went away
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	get(cancelled, "b", "", referrersError, 5)
+	// the least recently used referrers are evicted
+	get(context.Background(), "b", "", referrersUpstream, 6)
+	get(context.Background(), "c", "", referrersUpstream, 7)
+	get(context.Background(), "b", "", referrersCached, 7)
+	get(context.Background(), "a", "", referrersUpstream, 8)
+	if len(p.cached) != 2 || p.lru.Len() != 2 {
+		t.Fatalf("expected two cached referrers, got: %d %d", len(p.cached), p.lru.Len())
+	}
+	// and replaced in place when fetched again
+	p.putCached(&cachedReferrers{key: upstream.URL + "/v2/b/referrers/" + digest})
+	if len(p.cached) != 2 || p.lru.Len() != 2 {
+		t.Fatalf("expected two cached referrers, got: %d %d", len(p.cached), p.lru.Len())
+	}
+}
+
+func TestReferrersProxyFetchErrors(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	truncated := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(truncated.Close)
+	p := newReferrersProxy()
+	for _, fetchURL := range []string{unreachable.URL, truncated.URL} {
+		if _, _, err := p.fetch(context.Background(), fetchURL); err == nil {
+			t.Fatalf("expected error fetching %q but got none", fetchURL)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// registryClient fetches from registries and buckets anonymously
+type registryClient struct {
+	client *http.Client
+}
+
+// get GETs rawURL with the accept header if set
+//
+// Registries typically require a token even for anonymous pulls, so if the
+// response is 401 the request is retried with an anonymous bearer token.
+func (c *registryClient) get(ctx context.Context, rawURL, accept string) (*http.Response, error) {
+	return c.do(ctx, http.MethodGet, rawURL, accept)
+}
+
+// head is like get, but with HEAD
+func (c *registryClient) head(ctx context.Context, rawURL string) (*http.Response, error) {
+	return c.do(ctx, http.MethodHead, rawURL, "")
+}
+
+func (c *registryClient) do(ctx context.Context, method, rawURL, accept string) (*http.Response, error) {
+	resp, err := c.request(ctx, method, rawURL, accept, "")
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		var token string
+		if token, err = c.fetchToken(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+			return nil, err
+		}
+		resp, err = c.request(ctx, method, rawURL, accept, token)
+	}
+	return resp, err
+}
+
+func (c *registryClient) request(ctx context.Context, method, rawURL, accept, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return c.client.Do(req)
+}
+
+// reChallengeParam matches the parameters of a WWW-Authenticate challenge
+var reChallengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// fetchToken fetches an anonymous bearer token given the WWW-Authenticate
+// challenge from the registry
+// https://distribution.github.io/distribution/spec/auth/token/
+func (c *registryClient) fetchToken(ctx context.Context, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported auth challenge %q", challenge)
+	}
+	params := map[string]string{}
+	for _, match := range reChallengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	query := url.Values{}
+	for _, param := range []string{"service", "scope"} {
+		if v, ok := params[param]; ok {
+			query.Set(param, v)
+		}
+	}
+	resp, err := c.request(ctx, http.MethodGet, params["realm"]+"?"+query.Encode(), "", "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching token failed with status %s", resp.Status)
+	}
+	// access_token is the OAuth 2.0 compatible name for token
+	result := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to parse token: %w", err)
+	}
+	if result.Token != "" {
+		return result.Token, nil
+	}
+	return result.AccessToken, nil
+}
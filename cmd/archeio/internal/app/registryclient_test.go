@@ -0,0 +1,124 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistryClientGet(t *testing.T) {
+	t.Parallel()
+	// see newFakeRegistry, which requires a token
+	registry := newFakeRegistry(t)
+	c := &registryClient{client: http.DefaultClient}
+	resp, err := c.get(context.Background(), registry.URL+"/v2/pause/manifests/3.9", manifestAccept)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != testManifest {
+		t.Fatalf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestRegistryClientGetAccessToken(t *testing.T) {
+	t.Parallel()
+	// OAuth 2.0 compatible token servers may only set access_token
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"access_token": "anonymous"}`))
+	}))
+	t.Cleanup(tokenServer.Close)
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer anonymous" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q`, tokenServer.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(registry.Close)
+	c := &registryClient{client: http.DefaultClient}
+	resp, err := c.get(context.Background(), registry.URL+"/v2/pause/blobs/sha256:aaaa", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+}
+
+func TestRegistryClientGetErrors(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	newServer := func(handler http.HandlerFunc) string {
+		s := httptest.NewServer(handler)
+		t.Cleanup(s.Close)
+		return s.URL
+	}
+	challenge := func(realm string) http.HandlerFunc {
+		return func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q,service="registry.example"`, realm))
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}
+	testCases := []struct {
+		Name string
+		URL  string
+	}{
+		{Name: "invalid URL", URL: "http://%zz/v2/pause/manifests/3.9"},
+		{Name: "unreachable", URL: unreachable.URL + "/v2/pause/manifests/3.9"},
+		{
+			Name: "unsupported challenge",
+			URL: newServer(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="registry.example"`)
+				w.WriteHeader(http.StatusUnauthorized)
+			}),
+		},
+		{Name: "invalid realm", URL: newServer(challenge("http://%zz"))},
+		{Name: "unreachable realm", URL: newServer(challenge(unreachable.URL))},
+		{
+			Name: "token denied",
+			URL: newServer(challenge(newServer(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			}))),
+		},
+		{
+			Name: "unparsable token",
+			URL: newServer(challenge(newServer(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("{"))
+			}))),
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			c := &registryClient{client: http.DefaultClient}
+			if resp, err := c.get(context.Background(), tc.URL, ""); err == nil {
+				resp.Body.Close()
+				t.Fatalf("expected error but got status: %d", resp.StatusCode)
+			}
+		})
+	}
+}
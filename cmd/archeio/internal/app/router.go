@@ -0,0 +1,220 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"k8s.io/registry.k8s.io/pkg/net/clientip"
+)
+
+// Router decides how registry API requests are served
+//
+// It holds the state shared between the registry handler and the admin
+// explain endpoint, such as the blob existence cache, so that explaining
+// a request reflects how it would actually be served.
+//
+// Use NewRouter to instantiate
+type Router struct {
+	configs   *ConfigStore
+	inventory *blobInventory
+	ipRanges  *ipRanges
+	// see RouterOptions.IPRangeFiles
+	ipRangeFiles map[string]string
+	// manifests is nil unless the manifest cache is enabled
+	manifests *manifestCache
+	// blobDisk is nil unless the blob disk cache is enabled
+	blobDisk  *blobDiskCache
+	referrers *referrersProxy
+	// rateLimiter enforces RegistryConfig.RateLimits
+	rateLimiter *rateLimiter
+	routeV2     func(r *http.Request, rc *routingConfig) routeDecision
+}
+
+// RouterOptions configures a Router
+type RouterOptions struct {
+	// BlobCache configures the blob existence cache, see DefaultBlobCacheOptions
+	BlobCache BlobCacheOptions
+	// MaxBlobHeadsPerBucket bounds outstanding blob existence checks to each
+	// bucket, blob requests that would exceed this are sent upstream
+	MaxBlobHeadsPerBucket int
+	// CircuitBreaker configures skipping blob existence checks for failing buckets
+	CircuitBreaker CircuitBreakerOptions
+	// IPRangeFiles maps clouds to files with the raw IP ranges data they publish,
+	// which replace the compiled in ranges for that cloud, see Router.RunIPRanges
+	// and cloudcidrs.LoadIPMapper
+	IPRangeFiles map[string]string
+	// ManifestCache configures serving manifests from archeio
+	ManifestCache ManifestCacheOptions
+	// BlobDiskCache configures storing blobs on local disk and serving them
+	// from archeio
+	BlobDiskCache BlobDiskCacheOptions
+}
+
+// DefaultRouterOptions returns the default RouterOptions
+func DefaultRouterOptions() RouterOptions {
+	return RouterOptions{
+		BlobCache:             DefaultBlobCacheOptions(),
+		MaxBlobHeadsPerBucket: 100,
+		CircuitBreaker:        DefaultCircuitBreakerOptions(),
+		ManifestCache:         DefaultManifestCacheOptions(),
+		BlobDiskCache:         DefaultBlobDiskCacheOptions(),
+	}
+}
+
+// Validate returns an error if o is not usable
+func (o RouterOptions) Validate() error {
+	var errs []error
+	if err := o.BlobCache.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if o.MaxBlobHeadsPerBucket < 1 {
+		errs = append(errs, errors.New("max blob HEADs per bucket must be at least 1"))
+	}
+	if err := o.CircuitBreaker.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := o.ManifestCache.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := o.BlobDiskCache.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// NewRouter returns a Router serving according to the current config in configs,
+// or an error if opts are invalid
+func NewRouter(configs *ConfigStore, opts RouterOptions) (*Router, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	blobs := newCachedBlobChecker(opts.BlobCache, opts.MaxBlobHeadsPerBucket, opts.CircuitBreaker)
+	blobs.inventory = &blobInventory{}
+	rt := newRouter(configs, blobs)
+	rt.inventory = blobs.inventory
+	rt.ipRangeFiles = opts.IPRangeFiles
+	if opts.ManifestCache.Enabled {
+		manifests, err := newManifestCache(opts.ManifestCache)
+		if err != nil {
+			return nil, err
+		}
+		rt.manifests = manifests
+	}
+	if opts.BlobDiskCache.Dir != "" {
+		blobDisk, err := newBlobDiskCache(opts.BlobDiskCache)
+		if err != nil {
+			return nil, err
+		}
+		rt.blobDisk = blobDisk
+	}
+	return rt, nil
+}
+
+func newRouter(configs *ConfigStore, blobs blobChecker) *Router {
+	ranges := newIPRanges()
+	return &Router{
+		configs:     configs,
+		ipRanges:    ranges,
+		referrers:   newReferrersProxy(),
+		rateLimiter: newRateLimiter(),
+		routeV2:     makeV2Router(blobs, ranges),
+	}
+}
+
+// route decides how the registry API request r is served with rc
+//
+// With the manifest cache enabled, manifest requests are served by archeio
+// from the upstream URL they would otherwise be redirected to.
+//
+// With the blob disk cache enabled, sha256 blob requests are served by
+// archeio from disk, and missing blobs are served from where the request
+// would otherwise be redirected to, see Router.serveDiskBlob. Redirects to
+// private buckets are signed for the request method, so only GET requests
+// download blobs.
+func (rt *Router) route(r *http.Request, rc *routingConfig) routeDecision {
+	blobDigest := ""
+	if rt.blobDisk != nil {
+		if m := reSHA256Blob.FindStringSubmatch(r.URL.Path); m != nil {
+			blobDigest = m[1]
+		}
+	}
+	if blobDigest != "" && rt.blobDisk.contains(blobDigest) {
+		// client info is only needed for metrics here
+		d := routeDecision{}
+		if clientIP, err := clientip.Get(r); err == nil {
+			d = clientDecision(rt.ipRanges, clientIP)
+		}
+		d.Status = http.StatusOK
+		d.Route = routeCachedBlob
+		return d
+	}
+	d := rt.routeV2(r, rc)
+	switch {
+	case rt.manifests != nil && d.Route == routeUpstreamManifest && reManifest.MatchString(r.URL.Path):
+		d.Status = http.StatusOK
+		d.ManifestURL, d.Redirect = d.Redirect, ""
+		d.Route = routeCachedManifest
+	case blobDigest != "" && d.Redirect != "":
+		d.Status = http.StatusOK
+		d.BlobFillURL, d.Redirect = d.Redirect, ""
+	}
+	return d
+}
+
+// Explanation is the JSON trace of how a registry API request would be served
+//
+// See Router.Explain and docs/admin.md
+type Explanation struct {
+	// Path is the request path that was explained
+	Path string `json:"path"`
+	// ConfigHash identifies the config used, see ConfigStore.Hash
+	ConfigHash string `json:"configHash"`
+	routeDecision
+}
+
+// Explain runs the registry request routing logic for a GET of path from
+// clientIP without serving anything, and returns how it was routed
+//
+// Blob requests are checked against the bucket exactly as when serving,
+// which uses and populates the blob existence cache.
+func (rt *Router) Explain(clientIP, path string) (Explanation, error) {
+	ip, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return Explanation{}, fmt.Errorf("invalid client IP: %w", err)
+	}
+	if !strings.HasPrefix(path, "/v2") {
+		return Explanation{}, errors.New("path must be a registry API path starting with /v2")
+	}
+	r, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return Explanation{}, fmt.Errorf("invalid path: %w", err)
+	}
+	// without X-Forwarded-For the client IP is detected from RemoteAddr
+	r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+	rc := rt.configs.load()
+	return Explanation{
+		Path:          r.URL.Path,
+		ConfigHash:    rc.hash,
+		routeDecision: rt.route(r, rc),
+	}, nil
+}
@@ -0,0 +1,374 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRouterExplain(t *testing.T) {
+	const digest = "sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e"
+	const bucketURL = "https://prod-registry-k8s-io-eu-west-1.s3.dualstack.eu-west-1.amazonaws.com"
+	blobs := fakeBlobsChecker{
+		knownURLs: map[string]bool{
+			bucketURL + "/containers/images/" + digest: true,
+		},
+	}
+	configs, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	router := newRouter(configs, &blobs)
+
+	t.Run("blob", func(t *testing.T) {
+		t.Parallel()
+		explanation, err := router.Explain("35.180.1.1", "/v2/pause/blobs/"+digest)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if explanation.ConfigHash != configs.Hash() {
+			t.Errorf("expected config hash %q, got: %q", configs.Hash(), explanation.ConfigHash)
+		}
+		if explanation.Path != "/v2/pause/blobs/"+digest {
+			t.Errorf("unexpected path: %q", explanation.Path)
+		}
+		if explanation.Status != http.StatusTemporaryRedirect ||
+			explanation.Route != routeS3Blob ||
+			explanation.Backend != "eu-west-1" ||
+			explanation.BucketURL != bucketURL ||
+			explanation.Redirect != bucketURL+"/containers/images/"+digest ||
+			explanation.ClientIP != "35.180.1.1" ||
+			explanation.Region != "eu-west-3" ||
+			!slices.Equal(explanation.CheckedBuckets, []string{"eu-west-1"}) {
+			t.Errorf("unexpected explanation: %+v", explanation)
+		}
+		if explanation.BlobCacheHit == nil || *explanation.BlobCacheHit {
+			t.Errorf("expected blob cache miss, got: %v", explanation.BlobCacheHit)
+		}
+		prefix, err := netip.ParsePrefix(explanation.MatchedPrefix)
+		if err != nil || !prefix.Contains(netip.MustParseAddr("35.180.1.1")) {
+			t.Errorf("expected matched prefix containing the client IP, got: %q", explanation.MatchedPrefix)
+		}
+	})
+
+	t.Run("manifest from unknown IP", func(t *testing.T) {
+		t.Parallel()
+		explanation, err := router.Explain("::1", "/v2/pause/manifests/latest")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if explanation.Route != routeUpstreamManifest || explanation.ClientIP != "::1" ||
+			explanation.MatchedPrefix != "" || explanation.BucketURL != "" || explanation.BlobCacheHit != nil {
+			t.Errorf("unexpected explanation: %+v", explanation)
+		}
+	})
+
+	errorCases := []struct {
+		Name string
+		IP   string
+		Path string
+	}{
+		{Name: "invalid IP", IP: "not-an-ip", Path: "/v2/"},
+		{Name: "non-registry path", IP: "127.0.0.1", Path: "/privacy"},
+		{Name: "invalid path", IP: "127.0.0.1", Path: "/v2/%zz"},
+	}
+	for i := range errorCases {
+		tc := errorCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := router.Explain(tc.IP, tc.Path); err == nil {
+				t.Fatal("expected error but got none")
+			}
+		})
+	}
+}
+
+// slowBlobsChecker is a fakeBlobsChecker that takes delay for each check
+type slowBlobsChecker struct {
+	fakeBlobsChecker
+	delay time.Duration
+}
+
+func (s *slowBlobsChecker) BlobExists(bucket Backend, repo, digest string) (exists, cached bool) {
+	time.Sleep(s.delay)
+	return s.fakeBlobsChecker.BlobExists(bucket, repo, digest)
+}
+
+func TestRouterBucketFallbacks(t *testing.T) {
+	const digest = "sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e"
+	rc := DefaultRegistryConfig()
+	rc.UpstreamRegistryEndpoint = "https://registry.example"
+	rc.UpstreamRegistryPath = ""
+	rc.Buckets = []BucketConfig{
+		{Name: "a", URL: "https://a.example", Fallbacks: []string{"b", "c"}},
+		{Name: "b", URL: "https://b.example"},
+		{Name: "c", URL: "https://c.example"},
+	}
+	rc.RegionToBucket = map[string]string{}
+	rc.DefaultBucket = "a"
+	testCases := []struct {
+		Name             string
+		FallbackBudget   string
+		Delay            time.Duration
+		KnownBuckets     []string
+		ExpectedRoute    string
+		ExpectedBackend  string
+		ExpectedRedirect string
+		ExpectedChecked  []string
+	}{
+		{
+			Name:             "nearest bucket",
+			KnownBuckets:     []string{"a", "c"},
+			ExpectedRoute:    routeS3Blob,
+			ExpectedBackend:  "a",
+			ExpectedRedirect: "https://a.example/containers/images/" + digest,
+			ExpectedChecked:  []string{"a"},
+		},
+		{
+			Name:             "last fallback bucket",
+			KnownBuckets:     []string{"c"},
+			ExpectedRoute:    routeS3FallbackBlob,
+			ExpectedBackend:  "c",
+			ExpectedRedirect: "https://c.example/containers/images/" + digest,
+			ExpectedChecked:  []string{"a", "b", "c"},
+		},
+		{
+			Name:             "no bucket",
+			ExpectedRoute:    routeS3Fallback,
+			ExpectedBackend:  backendUpstream,
+			ExpectedRedirect: "https://registry.example/v2/pause/blobs/" + digest,
+			ExpectedChecked:  []string{"a", "b", "c"},
+		},
+		{
+			Name:             "latency budget exceeded",
+			FallbackBudget:   "1ms",
+			Delay:            5 * time.Millisecond,
+			KnownBuckets:     []string{"b"},
+			ExpectedRoute:    routeS3Fallback,
+			ExpectedBackend:  backendUpstream,
+			ExpectedRedirect: "https://registry.example/v2/pause/blobs/" + digest,
+			ExpectedChecked:  []string{"a"},
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			rc := rc
+			rc.FallbackBudget = tc.FallbackBudget
+			configs, err := NewConfigStore(rc)
+			if err != nil {
+				t.Fatalf("unexpected error creating config store: %v", err)
+			}
+			blobs := &slowBlobsChecker{
+				fakeBlobsChecker: fakeBlobsChecker{knownURLs: map[string]bool{}},
+				delay:            tc.Delay,
+			}
+			for _, name := range tc.KnownBuckets {
+				blobs.knownURLs["https://"+name+".example/containers/images/"+digest] = true
+			}
+			explanation, err := newRouter(configs, blobs).Explain("127.0.0.1", "/v2/pause/blobs/"+digest)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if explanation.Route != tc.ExpectedRoute ||
+				explanation.Backend != tc.ExpectedBackend ||
+				explanation.Redirect != tc.ExpectedRedirect ||
+				explanation.BucketURL != "https://a.example" ||
+				!slices.Equal(explanation.CheckedBuckets, tc.ExpectedChecked) {
+				t.Errorf("unexpected explanation: %+v", explanation)
+			}
+		})
+	}
+}
+
+func TestRouterOCIBackend(t *testing.T) {
+	const digest = "sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e"
+	rc := DefaultRegistryConfig()
+	rc.Buckets = []BucketConfig{{Name: "mirror", Type: BackendOCI, URL: "https://mirror.example/k8s"}}
+	rc.RegionToBucket = map[string]string{}
+	rc.DefaultBucket = "mirror"
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	const blobURL = "https://mirror.example/v2/k8s/pause/blobs/" + digest
+	blobs := fakeBlobsChecker{knownURLs: map[string]bool{blobURL: true}}
+	explanation, err := newRouter(configs, &blobs).Explain("127.0.0.1", "/v2/pause/blobs/"+digest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if explanation.Route != routeS3Blob || explanation.Backend != "mirror" || explanation.Redirect != blobURL {
+		t.Errorf("unexpected explanation: %+v", explanation)
+	}
+}
+
+func TestRouterTrafficSplit(t *testing.T) {
+	const digest = "sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e"
+	const bucketURL = "https://prod-registry-k8s-io-eu-west-1.s3.dualstack.eu-west-1.amazonaws.com"
+	rc := DefaultRegistryConfig()
+	rc.Buckets = append(rc.Buckets, BucketConfig{Name: "canary", URL: "https://canary.example", Fallbacks: []string{"eu-west-1"}})
+	// 35.180.1.1 is in eu-west-3
+	rc.TrafficSplits = map[string][]WeightedBucketConfig{
+		"eu-west-3": {{Bucket: "eu-west-1", Weight: 0}, {Bucket: "canary", Weight: 1}},
+	}
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	// the blob is not in the canary yet, so this falls back
+	blobs := fakeBlobsChecker{knownURLs: map[string]bool{bucketURL + "/containers/images/" + digest: true}}
+	explanation, err := newRouter(configs, &blobs).Explain("35.180.1.1", "/v2/pause/blobs/"+digest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if explanation.BucketURL != "https://canary.example" ||
+		explanation.Backend != "eu-west-1" ||
+		explanation.TrafficSplit != "eu-west-1=0,canary=1" ||
+		!slices.Equal(explanation.CheckedBuckets, []string{"canary", "eu-west-1"}) {
+		t.Errorf("unexpected explanation: %+v", explanation)
+	}
+}
+
+func TestRouterRoutingRules(t *testing.T) {
+	const digest = "sha256:da86e6ba6ca197bf6bc5e9d900febd906b133eaa4750e6bed647b0fbe50ed43e"
+	rc := DefaultRegistryConfig()
+	rc.Buckets = []BucketConfig{
+		{Name: "bucket", URL: "https://bucket.example"},
+		{Name: "team-mirror", Type: BackendOCI, URL: "https://mirror.example/team"},
+	}
+	rc.RegionToBucket = map[string]string{}
+	rc.DefaultBucket = "bucket"
+	rc.RoutingRules = []RoutingRuleConfig{
+		{
+			Name:                     "team",
+			Prefix:                   "team",
+			StripPrefix:              true,
+			UpstreamRegistryEndpoint: "https://team.example",
+			UpstreamRegistryPath:     "team-images",
+			Buckets:                  []string{"team-mirror"},
+			DefaultBucket:            "team-mirror",
+		},
+		{
+			Name:                     "tools",
+			Glob:                     "tools-*",
+			UpstreamRegistryEndpoint: "https://tools.example",
+		},
+	}
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	blobs := fakeBlobsChecker{knownURLs: map[string]bool{
+		"https://bucket.example/containers/images/" + digest: true,
+		"https://mirror.example/v2/team/app/blobs/" + digest: true,
+	}}
+	router := newRouter(configs, &blobs)
+
+	testCases := []struct {
+		Path                string
+		ExpectedRoutingRule string
+		ExpectedRoute       string
+		ExpectedBackend     string
+		ExpectedRedirect    string
+	}{
+		{
+			Path:                "/v2/team/app/blobs/" + digest,
+			ExpectedRoutingRule: "team",
+			ExpectedRoute:       routeS3Blob,
+			ExpectedBackend:     "team-mirror",
+			ExpectedRedirect:    "https://mirror.example/v2/team/app/blobs/" + digest,
+		},
+		{
+			Path:                "/v2/team/app/manifests/latest",
+			ExpectedRoutingRule: "team",
+			ExpectedRoute:       routeUpstreamManifest,
+			ExpectedBackend:     backendUpstream,
+			ExpectedRedirect:    "https://team.example/v2/team-images/app/manifests/latest",
+		},
+		{
+			Path:                "/v2/team/other/blobs/" + digest,
+			ExpectedRoutingRule: "team",
+			ExpectedRoute:       routeS3Fallback,
+			ExpectedBackend:     backendUpstream,
+			ExpectedRedirect:    "https://team.example/v2/team-images/other/blobs/" + digest,
+		},
+		{
+			Path:                "/v2/tools-kubectl/blobs/" + digest,
+			ExpectedRoutingRule: "tools",
+			ExpectedRoute:       routeUnmappedBlob,
+			ExpectedBackend:     backendUpstream,
+			ExpectedRedirect:    "https://tools.example/v2/tools-kubectl/blobs/" + digest,
+		},
+		{
+			Path:             "/v2/pause/blobs/" + digest,
+			ExpectedRoute:    routeS3Blob,
+			ExpectedBackend:  "bucket",
+			ExpectedRedirect: "https://bucket.example/containers/images/" + digest,
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Path, func(t *testing.T) {
+			t.Parallel()
+			explanation, err := router.Explain("127.0.0.1", tc.Path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if explanation.RoutingRule != tc.ExpectedRoutingRule ||
+				explanation.Route != tc.ExpectedRoute ||
+				explanation.Backend != tc.ExpectedBackend ||
+				explanation.Redirect != tc.ExpectedRedirect {
+				t.Errorf("unexpected explanation: %+v", explanation)
+			}
+		})
+	}
+}
+
+// mustNewRouter returns a Router with the default options for configs
+func mustNewRouter(t *testing.T, configs *ConfigStore) *Router {
+	t.Helper()
+	router, err := NewRouter(configs, DefaultRouterOptions())
+	if err != nil {
+		t.Fatalf("unexpected error creating router: %v", err)
+	}
+	return router
+}
+
+func TestNewRouterInvalidOptions(t *testing.T) {
+	configs, err := NewConfigStore(DefaultRegistryConfig())
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	if _, err := NewRouter(configs, RouterOptions{}); err == nil {
+		t.Fatal("expected error for zero value options but got none")
+	}
+	opts := DefaultRouterOptions()
+	opts.ManifestCache.TagTTL = -1
+	if _, err := NewRouter(configs, opts); err == nil {
+		t.Fatal("expected error for invalid manifest cache options but got none")
+	}
+	opts = DefaultRouterOptions()
+	opts.BlobDiskCache = BlobDiskCacheOptions{Dir: t.TempDir()}
+	if _, err := NewRouter(configs, opts); err == nil {
+		t.Fatal("expected error for invalid blob disk cache options but got none")
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// reRepository matches registry API requests for a repository and captures
+// the repository name, API and value, e.g. /v2/<name>/manifests/<reference>
+//
+// Blobs, manifests, tags and referrers are all under /v2/<name>/$api/$value
+// and <name> may contain / so we match the last such API path
+var reRepository = regexp.MustCompile("^/v2/(.+)/(blobs|manifests|tags|referrers)/([^/]+)$")
+
+// routingRule is a RoutingRuleConfig with the buckets it selects from resolved,
+// or the catch-all rule for the top level RegistryConfig
+type routingRule struct {
+	// name is empty for the catch-all rule
+	name                     string
+	prefix                   string
+	glob                     string
+	stripPrefix              bool
+	upstreamRegistryEndpoint string
+	upstreamRegistryPath     string
+	buckets                  *regionBuckets
+}
+
+// newRoutingRules returns the routing rules for rc in order,
+// ending with the catch-all rule which uses catchAllBuckets
+//
+// rc should already be validated, see RegistryConfig.Validate
+func newRoutingRules(rc RegistryConfig, catchAllBuckets *regionBuckets) []*routingRule {
+	nameToBucket := make(map[string]BucketConfig, len(rc.Buckets))
+	for _, bucket := range rc.Buckets {
+		nameToBucket[bucket.Name] = bucket
+	}
+	rules := make([]*routingRule, 0, len(rc.RoutingRules)+1)
+	for _, rule := range rc.RoutingRules {
+		// the rule selects from its buckets exactly like the top level config
+		ruleConfig := RegistryConfig{
+			RegionToBucket: rule.RegionToBucket,
+			DefaultBucket:  rule.DefaultBucket,
+			TrafficSplits:  rule.TrafficSplits,
+		}
+		for _, name := range rule.Buckets {
+			ruleConfig.Buckets = append(ruleConfig.Buckets, nameToBucket[name])
+		}
+		rules = append(rules, &routingRule{
+			name:                     rule.Name,
+			prefix:                   rule.Prefix,
+			glob:                     rule.Glob,
+			stripPrefix:              rule.StripPrefix,
+			upstreamRegistryEndpoint: rule.UpstreamRegistryEndpoint,
+			upstreamRegistryPath:     rule.UpstreamRegistryPath,
+			buckets:                  newRegionBuckets(ruleConfig),
+		})
+	}
+	return append(rules, &routingRule{
+		upstreamRegistryEndpoint: rc.UpstreamRegistryEndpoint,
+		upstreamRegistryPath:     rc.UpstreamRegistryPath,
+		buckets:                  catchAllBuckets,
+	})
+}
+
+// matches returns true if requests for repo should use this rule
+func (r *routingRule) matches(repo string) bool {
+	if r.prefix != "" {
+		return strings.HasPrefix(repo, r.prefix+"/")
+	}
+	// validation ensures the pattern is valid
+	matched, _ := path.Match(r.glob, repo)
+	return matched
+}
+
+// repository returns the name repo is redirected to upstream and in backends
+func (r *routingRule) repository(repo string) string {
+	if r.stripPrefix {
+		return strings.TrimPrefix(repo, r.prefix+"/")
+	}
+	return repo
+}
+
+// upstreamRedirectURL returns the upstream registry URL for the registry API
+// request at originalPath, which is for repo if repo is not empty
+func (r *routingRule) upstreamRedirectURL(originalPath, repo string) string {
+	p := strings.TrimPrefix(originalPath, "/v2")
+	if repo != "" {
+		p = "/" + r.repository(repo) + strings.TrimPrefix(p, "/"+repo)
+	}
+	return r.upstreamRegistryEndpoint + path.Join("/v2/", r.upstreamRegistryPath, p)
+}
+
+// routingRuleFor returns the first rule in rules matching the repository
+// originalPath is a request for, and the repository name if any
+//
+// rules must end with a catch-all rule, which is used for requests that
+// are not for a repository
+func routingRuleFor(rules []*routingRule, originalPath string) (rule *routingRule, repo string) {
+	catchAll := rules[len(rules)-1]
+	matches := reRepository.FindStringSubmatch(originalPath)
+	if matches == nil {
+		return catchAll, ""
+	}
+	repo = matches[1]
+	for _, rule := range rules[:len(rules)-1] {
+		if rule.matches(repo) {
+			return rule, repo
+		}
+	}
+	return catchAll, repo
+}
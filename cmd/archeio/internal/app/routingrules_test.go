@@ -0,0 +1,151 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func newRoutingRulesTestConfig() RegistryConfig {
+	rc := DefaultRegistryConfig()
+	rc.RoutingRules = []RoutingRuleConfig{
+		{
+			Name:                     "team",
+			Prefix:                   "team",
+			StripPrefix:              true,
+			UpstreamRegistryEndpoint: "https://team.example",
+			UpstreamRegistryPath:     "team-project/images",
+			Buckets:                  []string{"eu-west-1"},
+			DefaultBucket:            "eu-west-1",
+		},
+		{
+			Name:                     "tools",
+			Glob:                     "tools-*",
+			UpstreamRegistryEndpoint: "https://tools.example",
+		},
+		{
+			// shadowed by the team rule
+			Name:                     "team-shadowed",
+			Prefix:                   "team/app",
+			UpstreamRegistryEndpoint: "https://shadowed.example",
+		},
+	}
+	return rc
+}
+
+func TestRoutingRuleFor(t *testing.T) {
+	rc := newRoutingRulesTestConfig()
+	rules := newRoutingRules(rc, newRegionBuckets(rc))
+	testCases := []struct {
+		Path             string
+		ExpectedRule     string
+		ExpectedRepo     string
+		ExpectedRedirect string
+	}{
+		{
+			Path:             "/v2/team/app/manifests/latest",
+			ExpectedRule:     "team",
+			ExpectedRepo:     "team/app",
+			ExpectedRedirect: "https://team.example/v2/team-project/images/app/manifests/latest",
+		},
+		{
+			Path:             "/v2/team/sub/app/blobs/sha256:aaaa",
+			ExpectedRule:     "team",
+			ExpectedRepo:     "team/sub/app",
+			ExpectedRedirect: "https://team.example/v2/team-project/images/sub/app/blobs/sha256:aaaa",
+		},
+		{
+			// prefixes only match repositories under them
+			Path:             "/v2/team/manifests/latest",
+			ExpectedRule:     "",
+			ExpectedRepo:     "team",
+			ExpectedRedirect: "https://us-central1-docker.pkg.dev/v2/k8s-artifacts-prod/images/team/manifests/latest",
+		},
+		{
+			Path:             "/v2/teamapp/tags/list",
+			ExpectedRule:     "",
+			ExpectedRepo:     "teamapp",
+			ExpectedRedirect: "https://us-central1-docker.pkg.dev/v2/k8s-artifacts-prod/images/teamapp/tags/list",
+		},
+		{
+			Path:             "/v2/tools-kubectl/referrers/sha256:aaaa",
+			ExpectedRule:     "tools",
+			ExpectedRepo:     "tools-kubectl",
+			ExpectedRedirect: "https://tools.example/v2/tools-kubectl/referrers/sha256:aaaa",
+		},
+		{
+			// globs do not match across /
+			Path:             "/v2/tools-kubectl/sub/manifests/latest",
+			ExpectedRule:     "",
+			ExpectedRepo:     "tools-kubectl/sub",
+			ExpectedRedirect: "https://us-central1-docker.pkg.dev/v2/k8s-artifacts-prod/images/tools-kubectl/sub/manifests/latest",
+		},
+		{
+			// not a repository request
+			Path:             "/v2/tools-kubectl",
+			ExpectedRule:     "",
+			ExpectedRepo:     "",
+			ExpectedRedirect: "https://us-central1-docker.pkg.dev/v2/k8s-artifacts-prod/images/tools-kubectl",
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Path, func(t *testing.T) {
+			t.Parallel()
+			rule, repo := routingRuleFor(rules, tc.Path)
+			if rule.name != tc.ExpectedRule || repo != tc.ExpectedRepo {
+				t.Fatalf("expected rule %q and repository %q, got: %q and %q", tc.ExpectedRule, tc.ExpectedRepo, rule.name, repo)
+			}
+			if redirect := rule.upstreamRedirectURL(tc.Path, repo); redirect != tc.ExpectedRedirect {
+				t.Fatalf("expected redirect %q, got: %q", tc.ExpectedRedirect, redirect)
+			}
+		})
+	}
+}
+
+func TestNewRoutingRulesBuckets(t *testing.T) {
+	rc := newRoutingRulesTestConfig()
+	rc.Buckets = append(rc.Buckets, BucketConfig{Name: "canary", URL: "https://canary.example"})
+	rc.RoutingRules[0].Buckets = append(rc.RoutingRules[0].Buckets, "canary")
+	rc.RoutingRules[0].TrafficSplits = map[string][]WeightedBucketConfig{
+		"us-east-1": {{Bucket: "eu-west-1", Weight: 0}, {Bucket: "canary", Weight: 1}},
+	}
+	catchAll := newRegionBuckets(rc)
+	rules := newRoutingRules(rc, catchAll)
+	if len(rules) != 4 || rules[3].buckets != catchAll {
+		t.Fatalf("expected the routing rules followed by the catch-all rule, got: %+v", rules)
+	}
+	// the team rule only selects from its own buckets
+	if bucket := rules[0].buckets.ForRegion("us-east-1"); bucket == nil || bucket.Name() != "eu-west-1" {
+		t.Fatalf("expected the team rule's default bucket, got: %v", bucket)
+	}
+	if bucket := rules[1].buckets.ForRegion("us-east-1"); bucket != nil {
+		t.Fatalf("expected no bucket for the tools rule, got: %v", bucket.Name())
+	}
+	// and splits clients between them
+	clientIP := netip.MustParseAddr("192.0.2.1")
+	if candidates := rules[0].buckets.Candidates("us-east-1", clientIP); len(candidates) != 1 || candidates[0].Name() != "canary" {
+		t.Fatalf("expected the team rule's traffic split to pick canary, got: %v", candidates)
+	}
+	if split := rules[0].buckets.TrafficSplit("us-east-1"); split != "eu-west-1=0,canary=1" {
+		t.Fatalf("unexpected traffic split for the team rule: %q", split)
+	}
+	if split := catchAll.TrafficSplit("us-east-1"); split != "" {
+		t.Fatalf("expected no traffic split for the catch-all rule, got: %q", split)
+	}
+}
@@ -0,0 +1,347 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"golang.org/x/oauth2/google"
+)
+
+// urlSigner signs blob URLs for private buckets
+type urlSigner interface {
+	// sign returns rawURL signed for requests with method
+	sign(ctx context.Context, method, rawURL string) (string, error)
+}
+
+// loadRetryInterval is how long a failure to load signing credentials or keys
+// is returned for before loading them is tried again
+const loadRetryInterval = 10 * time.Second
+
+// cachedLoader caches the result of load once it succeeds
+//
+// Failures are not cached for good, so that a transient failure, such as the
+// metadata server not being reachable yet at startup, does not break signing
+// until the config is reloaded.
+type cachedLoader[T any] struct {
+	load func() (T, error)
+	// now is time.Now, except in tests
+	now func() time.Time
+
+	mu       sync.Mutex
+	value    T
+	loaded   bool
+	err      error
+	failedAt time.Time
+}
+
+func newCachedLoader[T any](load func() (T, error)) *cachedLoader[T] {
+	return &cachedLoader[T]{load: load, now: time.Now}
+}
+
+// get returns the loaded value, loading it if it has not been yet and
+// the last failure was at least loadRetryInterval ago
+func (l *cachedLoader[T]) get() (T, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.loaded {
+		return l.value, nil
+	}
+	if l.err != nil && l.now().Sub(l.failedAt) < loadRetryInterval {
+		return l.value, l.err
+	}
+	value, err := l.load()
+	if err != nil {
+		l.err, l.failedAt = err, l.now()
+		return l.value, err
+	}
+	l.value, l.loaded, l.err = value, true, nil
+	return value, nil
+}
+
+// newURLSigner returns the urlSigner for bucket, or nil if it is public
+//
+// bucket should already be validated, credentials are loaded when first signing.
+func newURLSigner(bucket BucketConfig) urlSigner {
+	if bucket.Signing == nil {
+		return nil
+	}
+	expiry, _ := bucket.Signing.expiry()
+	if bucket.Type == BackendGCS {
+		return &gcsSigner{
+			expiry:  expiry,
+			now:     time.Now,
+			account: newCachedLoader(loadGCSServiceAccount).get,
+		}
+	}
+	return &s3Signer{
+		region:      bucket.signingRegion(),
+		expiry:      expiry,
+		now:         time.Now,
+		credentials: newCachedLoader(loadAWSCredentials).get,
+		signer:      v4.NewSigner(),
+	}
+}
+
+// s3Signer presigns S3 URLs with SigV4
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+type s3Signer struct {
+	region string
+	expiry time.Duration
+	// now is time.Now, except in tests
+	now         func() time.Time
+	credentials func() (aws.CredentialsProvider, error)
+	signer      *v4.Signer
+}
+
+// loadAWSCredentials returns the AWS SDK default credential chain
+func loadAWSCredentials() (aws.CredentialsProvider, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return cfg.Credentials, nil
+}
+
+func (s *s3Signer) sign(ctx context.Context, method, rawURL string) (string, error) {
+	provider, err := s.credentials()
+	if err != nil {
+		return "", err
+	}
+	// the provider caches credentials until they expire
+	creds, err := provider.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+	// blob URLs always parse
+	req, _ := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	query := req.URL.Query()
+	query.Set("X-Amz-Expires", strconv.Itoa(int(s.expiry.Seconds())))
+	req.URL.RawQuery = query.Encode()
+	// signing with valid credentials cannot fail
+	signed, _, _ := s.signer.PresignHTTP(ctx, creds, req, "UNSIGNED-PAYLOAD", "s3", s.region, s.now())
+	return signed, nil
+}
+
+// gcsSigner signs GCS URLs with V4 signing and a service account key
+// https://cloud.google.com/storage/docs/access-control/signing-urls-manually
+type gcsSigner struct {
+	expiry time.Duration
+	// now is time.Now, except in tests
+	now     func() time.Time
+	account func() (*gcsServiceAccount, error)
+}
+
+// gcsServiceAccount is the identity GCS URLs are signed as
+type gcsServiceAccount struct {
+	email string
+	key   *rsa.PrivateKey
+}
+
+// loadGCSServiceAccount returns the service account key from the
+// Google Application Default Credentials
+func loadGCSServiceAccount() (*gcsServiceAccount, error) {
+	creds, err := google.FindDefaultCredentials(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to find Google credentials: %w", err)
+	}
+	// only service account keys are in JSON and can sign locally
+	cfg, err := google.JWTConfigFromJSON(creds.JSON)
+	if err != nil {
+		return nil, fmt.Errorf("google credentials are not a service account key: %w", err)
+	}
+	block, _ := pem.Decode(cfg.PrivateKey)
+	if block == nil {
+		return nil, errors.New("service account private key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse service account private key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account private key is not an RSA key")
+	}
+	return &gcsServiceAccount{email: cfg.Email, key: rsaKey}, nil
+}
+
+func (s *gcsSigner) sign(_ context.Context, method, rawURL string) (string, error) {
+	account, err := s.account()
+	if err != nil {
+		return "", err
+	}
+	// blob URLs always parse
+	u, _ := url.Parse(rawURL)
+	now := s.now().UTC()
+	datestamp := now.Format("20060102")
+	timestamp := now.Format("20060102T150405Z")
+	scope := datestamp + "/auto/storage/goog4_request"
+	query := u.Query()
+	query.Set("X-Goog-Algorithm", "GOOG4-RSA-SHA256")
+	query.Set("X-Goog-Credential", account.email+"/"+scope)
+	query.Set("X-Goog-Date", timestamp)
+	query.Set("X-Goog-Expires", strconv.Itoa(int(s.expiry.Seconds())))
+	query.Set("X-Goog-SignedHeaders", "host")
+	canonicalPath := gcsEscapePath(u.Path)
+	canonicalQuery := gcsCanonicalQuery(query)
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalPath,
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"GOOG4-RSA-SHA256", timestamp, scope, hex.EncodeToString(requestHash[:])}, "\n")
+	digest := sha256.Sum256([]byte(stringToSign))
+	// signing with a parsed RSA key cannot fail
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, account.key, crypto.SHA256, digest[:])
+	return u.Scheme + "://" + u.Host + canonicalPath + "?" + canonicalQuery + "&X-Goog-Signature=" + hex.EncodeToString(signature), nil
+}
+
+// gcsEscapePath percent-encodes p for V4 signing,
+// everything but unreserved characters and / is encoded
+func gcsEscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '/' || c == '-' || c == '.' || c == '_' || c == '~' ||
+			('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// gcsCanonicalQuery returns query sorted and encoded for V4 signing
+func gcsCanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, gcsEscapePath(key)+"="+strings.ReplaceAll(gcsEscapePath(value), "/", "%2F"))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// newCDNSigner returns the urlSigner for CDN redirects with c, or nil if c is nil
+//
+// c should already be validated, the key is loaded when first signing,
+// newRoutingConfig checks that it loads.
+func newCDNSigner(c *CDNSigningConfig) urlSigner {
+	if c == nil {
+		return nil
+	}
+	expiry, _ := parseSigningExpiry(c.Expiry)
+	return &cloudFrontSigner{
+		keyPairID: c.KeyPairID,
+		expiry:    expiry,
+		now:       time.Now,
+		key: newCachedLoader(func() (*rsa.PrivateKey, error) {
+			return loadRSAPrivateKey(c.PrivateKeyFile)
+		}).get,
+	}
+}
+
+// cloudFrontSigner signs CDN URLs with a CloudFront canned policy,
+// the method is not part of the signature
+type cloudFrontSigner struct {
+	keyPairID string
+	expiry    time.Duration
+	// now is time.Now, except in tests
+	now func() time.Time
+	key func() (*rsa.PrivateKey, error)
+}
+
+// cloudFrontEncoding is base64 with the characters CloudFront does not
+// allow in query parameters replaced
+var cloudFrontEncoding = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+
+func (s *cloudFrontSigner) sign(_ context.Context, _, rawURL string) (string, error) {
+	key, err := s.key()
+	if err != nil {
+		return "", err
+	}
+	expires := strconv.FormatInt(s.now().Add(s.expiry).Unix(), 10)
+	policy := `{"Statement":[{"Resource":"` + rawURL + `","Condition":{"DateLessThan":{"AWS:EpochTime":` + expires + `}}}]}`
+	// CloudFront canned policies are signed with SHA1
+	// nolint:gosec
+	digest := sha1.Sum([]byte(policy))
+	// signing with a parsed RSA key cannot fail
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, digest[:])
+	separator := "?"
+	if strings.Contains(rawURL, "?") {
+		separator = "&"
+	}
+	return rawURL + separator + "Expires=" + expires +
+		"&Signature=" + cloudFrontEncoding.Replace(base64.StdEncoding.EncodeToString(signature)) +
+		"&Key-Pair-Id=" + s.keyPairID, nil
+}
+
+// loadRSAPrivateKey loads a PEM encoded PKCS #1 or PKCS #8 RSA private key from path
+func loadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("private key %q is not PEM encoded", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %q: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key %q is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
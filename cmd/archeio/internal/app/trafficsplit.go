@@ -0,0 +1,100 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// trafficSplit selects between weighted buckets for each client,
+// see RegistryConfig.TrafficSplits
+type trafficSplit struct {
+	buckets []weightedBackend
+	// weights is the split for logs, e.g. "a=90,b=10"
+	weights string
+}
+
+type weightedBackend struct {
+	backend Backend
+	weight  int
+}
+
+// newTrafficSplit resolves the bucket names in split, which should already be validated
+func newTrafficSplit(split []WeightedBucketConfig, nameToBackend map[string]Backend) *trafficSplit {
+	t := &trafficSplit{weights: formatTrafficSplit(split)}
+	for _, b := range split {
+		t.buckets = append(t.buckets, weightedBackend{backend: nameToBackend[b.Bucket], weight: b.Weight})
+	}
+	return t
+}
+
+// formatTrafficSplit returns the weights in split for logs
+func formatTrafficSplit(split []WeightedBucketConfig) string {
+	weights := make([]string, 0, len(split))
+	for _, b := range split {
+		weights = append(weights, b.Bucket+"="+strconv.Itoa(b.Weight))
+	}
+	return strings.Join(weights, ",")
+}
+
+// pick returns the bucket for clientIP
+//
+// This is weighted rendezvous hashing, so each client sticks to one bucket
+// and changing a bucket's weight only moves clients to or from that bucket.
+func (t *trafficSplit) pick(clientIP netip.Addr) Backend {
+	var picked Backend
+	best := 0.0
+	for _, b := range t.buckets {
+		if b.weight == 0 {
+			continue
+		}
+		h := sha256.Sum256([]byte(clientIP.String() + "/" + b.backend.Name()))
+		// a uniform float in (0, 1) from 53 bits of the hash
+		u := (float64(binary.BigEndian.Uint64(h[:8])>>11) + 0.5) / (1 << 53)
+		if score := float64(b.weight) / -math.Log(u); score > best {
+			best, picked = score, b.backend
+		}
+	}
+	return picked
+}
+
+// recordTrafficSplits publishes the weights in rc's splits to metrics and logs,
+// replacing those of the previous config
+//
+// the catch-all rule's splits have an empty rule name
+func recordTrafficSplits(rc RegistryConfig) {
+	trafficSplitWeight.Reset()
+	record := func(rule string, splits map[string][]WeightedBucketConfig) {
+		for region, split := range splits {
+			for _, b := range split {
+				trafficSplitWeight.WithLabelValues(rule, region, b.Bucket).Set(float64(b.Weight))
+			}
+			klog.InfoS("traffic split", "rule", rule, "region", region, "weights", formatTrafficSplit(split))
+		}
+	}
+	record("", rc.TrafficSplits)
+	for _, rule := range rc.RoutingRules {
+		record(rule.Name, rule.TrafficSplits)
+	}
+}
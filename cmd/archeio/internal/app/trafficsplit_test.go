@@ -0,0 +1,199 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"math"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testClientIPs returns n distinct client IPs
+func testClientIPs(n int) []netip.Addr {
+	ips := make([]netip.Addr, 0, n)
+	ip := netip.MustParseAddr("10.0.0.0")
+	for i := 0; i < n; i++ {
+		ip = ip.Next()
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func TestTrafficSplitPick(t *testing.T) {
+	t.Parallel()
+	backends := map[string]Backend{
+		"old": &objectBackend{name: "old"},
+		"new": &objectBackend{name: "new"},
+	}
+	clientIPs := testClientIPs(10000)
+	testCases := []struct {
+		Name  string
+		Split []WeightedBucketConfig
+		// ExpectedNew is the expected share of clients picking "new"
+		ExpectedNew float64
+	}{
+		{
+			Name:        "no canary",
+			Split:       []WeightedBucketConfig{{Bucket: "old", Weight: 1}, {Bucket: "new", Weight: 0}},
+			ExpectedNew: 0,
+		},
+		{
+			Name:        "1%",
+			Split:       []WeightedBucketConfig{{Bucket: "old", Weight: 99}, {Bucket: "new", Weight: 1}},
+			ExpectedNew: 0.01,
+		},
+		{
+			Name:        "10%",
+			Split:       []WeightedBucketConfig{{Bucket: "old", Weight: 9}, {Bucket: "new", Weight: 1}},
+			ExpectedNew: 0.1,
+		},
+		{
+			Name:        "half",
+			Split:       []WeightedBucketConfig{{Bucket: "old", Weight: 50}, {Bucket: "new", Weight: 50}},
+			ExpectedNew: 0.5,
+		},
+		{
+			Name:        "complete",
+			Split:       []WeightedBucketConfig{{Bucket: "old", Weight: 0}, {Bucket: "new", Weight: 1}},
+			ExpectedNew: 1,
+		},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			split := newTrafficSplit(tc.Split, backends)
+			picked := 0
+			for _, ip := range clientIPs {
+				bucket := split.pick(ip)
+				if bucket.Name() == "new" {
+					picked++
+				}
+				// clients stick to one bucket
+				if again := split.pick(ip); again != bucket {
+					t.Fatalf("expected %v to pick %q again, got: %q", ip, bucket.Name(), again.Name())
+				}
+			}
+			if share := float64(picked) / float64(len(clientIPs)); math.Abs(share-tc.ExpectedNew) > 0.01 {
+				t.Errorf("expected share %v of clients to pick new, got: %v", tc.ExpectedNew, share)
+			}
+		})
+	}
+}
+
+func TestTrafficSplitShiftsOnlyToCanary(t *testing.T) {
+	t.Parallel()
+	backends := map[string]Backend{
+		"old":    &objectBackend{name: "old"},
+		"new":    &objectBackend{name: "new"},
+		"stable": &objectBackend{name: "stable"},
+	}
+	clientIPs := testClientIPs(1000)
+	previous := newTrafficSplit([]WeightedBucketConfig{{Bucket: "old", Weight: 50}, {Bucket: "stable", Weight: 50}, {Bucket: "new", Weight: 1}}, backends)
+	next := newTrafficSplit([]WeightedBucketConfig{{Bucket: "old", Weight: 50}, {Bucket: "stable", Weight: 50}, {Bucket: "new", Weight: 10}}, backends)
+	for _, ip := range clientIPs {
+		before, after := previous.pick(ip).Name(), next.pick(ip).Name()
+		// raising the canary weight only moves clients to the canary
+		if before != after && after != "new" {
+			t.Errorf("expected %v to stay on %q or move to new, got: %q", ip, before, after)
+		}
+	}
+}
+
+func TestRegionBucketsTrafficSplit(t *testing.T) {
+	t.Parallel()
+	rc := DefaultRegistryConfig()
+	rc.Buckets = []BucketConfig{
+		{Name: "old", URL: "https://old.example"},
+		{Name: "new", URL: "https://new.example", Fallbacks: []string{"old"}},
+	}
+	rc.RegionToBucket = map[string]string{"us-east-1": "old", "us-east-2": "old"}
+	rc.DefaultBucket = "old"
+	rc.TrafficSplits = map[string][]WeightedBucketConfig{
+		"us-east-1": {{Bucket: "old", Weight: 0}, {Bucket: "new", Weight: 100}},
+	}
+	buckets := newRegionBuckets(rc)
+	clientIP := netip.MustParseAddr("192.0.2.1")
+	names := func(candidates []Backend) []string {
+		r := []string{}
+		for _, bucket := range candidates {
+			r = append(r, bucket.Name())
+		}
+		return r
+	}
+	// the split overrides RegionToBucket and keeps the picked bucket's fallbacks
+	if c := names(buckets.Candidates("us-east-1", clientIP)); !slices.Equal(c, []string{"new", "old"}) {
+		t.Errorf("unexpected candidates for us-east-1: %v", c)
+	}
+	if s := buckets.TrafficSplit("us-east-1"); s != "old=0,new=100" {
+		t.Errorf("unexpected traffic split for us-east-1: %q", s)
+	}
+	if c := names(buckets.Candidates("us-east-2", clientIP)); !slices.Equal(c, []string{"old"}) {
+		t.Errorf("unexpected candidates for us-east-2: %v", c)
+	}
+	if s := buckets.TrafficSplit("us-east-2"); s != "" {
+		t.Errorf("expected no traffic split for us-east-2, got: %q", s)
+	}
+}
+
+func TestRecordTrafficSplits(t *testing.T) {
+	// not parallel, this checks global metrics
+	rc := DefaultRegistryConfig()
+	rc.Buckets = append(rc.Buckets, BucketConfig{Name: "canary", URL: "https://canary.example"})
+	rc.TrafficSplits = map[string][]WeightedBucketConfig{
+		"us-west-2": {{Bucket: "us-west-2", Weight: 99}, {Bucket: "canary", Weight: 1}},
+	}
+	rc.RoutingRules = []RoutingRuleConfig{{
+		Name:                     "team",
+		Prefix:                   "team",
+		UpstreamRegistryEndpoint: "https://team.example",
+		Buckets:                  []string{"canary"},
+		TrafficSplits: map[string][]WeightedBucketConfig{
+			"us-west-2": {{Bucket: "canary", Weight: 5}},
+		},
+	}}
+	configs, err := NewConfigStore(rc)
+	if err != nil {
+		t.Fatalf("unexpected error creating config store: %v", err)
+	}
+	if w := testutil.ToFloat64(trafficSplitWeight.WithLabelValues("", "us-west-2", "canary")); w != 1 {
+		t.Errorf("expected canary weight 1, got: %v", w)
+	}
+	// routing rules' splits are reported separately
+	if w := testutil.ToFloat64(trafficSplitWeight.WithLabelValues("team", "us-west-2", "canary")); w != 5 {
+		t.Errorf("expected team rule canary weight 5, got: %v", w)
+	}
+	rc.TrafficSplits["us-west-2"] = []WeightedBucketConfig{{Bucket: "us-west-2", Weight: 90}, {Bucket: "canary", Weight: 10}}
+	if err := configs.Update(rc); err != nil {
+		t.Fatalf("unexpected error updating config: %v", err)
+	}
+	if w := testutil.ToFloat64(trafficSplitWeight.WithLabelValues("", "us-west-2", "canary")); w != 10 {
+		t.Errorf("expected canary weight 10 after update, got: %v", w)
+	}
+	// removed splits are no longer reported
+	rc.TrafficSplits = nil
+	rc.RoutingRules = nil
+	if err := configs.Update(rc); err != nil {
+		t.Fatalf("unexpected error updating config: %v", err)
+	}
+	if n := testutil.CollectAndCount(trafficSplitWeight); n != 0 {
+		t.Errorf("expected no traffic split weights, got: %d", n)
+	}
+}
@@ -18,16 +18,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"k8s.io/klog/v2"
 
 	"k8s.io/registry.k8s.io/cmd/archeio/internal/app"
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs"
 )
 
 func main() {
@@ -36,28 +41,105 @@ func main() {
 	flag.Parse()
 	defer klog.Flush()
 
+	// subcommands, the default is to serve
+	if flag.Arg(0) == "explain" {
+		if err := explain(flag.Args()[1:]); err != nil {
+			klog.Fatal(err)
+		}
+		return
+	}
+
 	// cloud run expects us to listen to HTTP on $PORT
 	// https://cloud.google.com/run/docs/container-contract#port
 	port := getEnv("PORT", "8080")
 
-	// make it possible to override k8s.gcr.io without rebuilding in the future
-	registryConfig := app.RegistryConfig{
-		UpstreamRegistryEndpoint: getEnv("UPSTREAM_REGISTRY_ENDPOINT", "https://us-central1-docker.pkg.dev"),
-		UpstreamRegistryPath:     getEnv("UPSTREAM_REGISTRY_PATH", "k8s-artifacts-prod/images"),
-		InfoURL:                  "https://github.com/kubernetes/registry.k8s.io",
-		PrivacyURL:               "https://www.linuxfoundation.org/privacy-policy/",
-		DefaultAWSBaseURL:        getEnv("DEFAULT_AWS_BASE_URL", "https://prod-registry-k8s-io-us-east-1.s3.dualstack.us-east-1.amazonaws.com"),
+	registryConfig, err := loadRegistryConfig()
+	if err != nil {
+		klog.Fatalf("Failed to load configuration: %v", err)
+	}
+	configStore, err := app.NewConfigStore(registryConfig)
+	if err != nil {
+		klog.Fatalf("Invalid configuration: %v", err)
+	}
+	routerOptions, err := loadRouterOptions()
+	if err != nil {
+		klog.Fatalf("Invalid options: %v", err)
 	}
+	router, err := app.NewRouter(configStore, routerOptions)
+	if err != nil {
+		klog.Fatalf("Invalid options: %v", err)
+	}
+
+	// reload configuration on SIGHUP or when $CONFIG_FILE changes
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	configWatcher := &app.ConfigWatcher{
+		Store:        configStore,
+		Load:         loadRegistryConfig,
+		Path:         os.Getenv("CONFIG_FILE"),
+		PollInterval: 10 * time.Second,
+		Signals:      reload,
+	}
+	go configWatcher.Run(watchCtx)
+
+	// optional access log, independent of klog verbosity
+	handlerOptions := app.HandlerOptions{}
+	switch accessLog := os.Getenv("ACCESS_LOG"); accessLog {
+	case "":
+	case "stdout":
+		handlerOptions.AccessLog = app.NewAccessLogger(os.Stdout)
+	case "stderr":
+		handlerOptions.AccessLog = app.NewAccessLogger(os.Stderr)
+	default:
+		f, err := os.OpenFile(accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			klog.Fatalf("Failed to open access log: %v", err)
+		}
+		defer f.Close()
+		handlerOptions.AccessLog = app.NewAccessLogger(f)
+	}
+
+	// keep blob inventories configured for buckets up to date
+	inventoryInterval, err := time.ParseDuration(getEnv("BLOB_INVENTORY_REFRESH", "1h"))
+	if err != nil || inventoryInterval <= 0 {
+		klog.Fatalf("Invalid BLOB_INVENTORY_REFRESH: %q", os.Getenv("BLOB_INVENTORY_REFRESH"))
+	}
+	go router.RunInventory(watchCtx, inventoryInterval)
+
+	// keep cloud IP ranges loaded from files up to date, if any
+	ipRangesInterval, err := time.ParseDuration(getEnv("IP_RANGES_REFRESH", "1h"))
+	if err != nil || ipRangesInterval <= 0 {
+		klog.Fatalf("Invalid IP_RANGES_REFRESH: %q", os.Getenv("IP_RANGES_REFRESH"))
+	}
+	go router.RunIPRanges(watchCtx, ipRangesInterval)
+
+	// probe backends for readiness
+	health := app.NewHealth(configStore)
+	go health.Run(watchCtx, 30*time.Second)
+	handlerOptions.Health = health
 
 	// configure server with reasonable timeout
-	// we only serve redirects, 10s should be sufficient
+	// registry requests have no body, so 10s to read them is plenty
+	// there is deliberately no write timeout, with the blob disk cache enabled
+	// we serve blobs that may take clients far longer than that to download
 	server := &http.Server{
 		Addr:              ":" + port,
-		Handler:           app.MakeHandler(registryConfig),
+		Handler:           app.MakeHandler(router, handlerOptions),
 		ReadTimeout:       10 * time.Second,
 		ReadHeaderTimeout: 2 * time.Second,
 	}
 
+	// optionally serve admin endpoints (metrics etc.) on a separate port
+	// that should not be exposed publicly
+	adminPort := os.Getenv("ADMIN_PORT")
+	adminServer := &http.Server{
+		Addr:              ":" + adminPort,
+		Handler:           app.MakeAdminHandler(router),
+		ReadHeaderTimeout: 2 * time.Second,
+	}
+
 	// signal handler for graceful shutdown
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
@@ -69,15 +151,181 @@ func main() {
 		}
 	}()
 	klog.InfoS("listening", "port", port)
-	klog.InfoS("registry", "configuration", registryConfig)
+	if adminPort != "" {
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				klog.Fatal(err)
+			}
+		}()
+		klog.InfoS("admin listening", "port", adminPort)
+	}
+	klog.InfoS("registry", "configuration", registryConfig, "hash", configStore.Hash())
 
 	// Graceful shutdown
 	<-done
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// fail readiness first, optionally waiting for load balancers to notice
+	health.SetShuttingDown()
+	shutdownDelay, err := time.ParseDuration(getEnv("SHUTDOWN_DELAY", "0s"))
+	if err != nil {
+		klog.Fatalf("Invalid SHUTDOWN_DELAY: %v", err)
+	}
+	// in-flight requests are only redirects unless blobs are served by archeio
+	defaultShutdownTimeout := "5s"
+	if routerOptions.BlobDiskCache.Dir != "" {
+		defaultShutdownTimeout = "5m"
+	}
+	shutdownTimeout, err := time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", defaultShutdownTimeout))
+	if err != nil {
+		klog.Fatalf("Invalid SHUTDOWN_TIMEOUT: %v", err)
+	}
+	klog.InfoS("shutting down", "delay", shutdownDelay, "timeout", shutdownTimeout)
+	time.Sleep(shutdownDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 	if err := server.Shutdown(ctx); err != nil {
 		klog.Fatalf("Server didn't exit gracefully %v", err)
 	}
+	// blob downloads may outlive the requests for them
+	router.Shutdown(ctx)
+	if err := adminServer.Shutdown(ctx); err != nil {
+		klog.Fatalf("Admin server didn't exit gracefully %v", err)
+	}
+}
+
+// loadRegistryConfig loads $CONFIG_FILE or else the built-in default config,
+// applying the legacy environment variable overrides on top
+func loadRegistryConfig() (app.RegistryConfig, error) {
+	registryConfig := app.DefaultRegistryConfig()
+	if configFile := os.Getenv("CONFIG_FILE"); configFile != "" {
+		rc, err := app.LoadRegistryConfig(configFile)
+		if err != nil {
+			return app.RegistryConfig{}, err
+		}
+		registryConfig = rc
+	}
+	// make it possible to override k8s.gcr.io without rebuilding in the future
+	registryConfig.UpstreamRegistryEndpoint = getEnv("UPSTREAM_REGISTRY_ENDPOINT", registryConfig.UpstreamRegistryEndpoint)
+	registryConfig.UpstreamRegistryPath = getEnv("UPSTREAM_REGISTRY_PATH", registryConfig.UpstreamRegistryPath)
+	if defaultURL, ok := os.LookupEnv("DEFAULT_AWS_BASE_URL"); ok {
+		registryConfig.SetDefaultBucketURL(defaultURL)
+	}
+	return registryConfig, registryConfig.Validate()
+}
+
+// loadRouterOptions returns the default router options with environment
+// variable overrides applied
+func loadRouterOptions() (app.RouterOptions, error) {
+	opts := app.DefaultRouterOptions()
+	var errs []error
+	if v, ok := os.LookupEnv("BLOB_CACHE_SIZE"); ok {
+		size, err := strconv.Atoi(v)
+		errs = append(errs, err)
+		opts.BlobCache.MaxEntries = size
+	}
+	if v, ok := os.LookupEnv("BLOB_CACHE_TTL"); ok {
+		ttl, err := time.ParseDuration(v)
+		errs = append(errs, err)
+		opts.BlobCache.PositiveTTL = ttl
+	}
+	if v, ok := os.LookupEnv("BLOB_CACHE_NEGATIVE_TTL"); ok {
+		ttl, err := time.ParseDuration(v)
+		errs = append(errs, err)
+		opts.BlobCache.NegativeTTL = ttl
+	}
+	if v, ok := os.LookupEnv("BLOB_HEADS_PER_BUCKET"); ok {
+		heads, err := strconv.Atoi(v)
+		errs = append(errs, err)
+		opts.MaxBlobHeadsPerBucket = heads
+	}
+	if v, ok := os.LookupEnv("BLOB_BREAKER_FAILURES"); ok {
+		failures, err := strconv.Atoi(v)
+		errs = append(errs, err)
+		opts.CircuitBreaker.Failures = failures
+	}
+	if v, ok := os.LookupEnv("BLOB_BREAKER_COOLDOWN"); ok {
+		cooldown, err := time.ParseDuration(v)
+		errs = append(errs, err)
+		opts.CircuitBreaker.Cooldown = cooldown
+	}
+	if v, ok := os.LookupEnv("MANIFEST_CACHE"); ok {
+		enabled, err := strconv.ParseBool(v)
+		errs = append(errs, err)
+		opts.ManifestCache.Enabled = enabled
+	}
+	opts.ManifestCache.Dir = os.Getenv("MANIFEST_CACHE_DIR")
+	if v, ok := os.LookupEnv("MANIFEST_CACHE_TAG_TTL"); ok {
+		ttl, err := time.ParseDuration(v)
+		errs = append(errs, err)
+		opts.ManifestCache.TagTTL = ttl
+	}
+	if v, ok := os.LookupEnv("MANIFEST_CACHE_MAX_TAGS"); ok {
+		maxTags, err := strconv.Atoi(v)
+		errs = append(errs, err)
+		opts.ManifestCache.MaxTags = maxTags
+	}
+	opts.BlobDiskCache.Dir = os.Getenv("BLOB_DISK_CACHE_DIR")
+	if v, ok := os.LookupEnv("BLOB_DISK_CACHE_MAX_BYTES"); ok {
+		maxBytes, err := strconv.ParseInt(v, 10, 64)
+		errs = append(errs, err)
+		opts.BlobDiskCache.MaxBytes = maxBytes
+	}
+	ipRangeFiles := map[string]string{}
+	for cloud, env := range map[string]string{
+		cloudcidrs.AWS:   "IP_RANGES_AWS_FILE",
+		cloudcidrs.GCP:   "IP_RANGES_GCP_FILE",
+		cloudcidrs.Azure: "IP_RANGES_AZURE_FILE",
+	} {
+		if file := os.Getenv(env); file != "" {
+			ipRangeFiles[cloud] = file
+		}
+	}
+	opts.IPRangeFiles = ipRangeFiles
+	return opts, errors.Join(errs...)
+}
+
+// explain implements `archeio explain`, which prints how a request would be
+// routed with the same configuration as serving, see docs/admin.md
+func explain(args []string) error {
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	ip := flags.String("ip", "", "client IP address to explain the request for")
+	path := flags.String("path", "/v2/", "registry API request path to explain")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	registryConfig, err := loadRegistryConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	configStore, err := app.NewConfigStore(registryConfig)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	routerOptions, err := loadRouterOptions()
+	if err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+	// a server may be using the caches on disk, which opening them would
+	// interfere with, manifests are explained without reading the cache anyway
+	routerOptions.ManifestCache.Dir = ""
+	routerOptions.BlobDiskCache.Dir = ""
+	router, err := app.NewRouter(configStore, routerOptions)
+	if err != nil {
+		return fmt.Errorf("invalid options: %w", err)
+	}
+	// load IP ranges from files once, RunIPRanges returns after the initial
+	// load when the context is already done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	router.RunIPRanges(ctx, time.Hour)
+	// and blob inventories, so blobs are explained as when serving
+	router.LoadInventory(context.Background())
+	explanation, err := router.Explain(*ip, *path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(explanation)
 }
 
 // getEnv returns defaultValue if key is not set, else the value of os.LookupEnv(key)
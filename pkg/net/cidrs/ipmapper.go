@@ -25,3 +25,9 @@ import "net/netip"
 type IPMapper[V comparable] interface {
 	GetIP(ip netip.Addr) (value V, matches bool)
 }
+
+// PrefixMapper is an IPMapper that can also return the matching netip.Prefix
+type PrefixMapper[V comparable] interface {
+	IPMapper[V]
+	GetIPPrefix(ip netip.Addr) (value V, prefix netip.Prefix, matches bool)
+}
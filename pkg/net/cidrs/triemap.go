@@ -91,6 +91,15 @@ func (t *TrieMap[V]) GetIP(ip netip.Addr) (value V, contains bool) {
 	return
 }
 
+// GetIPPrefix is like GetIP, but also returns the matching cidr if any
+func (t *TrieMap[V]) GetIPPrefix(ip netip.Addr) (value V, prefix netip.Prefix, contains bool) {
+	v := t.trieMap.getIPValue(ip)
+	if v == nil {
+		return
+	}
+	return t.keyToValue[v.key], v.cidr, true
+}
+
 // trieMap is the core implementation, but it only stores netip.Prefix : int
 type trieMap struct {
 	// surely ipv4 and ipv6 will be enough in our lifetime?
@@ -196,20 +205,29 @@ func (t *trieMap) insertIPV6(cidr netip.Prefix, key int) {
 }
 
 func (t *trieMap) GetIP(ip netip.Addr) (int, bool) {
+	v := t.getIPValue(ip)
+	if v == nil {
+		return -1, false
+	}
+	return v.key, true
+}
+
+// getIPValue returns the matching nodeValue for ip, or nil if there is none
+func (t *trieMap) getIPValue(ip netip.Addr) *nodeValue {
 	if ip.Is4() {
 		return t.getIPv4(ip)
 	}
 	return t.getIPv6(ip)
 }
 
-func (t *trieMap) getIPv4(addr netip.Addr) (int, bool) {
+func (t *trieMap) getIPv4(addr netip.Addr) *nodeValue {
 	// check the root first
 	curr := t.ipv4Root
 	if curr == nil {
-		return -1, false
+		return nil
 	}
 	if curr.value != nil && curr.value.cidr.Contains(addr) {
-		return curr.value.key, true
+		return curr.value
 	}
 	// walk IP bits high to low, checking if current node matches
 	ip := addr.As4()
@@ -235,20 +253,20 @@ func (t *trieMap) getIPv4(addr netip.Addr) (int, bool) {
 		}
 		// check for a match in the current node
 		if curr.value != nil && curr.value.cidr.Contains(addr) {
-			return curr.value.key, true
+			return curr.value
 		}
 	}
-	return -1, false
+	return nil
 }
 
-func (t *trieMap) getIPv6(addr netip.Addr) (int, bool) {
+func (t *trieMap) getIPv6(addr netip.Addr) *nodeValue {
 	// check the root first
 	curr := t.ipv6Root
 	if curr == nil {
-		return -1, false
+		return nil
 	}
 	if curr.value != nil && curr.value.cidr.Contains(addr) {
-		return curr.value.key, true
+		return curr.value
 	}
 	// walk IP bits high to low, checking if current node matches
 	// first cast ip to two uint64 for fast bit access
@@ -283,8 +301,8 @@ func (t *trieMap) getIPv6(addr netip.Addr) (int, bool) {
 		}
 		// check for a match in the current node
 		if curr.value != nil && curr.value.cidr.Contains(addr) {
-			return curr.value.key, true
+			return curr.value
 		}
 	}
-	return -1, false
+	return nil
 }
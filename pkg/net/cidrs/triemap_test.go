@@ -46,6 +46,47 @@ func TestTrieMap(t *testing.T) {
 	}
 }
 
+func TestTrieMapGetIPPrefix(t *testing.T) {
+	trieMap := NewTrieMap[string]()
+	for value, cidrs := range testCIDRS {
+		for _, cidr := range cidrs {
+			trieMap.Insert(cidr, value)
+		}
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Addr.String(), func(t *testing.T) {
+			t.Parallel()
+			// NOTE: we set region == "" for no-contains
+			expectedContains := tc.ExpectedRegion != ""
+			ip := tc.Addr
+			region, prefix, contains := trieMap.GetIPPrefix(ip)
+			if contains != expectedContains || region != tc.ExpectedRegion {
+				t.Fatalf(
+					"result does not match for %v, got: (%q, %t) expected: (%q, %t)",
+					ip, region, contains, tc.ExpectedRegion, expectedContains,
+				)
+			}
+			if !contains {
+				if prefix.IsValid() {
+					t.Fatalf("expected no prefix for %v, got: %v", ip, prefix)
+				}
+				return
+			}
+			// the prefix must be one of those inserted for the region
+			found := false
+			for _, cidr := range testCIDRS[region] {
+				if cidr == prefix {
+					found = true
+				}
+			}
+			if !found || !prefix.Contains(ip) {
+				t.Fatalf("unexpected prefix %v for %v in region %q", prefix, ip, region)
+			}
+		})
+	}
+}
+
 func TestTrieMapEmpty(t *testing.T) {
 	trieMap := NewTrieMap[string]()
 	v, contains := trieMap.GetIP(netip.MustParseAddr("127.0.0.1"))
@@ -56,6 +97,10 @@ func TestTrieMapEmpty(t *testing.T) {
 	if contains || v != "" {
 		t.Fatalf("empty TrieMap should not contain anything")
 	}
+	v, prefix, contains := trieMap.GetIPPrefix(netip.MustParseAddr("::1"))
+	if contains || v != "" || prefix.IsValid() {
+		t.Fatalf("empty TrieMap should not contain anything")
+	}
 }
 
 func TestTrieMapSlashZero(t *testing.T) {
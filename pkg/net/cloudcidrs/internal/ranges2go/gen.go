@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"io"
 	"sort"
+
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs/internal/rangesjson"
 )
 
 const fileHeader = `/*
@@ -48,7 +50,7 @@ import (
 
 `
 
-func generateRangesGo(w io.Writer, cloudToRTP map[string]regionsToPrefixes) error {
+func generateRangesGo(w io.Writer, cloudToRTP map[string]rangesjson.RegionsToPrefixes) error {
 	// generate source file header
 	if _, err := io.WriteString(w, fileHeader); err != nil {
 		return err
@@ -88,7 +90,7 @@ var regionToRanges = map[IPInfo][]netip.Prefix{
 	return nil
 }
 
-func genCloud(w io.Writer, cloud string, rtp regionsToPrefixes) error {
+func genCloud(w io.Writer, cloud string, rtp rangesjson.RegionsToPrefixes) error {
 	// ensure iteration order is predictable for reproducible codegen
 	regions := make([]string, 0, len(rtp))
 	for region := range rtp {
@@ -19,6 +19,8 @@ package main
 import (
 	"bytes"
 	"testing"
+
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs/internal/rangesjson"
 )
 
 func TestGenerateRangesGo(t *testing.T) {
@@ -80,7 +82,7 @@ func TestGenerateRangesGo(t *testing.T) {
   ]
 }
 `
-	awsRTP, err := parseAWS(rawAWSData)
+	awsRTP, err := rangesjson.ParseAWS(rawAWSData)
 	if err != nil {
 		t.Fatalf("unexpected error parsing test data: %v", err)
 	}
@@ -114,7 +116,35 @@ func TestGenerateRangesGo(t *testing.T) {
   }]
 }
 `
-	gcpRTP, err := parseGCP(rawGCPData)
+	gcpRTP, err := rangesjson.ParseGCP(rawGCPData)
+	if err != nil {
+		t.Fatalf("unexpected error parsing test data: %v", err)
+	}
+	const rawAzureData = `{
+  "changeNumber": 312,
+  "cloud": "Public",
+  "values": [
+    {
+      "name": "AzureCloud.westeurope",
+      "id": "AzureCloud.westeurope",
+      "properties": {
+        "changeNumber": 89,
+        "region": "westeurope",
+        "regionId": 18,
+        "platform": "Azure",
+        "systemService": "",
+        "addressPrefixes": [
+          "13.69.0.0/17",
+          "20.50.0.0/18",
+          "2603:1020:200::/46"
+        ],
+        "networkFeatures": null
+      }
+    }
+  ]
+}
+`
+	azureRTP, err := rangesjson.ParseAzure(rawAzureData)
 	if err != nil {
 		t.Fatalf("unexpected error parsing test data: %v", err)
 	}
@@ -147,6 +177,9 @@ import (
 // AWS cloud
 const AWS = "AWS"
 
+// Azure cloud
+const Azure = "Azure"
+
 // GCP cloud
 const GCP = "GCP"
 
@@ -164,6 +197,10 @@ var regionToRanges = map[IPInfo][]netip.Prefix{
 		netip.PrefixFrom(netip.AddrFrom4([4]byte{52, 95, 174, 0}), 24),
 		netip.PrefixFrom(netip.AddrFrom4([4]byte{69, 107, 7, 136}), 29),
 	},
+	{Cloud: Azure, Region: "westeurope"}: {
+		netip.PrefixFrom(netip.AddrFrom4([4]byte{20, 50, 0, 0}), 18),
+		netip.PrefixFrom(netip.AddrFrom16([16]byte{38, 3, 16, 32, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}), 46),
+	},
 	{Cloud: GCP, Region: "asia-east1"}: {
 		netip.PrefixFrom(netip.AddrFrom16([16]byte{38, 0, 25, 0, 64, 48, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}), 44),
 		netip.PrefixFrom(netip.AddrFrom4([4]byte{34, 137, 0, 0}), 16),
@@ -176,9 +213,10 @@ var regionToRanges = map[IPInfo][]netip.Prefix{
 }
 `
 
-	cloudToRTP := map[string]regionsToPrefixes{
-		"AWS": awsRTP,
-		"GCP": gcpRTP,
+	cloudToRTP := map[string]rangesjson.RegionsToPrefixes{
+		"AWS":   awsRTP,
+		"Azure": azureRTP,
+		"GCP":   gcpRTP,
 	}
 	// generate and compare
 	w := &bytes.Buffer{}
@@ -14,13 +14,15 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-// ranges2go generates a go source file with pre-parsed AWS IP ranges data.
+// ranges2go generates a go source file with pre-parsed AWS, GCP and Azure IP ranges data.
 // See also genrawdata.sh for downloading the raw data to this binary.
 package main
 
 import (
 	"os"
 	"path/filepath"
+
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs/internal/rangesjson"
 )
 
 func main() {
@@ -36,13 +38,19 @@ func main() {
 	// read in data
 	awsRaw := mustReadFile(filepath.Join(dataDir, "aws-ip-ranges.json"))
 	gcpRaw := mustReadFile(filepath.Join(dataDir, "gcp-cloud.json"))
+	azureRaw := mustReadFile(filepath.Join(dataDir, "azure-service-tags.json"))
 	// parse raw AWS IP range data
-	awsRTP, err := parseAWS(awsRaw)
+	awsRTP, err := rangesjson.ParseAWS(awsRaw)
 	if err != nil {
 		panic(err)
 	}
 	// parse GCP IP range data
-	gcpRTP, err := parseGCP(gcpRaw)
+	gcpRTP, err := rangesjson.ParseGCP(gcpRaw)
+	if err != nil {
+		panic(err)
+	}
+	// parse Azure Service Tags data
+	azureRTP, err := rangesjson.ParseAzure(azureRaw)
 	if err != nil {
 		panic(err)
 	}
@@ -51,9 +59,10 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	cloudToRTP := map[string]regionsToPrefixes{
-		"AWS": awsRTP,
-		"GCP": gcpRTP,
+	cloudToRTP := map[string]rangesjson.RegionsToPrefixes{
+		"AWS":   awsRTP,
+		"Azure": azureRTP,
+		"GCP":   gcpRTP,
 	}
 	if err := generateRangesGo(f, cloudToRTP); err != nil {
 		panic(err)
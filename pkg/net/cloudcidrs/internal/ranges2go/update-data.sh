@@ -22,3 +22,9 @@ cd "$(dirname "${BASH_SOURCE[0]}")"
 # fetch data for each supported cloud
 curl -Lo 'data/aws-ip-ranges.json' 'https://ip-ranges.amazonaws.com/ip-ranges.json'
 curl -Lo 'data/gcp-cloud.json' 'https://www.gstatic.com/ipranges/cloud.json'
+# Azure publishes Service Tags weekly under a new dated URL, linked from the download page
+# https://www.microsoft.com/en-us/download/details.aspx?id=56519
+azure_url="$(curl -sL 'https://www.microsoft.com/en-us/download/details.aspx?id=56519' \
+  | grep -o 'https://download.microsoft.com/download/[^"]*/ServiceTags_Public_[0-9]*.json' \
+  | head -n1)"
+curl -Lo 'data/azure-service-tags.json' "${azure_url}"
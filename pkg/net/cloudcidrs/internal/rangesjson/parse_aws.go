@@ -14,7 +14,7 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package rangesjson
 
 import (
 	"encoding/json"
@@ -22,9 +22,9 @@ import (
 	"sort"
 )
 
-// parseAWS parses raw AWS IP ranges JSON data
-// and processes it to a regionsToPrefixes map
-func parseAWS(raw string) (regionsToPrefixes, error) {
+// ParseAWS parses raw AWS IP ranges JSON data
+// and processes it to a RegionsToPrefixes map
+func ParseAWS(raw string) (RegionsToPrefixes, error) {
 	parsed, err := parseAWSIPRangesJSON([]byte(raw))
 	if err != nil {
 		return nil, err
@@ -67,10 +67,10 @@ func parseAWSIPRangesJSON(rawJSON []byte) (*AWSIPRangesJSON, error) {
 	return r, nil
 }
 
-// awsRegionsToPrefixesFromData processes the raw unmarshalled JSON into regionsToPrefixes map
-func awsRegionsToPrefixesFromData(data *AWSIPRangesJSON) (regionsToPrefixes, error) {
+// awsRegionsToPrefixesFromData processes the raw unmarshalled JSON into RegionsToPrefixes map
+func awsRegionsToPrefixesFromData(data *AWSIPRangesJSON) (RegionsToPrefixes, error) {
 	// convert from AWS published structure to a map by region, parse Prefixes
-	rtp := regionsToPrefixes{}
+	rtp := RegionsToPrefixes{}
 	for _, prefix := range data.Prefixes {
 		region := prefix.Region
 		ipPrefix, err := netip.ParsePrefix(prefix.IPPrefix)
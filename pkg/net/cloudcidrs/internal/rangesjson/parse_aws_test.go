@@ -14,7 +14,7 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package rangesjson
 
 import (
 	"reflect"
@@ -124,7 +124,7 @@ func TestParseAWS(t *testing.T) {
 	t.Run("unparsable data", func(t *testing.T) {
 		t.Parallel()
 		badJSON := `{"prefixes":false}`
-		_, err := parseAWS(badJSON)
+		_, err := ParseAWS(badJSON)
 		if err == nil {
 			t.Fatal("expected error parsing bogus raw JSON but got none")
 		}
@@ -0,0 +1,101 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rangesjson
+
+import (
+	"encoding/json"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// ParseAzure parses raw Azure Service Tags JSON data
+// and processes it to a RegionsToPrefixes map
+func ParseAzure(raw string) (RegionsToPrefixes, error) {
+	parsed, err := parseAzureServiceTagsJSON([]byte(raw))
+	if err != nil {
+		return nil, err
+	}
+	return azureRegionsToPrefixesFromData(parsed)
+}
+
+/*
+	For more on these datatypes see:
+	https://learn.microsoft.com/en-us/azure/virtual-network/service-tags-overview#discover-service-tags-by-using-downloadable-json-files
+*/
+
+type AzureServiceTagsJSON struct {
+	Values []AzureServiceTag `json:"values"`
+	// changeNumber and cloud omitted
+}
+
+type AzureServiceTag struct {
+	Name       string                    `json:"name"`
+	Properties AzureServiceTagProperties `json:"properties"`
+	// id omitted
+}
+
+type AzureServiceTagProperties struct {
+	Region          string   `json:"region"`
+	AddressPrefixes []string `json:"addressPrefixes"`
+	// changeNumber, regionId, platform, systemService and networkFeatures omitted
+}
+
+// azureCloudTagPrefix prefixes the tags with all of the IP ranges in each region,
+// the other regional tags are subsets of these for specific services
+const azureCloudTagPrefix = "AzureCloud."
+
+// parseAzureServiceTagsJSON parses Azure Service Tags JSON data
+func parseAzureServiceTagsJSON(rawJSON []byte) (*AzureServiceTagsJSON, error) {
+	r := &AzureServiceTagsJSON{}
+	if err := json.Unmarshal(rawJSON, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// azureRegionsToPrefixesFromData processes the raw unmarshalled JSON into RegionsToPrefixes map
+func azureRegionsToPrefixesFromData(data *AzureServiceTagsJSON) (RegionsToPrefixes, error) {
+	// convert from Azure published structure to a map by region, parse Prefixes
+	rtp := RegionsToPrefixes{}
+	for _, tag := range data.Values {
+		// global tags have no region
+		region := tag.Properties.Region
+		if region == "" || !strings.HasPrefix(tag.Name, azureCloudTagPrefix) {
+			continue
+		}
+		for _, prefix := range tag.Properties.AddressPrefixes {
+			ipPrefix, err := netip.ParsePrefix(prefix)
+			if err != nil {
+				return nil, err
+			}
+			rtp[region] = append(rtp[region], ipPrefix)
+		}
+	}
+
+	// flatten
+	for region := range rtp {
+		// this approach allows us to produce consistent generated results
+		// since the ip ranges will be ordered
+		sort.Slice(rtp[region], func(i, j int) bool {
+			return rtp[region][i].String() < rtp[region][j].String()
+		})
+		rtp[region] = dedupeSortedPrefixes(rtp[region])
+	}
+
+	return rtp, nil
+}
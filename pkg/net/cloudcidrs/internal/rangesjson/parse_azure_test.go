@@ -0,0 +1,158 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rangesjson
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestAzureParseServiceTagsJSON(t *testing.T) {
+	// parse a snapshot of a valid subsest of data
+	const testData = `{
+  "changeNumber": 312,
+  "cloud": "Public",
+  "values": [
+    {
+      "name": "AzureCloud.westeurope",
+      "id": "AzureCloud.westeurope",
+      "properties": {
+        "changeNumber": 89,
+        "region": "westeurope",
+        "regionId": 18,
+        "platform": "Azure",
+        "systemService": "",
+        "addressPrefixes": [
+          "13.69.0.0/17",
+          "2603:1020:200::/46"
+        ],
+        "networkFeatures": [
+          "API",
+          "NSG",
+          "UDR",
+          "FW"
+        ]
+      }
+    }
+  ]
+}`
+	expectedParsed := &AzureServiceTagsJSON{
+		Values: []AzureServiceTag{
+			{
+				Name: "AzureCloud.westeurope",
+				Properties: AzureServiceTagProperties{
+					Region: "westeurope",
+					AddressPrefixes: []string{
+						"13.69.0.0/17",
+						"2603:1020:200::/46",
+					},
+				},
+			},
+		},
+	}
+	parsed, err := parseAzureServiceTagsJSON([]byte(testData))
+	if err != nil {
+		t.Fatalf("unexpected error parsing testdata: %v", err)
+	}
+	if !reflect.DeepEqual(expectedParsed, parsed) {
+		t.Error("parsed did not match expected:")
+		t.Errorf("%#v", expectedParsed)
+		t.Error("parsed: ")
+		t.Errorf("%#v", parsed)
+		t.Fail()
+	}
+
+	// parse some bogus data
+	_, err = parseAzureServiceTagsJSON([]byte(`{"values": false}`))
+	if err == nil {
+		t.Fatal("expected error parsing garbage data but got none")
+	}
+}
+
+func TestAzureRegionsToPrefixesFromData(t *testing.T) {
+	t.Run("bad prefixes", func(t *testing.T) {
+		t.Parallel()
+		badPrefixes := &AzureServiceTagsJSON{
+			Values: []AzureServiceTag{
+				{
+					Name: "AzureCloud.eastus",
+					Properties: AzureServiceTagProperties{
+						Region:          "eastus",
+						AddressPrefixes: []string{"asdf;asdf,"},
+					},
+				},
+			},
+		}
+		_, err := azureRegionsToPrefixesFromData(badPrefixes)
+		if err == nil {
+			t.Fatal("expected error parsing bogus prefix but got none")
+		}
+	})
+	t.Run("only regional AzureCloud tags", func(t *testing.T) {
+		t.Parallel()
+		data := &AzureServiceTagsJSON{
+			Values: []AzureServiceTag{
+				{
+					// global tag
+					Name: "AzureCloud",
+					Properties: AzureServiceTagProperties{
+						AddressPrefixes: []string{"13.64.0.0/16", "13.69.0.0/17"},
+					},
+				},
+				{
+					// service tag, a subset of the region's AzureCloud tag
+					Name: "Storage.eastus",
+					Properties: AzureServiceTagProperties{
+						Region:          "eastus",
+						AddressPrefixes: []string{"not even parsed"},
+					},
+				},
+				{
+					Name: "AzureCloud.eastus",
+					Properties: AzureServiceTagProperties{
+						Region:          "eastus",
+						AddressPrefixes: []string{"20.42.0.0/17", "13.64.0.0/16"},
+					},
+				},
+			},
+		}
+		rtp, err := azureRegionsToPrefixesFromData(data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(rtp) != 1 || len(rtp["eastus"]) == 0 {
+			t.Fatalf("expected only eastus prefixes, got: %v", rtp)
+		}
+		for _, prefix := range rtp["eastus"] {
+			if prefix != netip.MustParsePrefix("20.42.0.0/17") && prefix != netip.MustParsePrefix("13.64.0.0/16") {
+				t.Fatalf("unexpected eastus prefix: %v", prefix)
+			}
+		}
+	})
+}
+
+func TestParseAzure(t *testing.T) {
+	t.Run("unparsable data", func(t *testing.T) {
+		t.Parallel()
+		badJSON := `{"values":false}`
+		_, err := ParseAzure(badJSON)
+		if err == nil {
+			t.Fatal("expected error parsing bogus raw JSON but got none")
+		}
+	})
+}
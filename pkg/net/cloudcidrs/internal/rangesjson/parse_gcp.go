@@ -14,7 +14,7 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package rangesjson
 
 import (
 	"encoding/json"
@@ -23,9 +23,9 @@ import (
 	"sort"
 )
 
-// parseGCP parses raw GCP cloud.json data
-// and processes it to a regionsToPrefixes map
-func parseGCP(raw string) (regionsToPrefixes, error) {
+// ParseGCP parses raw GCP cloud.json data
+// and processes it to a RegionsToPrefixes map
+func ParseGCP(raw string) (RegionsToPrefixes, error) {
 	parsed, err := parseGCPCloudJSON([]byte(raw))
 	if err != nil {
 		return nil, err
@@ -54,10 +54,10 @@ func parseGCPCloudJSON(rawJSON []byte) (*GCPCloudJSON, error) {
 	return r, nil
 }
 
-// gcpRegionsToPrefixesFromData processes the raw unmarshalled JSON into regionsToPrefixes map
-func gcpRegionsToPrefixesFromData(data *GCPCloudJSON) (regionsToPrefixes, error) {
+// gcpRegionsToPrefixesFromData processes the raw unmarshalled JSON into RegionsToPrefixes map
+func gcpRegionsToPrefixesFromData(data *GCPCloudJSON) (RegionsToPrefixes, error) {
 	// convert from AWS published structure to a map by region, parse Prefixes
-	rtp := regionsToPrefixes{}
+	rtp := RegionsToPrefixes{}
 	for _, prefix := range data.Prefixes {
 		region := prefix.Scope
 		if prefix.IPv4Prefix != "" {
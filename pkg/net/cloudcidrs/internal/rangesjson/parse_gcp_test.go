@@ -14,7 +14,7 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package rangesjson
 
 import (
 	"reflect"
@@ -123,7 +123,7 @@ func TestParseGCP(t *testing.T) {
 	t.Run("unparsable data", func(t *testing.T) {
 		t.Parallel()
 		badJSON := `{"prefixes":false}`
-		_, err := parseGCP(badJSON)
+		_, err := ParseGCP(badJSON)
 		if err == nil {
 			t.Fatal("expected error parsing bogus raw JSON but got none")
 		}
@@ -14,11 +14,11 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package main
+package rangesjson
 
 import (
 	"net/netip"
 )
 
-// regionToPrefixes is the structure we process the JSON into
-type regionsToPrefixes map[string][]netip.Prefix
+// RegionsToPrefixes is the structure we process the JSON into
+type RegionsToPrefixes map[string][]netip.Prefix
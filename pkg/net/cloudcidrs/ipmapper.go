@@ -16,11 +16,19 @@ limitations under the License.
 
 package cloudcidrs
 
-import "k8s.io/registry.k8s.io/pkg/net/cidrs"
+import (
+	"net/netip"
 
-// NewIPMapper returns cidrs.IPMapper populated with cloud region info
-// for the clouds we have resources for, currently GCP and AWS
-func NewIPMapper() cidrs.IPMapper[IPInfo] {
+	"k8s.io/registry.k8s.io/pkg/net/cidrs"
+)
+
+// NewIPMapper returns cidrs.PrefixMapper populated with cloud region info
+// for the clouds we know the IP ranges of, currently AWS, GCP and Azure
+func NewIPMapper() cidrs.PrefixMapper[IPInfo] {
+	return newIPMapper(regionToRanges)
+}
+
+func newIPMapper(regionToRanges map[IPInfo][]netip.Prefix) cidrs.PrefixMapper[IPInfo] {
 	t := cidrs.NewTrieMap[IPInfo]()
 	for info, cidrs := range regionToRanges {
 		for _, cidr := range cidrs {
@@ -67,6 +67,26 @@ func TestNewIPMapper(t *testing.T) {
 	}
 }
 
+func TestNewIPMapperAzure(t *testing.T) {
+	azureRanges := map[IPInfo][]netip.Prefix{}
+	for info, prefixes := range regionToRanges {
+		if info.Cloud == Azure {
+			azureRanges[info] = prefixes
+		}
+	}
+	if len(azureRanges) == 0 {
+		t.Skip("no Azure ranges are generated, run internal/ranges2go/update-data.sh and run.sh")
+	}
+	// the first address of each region's ranges is mapped to Azure
+	mapper := NewIPMapper()
+	for info, prefixes := range azureRanges {
+		addr := prefixes[0].Addr()
+		if r, matched := mapper.GetIP(addr); !matched || r.Cloud != Azure {
+			t.Errorf("expected %v from %v to be mapped to Azure, got: (%v, %t)", addr, info, r, matched)
+		}
+	}
+}
+
 /*  for benchmarking memory / init time */
 
 func BenchmarkNewIPMapper(b *testing.B) {
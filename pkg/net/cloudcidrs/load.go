@@ -0,0 +1,69 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudcidrs
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+
+	"k8s.io/registry.k8s.io/pkg/net/cidrs"
+	"k8s.io/registry.k8s.io/pkg/net/cloudcidrs/internal/rangesjson"
+)
+
+// dataParsers parses the raw IP ranges data published by each cloud,
+// the same data ranges2go generates regionToRanges from
+var dataParsers = map[string]func(raw string) (rangesjson.RegionsToPrefixes, error){
+	// https://ip-ranges.amazonaws.com/ip-ranges.json
+	AWS: rangesjson.ParseAWS,
+	// https://www.gstatic.com/ipranges/cloud.json
+	GCP: rangesjson.ParseGCP,
+	// https://www.microsoft.com/en-us/download/details.aspx?id=56519
+	Azure: rangesjson.ParseAzure,
+}
+
+// LoadIPMapper returns cidrs.PrefixMapper populated like NewIPMapper, except
+// that the ranges for each cloud in files are loaded from the raw data the
+// cloud publishes at that file path, instead of the compiled in data
+//
+// Supported clouds are AWS, GCP and Azure.
+func LoadIPMapper(files map[string]string) (cidrs.PrefixMapper[IPInfo], error) {
+	ranges := make(map[IPInfo][]netip.Prefix, len(regionToRanges))
+	for info, prefixes := range regionToRanges {
+		if _, replaced := files[info.Cloud]; !replaced {
+			ranges[info] = prefixes
+		}
+	}
+	for cloud, file := range files {
+		parse, ok := dataParsers[cloud]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cloud %q", cloud)
+		}
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		rtp, err := parse(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s IP ranges from %q: %w", cloud, file, err)
+		}
+		for region, prefixes := range rtp {
+			ranges[IPInfo{Cloud: cloud, Region: region}] = prefixes
+		}
+	}
+	return newIPMapper(ranges), nil
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudcidrs
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadIPMapperGeneratedData(t *testing.T) {
+	// the data we generate from should load to the same results
+	mapper, err := LoadIPMapper(map[string]string{
+		AWS:   "./internal/ranges2go/data/aws-ip-ranges.json",
+		GCP:   "./internal/ranges2go/data/gcp-cloud.json",
+		Azure: "./internal/ranges2go/data/azure-service-tags.json",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error loading data: %v", err)
+	}
+	for i := range allTestCases {
+		tc := allTestCases[i]
+		r, matched := mapper.GetIP(tc.Addr)
+		if matched != (tc.ExpectedRegion != "") || r.Region != tc.ExpectedRegion {
+			t.Errorf("result does not match for %v, got: (%q, %t) expected: %q", tc.Addr, r.Region, matched, tc.ExpectedRegion)
+		}
+	}
+}
+
+func TestLoadIPMapper(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatalf("failed to write test data: %v", err)
+		}
+		return path
+	}
+	awsFile := writeFile("aws.json", `{"prefixes": [{"ip_prefix": "192.0.2.0/24", "region": "test-1"}]}`)
+	badFile := writeFile("bad.json", `{"prefixes": [{"ip_prefix": "not a prefix", "region": "test-1"}]}`)
+
+	mapper, err := LoadIPMapper(map[string]string{AWS: awsFile})
+	if err != nil {
+		t.Fatalf("unexpected error loading data: %v", err)
+	}
+	// from the file
+	if r, matched := mapper.GetIP(netip.MustParseAddr("192.0.2.1")); !matched || r != (IPInfo{Cloud: AWS, Region: "test-1"}) {
+		t.Errorf("expected loaded AWS range to match, got: (%+v, %t)", r, matched)
+	}
+	// the compiled in AWS data is replaced
+	if r, matched := mapper.GetIP(netip.MustParseAddr("35.180.1.1")); matched {
+		t.Errorf("expected compiled in AWS ranges to be replaced, got: %+v", r)
+	}
+	// the compiled in data is still used for clouds without a file
+	gcpMapper, err := LoadIPMapper(map[string]string{GCP: writeFile("gcp.json", `{"prefixes": []}`)})
+	if err != nil {
+		t.Fatalf("unexpected error loading data: %v", err)
+	}
+	if r, matched := gcpMapper.GetIP(netip.MustParseAddr("35.180.1.1")); !matched || r.Region != "eu-west-3" {
+		t.Errorf("expected compiled in AWS ranges without an AWS file, got: (%+v, %t)", r, matched)
+	}
+
+	errorCases := []struct {
+		Name  string
+		Files map[string]string
+	}{
+		{Name: "unsupported cloud", Files: map[string]string{"Oracle": awsFile}},
+		{Name: "missing file", Files: map[string]string{AWS: filepath.Join(dir, "missing.json")}},
+		{Name: "unparsable data", Files: map[string]string{AWS: badFile}},
+	}
+	for i := range errorCases {
+		tc := errorCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := LoadIPMapper(tc.Files); err == nil {
+				t.Fatal("expected error but got none")
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudcidrs
+
+import "math"
+
+// Continents used in RegionInfo
+const (
+	Africa       = "Africa"
+	Asia         = "Asia"
+	Europe       = "Europe"
+	NorthAmerica = "North America"
+	Oceania      = "Oceania"
+	SouthAmerica = "South America"
+)
+
+// RegionInfo is geographic metadata for a cloud region
+//
+// Latitude and Longitude are approximate, typically the city the cloud
+// provider names for the region, which is good enough to find nearby regions.
+type RegionInfo struct {
+	Continent string
+	Latitude  float64
+	Longitude float64
+}
+
+// GetRegionInfo returns the RegionInfo for a cloud region, and false if there
+// is none, such as for the global meta regions
+func GetRegionInfo(info IPInfo) (RegionInfo, bool) {
+	r, ok := regionInfos[info]
+	return r, ok
+}
+
+// earthRadiusKm is the mean radius of the earth
+const earthRadiusKm = 6371
+
+// DistanceKm returns the approximate great-circle distance to o in kilometers
+func (r RegionInfo) DistanceKm(o RegionInfo) float64 {
+	lat1, lat2 := r.Latitude*math.Pi/180, o.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (o.Longitude - r.Longitude) * math.Pi / 180
+	// haversine formula
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// regionInfos is maintained by hand, unlike the generated IP range data,
+// since the cloud providers do not publish it in their IP range data
+//
+// when regenerating the IP range data adds a new region, add it here
+var regionInfos = map[IPInfo]RegionInfo{
+	// https://docs.aws.amazon.com/global-infrastructure/latest/regions/aws-regions.html
+	{Cloud: AWS, Region: "af-south-1"}:     {Continent: Africa, Latitude: -33.92, Longitude: 18.42},        // Cape Town
+	{Cloud: AWS, Region: "ap-east-1"}:      {Continent: Asia, Latitude: 22.32, Longitude: 114.17},          // Hong Kong
+	{Cloud: AWS, Region: "ap-northeast-1"}: {Continent: Asia, Latitude: 35.68, Longitude: 139.69},          // Tokyo
+	{Cloud: AWS, Region: "ap-northeast-2"}: {Continent: Asia, Latitude: 37.57, Longitude: 126.98},          // Seoul
+	{Cloud: AWS, Region: "ap-northeast-3"}: {Continent: Asia, Latitude: 34.69, Longitude: 135.50},          // Osaka
+	{Cloud: AWS, Region: "ap-south-1"}:     {Continent: Asia, Latitude: 19.08, Longitude: 72.88},           // Mumbai
+	{Cloud: AWS, Region: "ap-south-2"}:     {Continent: Asia, Latitude: 17.39, Longitude: 78.49},           // Hyderabad
+	{Cloud: AWS, Region: "ap-southeast-1"}: {Continent: Asia, Latitude: 1.35, Longitude: 103.82},           // Singapore
+	{Cloud: AWS, Region: "ap-southeast-2"}: {Continent: Oceania, Latitude: -33.87, Longitude: 151.21},      // Sydney
+	{Cloud: AWS, Region: "ap-southeast-3"}: {Continent: Asia, Latitude: -6.21, Longitude: 106.85},          // Jakarta
+	{Cloud: AWS, Region: "ap-southeast-4"}: {Continent: Oceania, Latitude: -37.81, Longitude: 144.96},      // Melbourne
+	{Cloud: AWS, Region: "ap-southeast-5"}: {Continent: Asia, Latitude: 3.14, Longitude: 101.69},           // Malaysia
+	{Cloud: AWS, Region: "ap-southeast-6"}: {Continent: Oceania, Latitude: -36.85, Longitude: 174.76},      // New Zealand
+	{Cloud: AWS, Region: "ca-central-1"}:   {Continent: NorthAmerica, Latitude: 45.50, Longitude: -73.57},  // Montreal
+	{Cloud: AWS, Region: "ca-west-1"}:      {Continent: NorthAmerica, Latitude: 51.05, Longitude: -114.07}, // Calgary
+	{Cloud: AWS, Region: "cn-north-1"}:     {Continent: Asia, Latitude: 39.90, Longitude: 116.41},          // Beijing
+	{Cloud: AWS, Region: "cn-northwest-1"}: {Continent: Asia, Latitude: 37.51, Longitude: 105.19},          // Ningxia
+	{Cloud: AWS, Region: "eu-central-1"}:   {Continent: Europe, Latitude: 50.11, Longitude: 8.68},          // Frankfurt
+	{Cloud: AWS, Region: "eu-central-2"}:   {Continent: Europe, Latitude: 47.38, Longitude: 8.54},          // Zurich
+	{Cloud: AWS, Region: "eu-north-1"}:     {Continent: Europe, Latitude: 59.33, Longitude: 18.07},         // Stockholm
+	{Cloud: AWS, Region: "eu-south-1"}:     {Continent: Europe, Latitude: 45.46, Longitude: 9.19},          // Milan
+	{Cloud: AWS, Region: "eu-south-2"}:     {Continent: Europe, Latitude: 41.65, Longitude: -0.88},         // Spain
+	{Cloud: AWS, Region: "eu-west-1"}:      {Continent: Europe, Latitude: 53.35, Longitude: -6.26},         // Ireland
+	{Cloud: AWS, Region: "eu-west-2"}:      {Continent: Europe, Latitude: 51.51, Longitude: -0.13},         // London
+	{Cloud: AWS, Region: "eu-west-3"}:      {Continent: Europe, Latitude: 48.86, Longitude: 2.35},          // Paris
+	{Cloud: AWS, Region: "eusc-de-east-1"}: {Continent: Europe, Latitude: 52.39, Longitude: 13.07},         // Brandenburg
+	{Cloud: AWS, Region: "il-central-1"}:   {Continent: Asia, Latitude: 32.09, Longitude: 34.78},           // Tel Aviv
+	{Cloud: AWS, Region: "me-central-1"}:   {Continent: Asia, Latitude: 25.20, Longitude: 55.27},           // UAE
+	{Cloud: AWS, Region: "me-south-1"}:     {Continent: Asia, Latitude: 26.23, Longitude: 50.59},           // Bahrain
+	{Cloud: AWS, Region: "sa-east-1"}:      {Continent: SouthAmerica, Latitude: -23.55, Longitude: -46.63}, // Sao Paulo
+	{Cloud: AWS, Region: "us-east-1"}:      {Continent: NorthAmerica, Latitude: 39.04, Longitude: -77.49},  // N. Virginia
+	{Cloud: AWS, Region: "us-east-2"}:      {Continent: NorthAmerica, Latitude: 39.96, Longitude: -83.00},  // Ohio
+	{Cloud: AWS, Region: "us-gov-east-1"}:  {Continent: NorthAmerica, Latitude: 39.96, Longitude: -83.00},  // Ohio
+	{Cloud: AWS, Region: "us-gov-west-1"}:  {Continent: NorthAmerica, Latitude: 45.84, Longitude: -119.70}, // Oregon
+	{Cloud: AWS, Region: "us-west-1"}:      {Continent: NorthAmerica, Latitude: 37.77, Longitude: -122.42}, // N. California
+	{Cloud: AWS, Region: "us-west-2"}:      {Continent: NorthAmerica, Latitude: 45.84, Longitude: -119.70}, // Oregon
+
+	// https://cloud.google.com/compute/docs/regions-zones
+	{Cloud: GCP, Region: "africa-south1"}:           {Continent: Africa, Latitude: -26.20, Longitude: 28.05},        // Johannesburg
+	{Cloud: GCP, Region: "asia-east1"}:              {Continent: Asia, Latitude: 24.05, Longitude: 120.52},          // Taiwan
+	{Cloud: GCP, Region: "asia-east2"}:              {Continent: Asia, Latitude: 22.32, Longitude: 114.17},          // Hong Kong
+	{Cloud: GCP, Region: "asia-northeast1"}:         {Continent: Asia, Latitude: 35.68, Longitude: 139.69},          // Tokyo
+	{Cloud: GCP, Region: "asia-northeast2"}:         {Continent: Asia, Latitude: 34.69, Longitude: 135.50},          // Osaka
+	{Cloud: GCP, Region: "asia-northeast3"}:         {Continent: Asia, Latitude: 37.57, Longitude: 126.98},          // Seoul
+	{Cloud: GCP, Region: "asia-south1"}:             {Continent: Asia, Latitude: 19.08, Longitude: 72.88},           // Mumbai
+	{Cloud: GCP, Region: "asia-south2"}:             {Continent: Asia, Latitude: 28.61, Longitude: 77.21},           // Delhi
+	{Cloud: GCP, Region: "asia-southeast1"}:         {Continent: Asia, Latitude: 1.35, Longitude: 103.82},           // Singapore
+	{Cloud: GCP, Region: "asia-southeast2"}:         {Continent: Asia, Latitude: -6.21, Longitude: 106.85},          // Jakarta
+	{Cloud: GCP, Region: "australia-southeast1"}:    {Continent: Oceania, Latitude: -33.87, Longitude: 151.21},      // Sydney
+	{Cloud: GCP, Region: "australia-southeast2"}:    {Continent: Oceania, Latitude: -37.81, Longitude: 144.96},      // Melbourne
+	{Cloud: GCP, Region: "europe-central2"}:         {Continent: Europe, Latitude: 52.23, Longitude: 21.01},         // Warsaw
+	{Cloud: GCP, Region: "europe-north1"}:           {Continent: Europe, Latitude: 60.57, Longitude: 27.20},         // Finland
+	{Cloud: GCP, Region: "europe-southwest1"}:       {Continent: Europe, Latitude: 40.42, Longitude: -3.70},         // Madrid
+	{Cloud: GCP, Region: "europe-west1"}:            {Continent: Europe, Latitude: 50.45, Longitude: 3.82},          // Belgium
+	{Cloud: GCP, Region: "europe-west10"}:           {Continent: Europe, Latitude: 52.52, Longitude: 13.40},         // Berlin
+	{Cloud: GCP, Region: "europe-west12"}:           {Continent: Europe, Latitude: 45.07, Longitude: 7.69},          // Turin
+	{Cloud: GCP, Region: "europe-west2"}:            {Continent: Europe, Latitude: 51.51, Longitude: -0.13},         // London
+	{Cloud: GCP, Region: "europe-west3"}:            {Continent: Europe, Latitude: 50.11, Longitude: 8.68},          // Frankfurt
+	{Cloud: GCP, Region: "europe-west4"}:            {Continent: Europe, Latitude: 53.44, Longitude: 6.83},          // Netherlands
+	{Cloud: GCP, Region: "europe-west6"}:            {Continent: Europe, Latitude: 47.38, Longitude: 8.54},          // Zurich
+	{Cloud: GCP, Region: "europe-west8"}:            {Continent: Europe, Latitude: 45.46, Longitude: 9.19},          // Milan
+	{Cloud: GCP, Region: "europe-west9"}:            {Continent: Europe, Latitude: 48.86, Longitude: 2.35},          // Paris
+	{Cloud: GCP, Region: "me-central1"}:             {Continent: Asia, Latitude: 25.29, Longitude: 51.53},           // Doha
+	{Cloud: GCP, Region: "me-central2"}:             {Continent: Asia, Latitude: 26.43, Longitude: 50.10},           // Dammam
+	{Cloud: GCP, Region: "me-west1"}:                {Continent: Asia, Latitude: 32.09, Longitude: 34.78},           // Tel Aviv
+	{Cloud: GCP, Region: "northamerica-northeast1"}: {Continent: NorthAmerica, Latitude: 45.50, Longitude: -73.57},  // Montreal
+	{Cloud: GCP, Region: "northamerica-northeast2"}: {Continent: NorthAmerica, Latitude: 43.65, Longitude: -79.38},  // Toronto
+	{Cloud: GCP, Region: "southamerica-east1"}:      {Continent: SouthAmerica, Latitude: -23.55, Longitude: -46.63}, // Sao Paulo
+	{Cloud: GCP, Region: "southamerica-west1"}:      {Continent: SouthAmerica, Latitude: -33.45, Longitude: -70.67}, // Santiago
+	{Cloud: GCP, Region: "us-central1"}:             {Continent: NorthAmerica, Latitude: 41.26, Longitude: -95.86},  // Iowa
+	{Cloud: GCP, Region: "us-central2"}:             {Continent: NorthAmerica, Latitude: 36.31, Longitude: -95.32},  // Oklahoma
+	{Cloud: GCP, Region: "us-east1"}:                {Continent: NorthAmerica, Latitude: 33.20, Longitude: -80.01},  // South Carolina
+	{Cloud: GCP, Region: "us-east4"}:                {Continent: NorthAmerica, Latitude: 39.04, Longitude: -77.49},  // N. Virginia
+	{Cloud: GCP, Region: "us-east5"}:                {Continent: NorthAmerica, Latitude: 39.96, Longitude: -83.00},  // Columbus
+	{Cloud: GCP, Region: "us-south1"}:               {Continent: NorthAmerica, Latitude: 32.78, Longitude: -96.80},  // Dallas
+	{Cloud: GCP, Region: "us-west1"}:                {Continent: NorthAmerica, Latitude: 45.59, Longitude: -121.18}, // Oregon
+	{Cloud: GCP, Region: "us-west2"}:                {Continent: NorthAmerica, Latitude: 34.05, Longitude: -118.24}, // Los Angeles
+	{Cloud: GCP, Region: "us-west3"}:                {Continent: NorthAmerica, Latitude: 40.76, Longitude: -111.89}, // Salt Lake City
+	{Cloud: GCP, Region: "us-west4"}:                {Continent: NorthAmerica, Latitude: 36.17, Longitude: -115.14}, // Las Vegas
+
+	// https://learn.microsoft.com/en-us/azure/reliability/regions-list
+	{Cloud: Azure, Region: "australiacentral"}:   {Continent: Oceania, Latitude: -35.28, Longitude: 149.13},      // Canberra
+	{Cloud: Azure, Region: "australiacentral2"}:  {Continent: Oceania, Latitude: -35.28, Longitude: 149.13},      // Canberra
+	{Cloud: Azure, Region: "australiaeast"}:      {Continent: Oceania, Latitude: -33.87, Longitude: 151.21},      // New South Wales
+	{Cloud: Azure, Region: "australiasoutheast"}: {Continent: Oceania, Latitude: -37.81, Longitude: 144.96},      // Victoria
+	{Cloud: Azure, Region: "brazilsouth"}:        {Continent: SouthAmerica, Latitude: -23.55, Longitude: -46.63}, // Sao Paulo
+	{Cloud: Azure, Region: "brazilsoutheast"}:    {Continent: SouthAmerica, Latitude: -22.91, Longitude: -43.17}, // Rio
+	{Cloud: Azure, Region: "canadacentral"}:      {Continent: NorthAmerica, Latitude: 43.65, Longitude: -79.38},  // Toronto
+	{Cloud: Azure, Region: "canadaeast"}:         {Continent: NorthAmerica, Latitude: 46.81, Longitude: -71.21},  // Quebec City
+	{Cloud: Azure, Region: "centralindia"}:       {Continent: Asia, Latitude: 18.52, Longitude: 73.86},           // Pune
+	{Cloud: Azure, Region: "centralus"}:          {Continent: NorthAmerica, Latitude: 41.59, Longitude: -93.60},  // Iowa
+	{Cloud: Azure, Region: "eastasia"}:           {Continent: Asia, Latitude: 22.32, Longitude: 114.17},          // Hong Kong
+	{Cloud: Azure, Region: "eastus"}:             {Continent: NorthAmerica, Latitude: 37.37, Longitude: -79.82},  // Virginia
+	{Cloud: Azure, Region: "eastus2"}:            {Continent: NorthAmerica, Latitude: 36.67, Longitude: -78.39},  // Virginia
+	{Cloud: Azure, Region: "francecentral"}:      {Continent: Europe, Latitude: 48.86, Longitude: 2.35},          // Paris
+	{Cloud: Azure, Region: "francesouth"}:        {Continent: Europe, Latitude: 43.30, Longitude: 5.37},          // Marseille
+	{Cloud: Azure, Region: "germanynorth"}:       {Continent: Europe, Latitude: 52.52, Longitude: 13.40},         // Berlin
+	{Cloud: Azure, Region: "germanywestcentral"}: {Continent: Europe, Latitude: 50.11, Longitude: 8.68},          // Frankfurt
+	{Cloud: Azure, Region: "israelcentral"}:      {Continent: Asia, Latitude: 32.09, Longitude: 34.78},           // Israel
+	{Cloud: Azure, Region: "italynorth"}:         {Continent: Europe, Latitude: 45.46, Longitude: 9.19},          // Milan
+	{Cloud: Azure, Region: "japaneast"}:          {Continent: Asia, Latitude: 35.68, Longitude: 139.69},          // Tokyo
+	{Cloud: Azure, Region: "japanwest"}:          {Continent: Asia, Latitude: 34.69, Longitude: 135.50},          // Osaka
+	{Cloud: Azure, Region: "jioindiacentral"}:    {Continent: Asia, Latitude: 21.15, Longitude: 79.09},           // Nagpur
+	{Cloud: Azure, Region: "jioindiawest"}:       {Continent: Asia, Latitude: 22.47, Longitude: 70.06},           // Jamnagar
+	{Cloud: Azure, Region: "koreacentral"}:       {Continent: Asia, Latitude: 37.57, Longitude: 126.98},          // Seoul
+	{Cloud: Azure, Region: "koreasouth"}:         {Continent: Asia, Latitude: 35.18, Longitude: 129.08},          // Busan
+	{Cloud: Azure, Region: "mexicocentral"}:      {Continent: NorthAmerica, Latitude: 20.59, Longitude: -100.39}, // Queretaro
+	{Cloud: Azure, Region: "newzealandnorth"}:    {Continent: Oceania, Latitude: -36.85, Longitude: 174.76},      // Auckland
+	{Cloud: Azure, Region: "northcentralus"}:     {Continent: NorthAmerica, Latitude: 41.88, Longitude: -87.63},  // Illinois
+	{Cloud: Azure, Region: "northeurope"}:        {Continent: Europe, Latitude: 53.35, Longitude: -6.26},         // Ireland
+	{Cloud: Azure, Region: "norwayeast"}:         {Continent: Europe, Latitude: 59.91, Longitude: 10.75},         // Oslo
+	{Cloud: Azure, Region: "norwaywest"}:         {Continent: Europe, Latitude: 58.97, Longitude: 5.73},          // Stavanger
+	{Cloud: Azure, Region: "polandcentral"}:      {Continent: Europe, Latitude: 52.23, Longitude: 21.01},         // Warsaw
+	{Cloud: Azure, Region: "qatarcentral"}:       {Continent: Asia, Latitude: 25.29, Longitude: 51.53},           // Doha
+	{Cloud: Azure, Region: "southafricanorth"}:   {Continent: Africa, Latitude: -26.20, Longitude: 28.05},        // Johannesburg
+	{Cloud: Azure, Region: "southafricawest"}:    {Continent: Africa, Latitude: -33.92, Longitude: 18.42},        // Cape Town
+	{Cloud: Azure, Region: "southcentralus"}:     {Continent: NorthAmerica, Latitude: 29.42, Longitude: -98.49},  // Texas
+	{Cloud: Azure, Region: "southeastasia"}:      {Continent: Asia, Latitude: 1.35, Longitude: 103.82},           // Singapore
+	{Cloud: Azure, Region: "southindia"}:         {Continent: Asia, Latitude: 13.08, Longitude: 80.27},           // Chennai
+	{Cloud: Azure, Region: "spaincentral"}:       {Continent: Europe, Latitude: 40.42, Longitude: -3.70},         // Madrid
+	{Cloud: Azure, Region: "swedencentral"}:      {Continent: Europe, Latitude: 60.67, Longitude: 17.14},         // Gavle
+	{Cloud: Azure, Region: "switzerlandnorth"}:   {Continent: Europe, Latitude: 47.38, Longitude: 8.54},          // Zurich
+	{Cloud: Azure, Region: "switzerlandwest"}:    {Continent: Europe, Latitude: 46.20, Longitude: 6.14},          // Geneva
+	{Cloud: Azure, Region: "uaecentral"}:         {Continent: Asia, Latitude: 24.45, Longitude: 54.38},           // Abu Dhabi
+	{Cloud: Azure, Region: "uaenorth"}:           {Continent: Asia, Latitude: 25.20, Longitude: 55.27},           // Dubai
+	{Cloud: Azure, Region: "uksouth"}:            {Continent: Europe, Latitude: 51.51, Longitude: -0.13},         // London
+	{Cloud: Azure, Region: "ukwest"}:             {Continent: Europe, Latitude: 51.48, Longitude: -3.18},         // Cardiff
+	{Cloud: Azure, Region: "westcentralus"}:      {Continent: NorthAmerica, Latitude: 41.14, Longitude: -104.82}, // Wyoming
+	{Cloud: Azure, Region: "westeurope"}:         {Continent: Europe, Latitude: 52.37, Longitude: 4.90},          // Netherlands
+	{Cloud: Azure, Region: "westindia"}:          {Continent: Asia, Latitude: 19.08, Longitude: 72.88},           // Mumbai
+	{Cloud: Azure, Region: "westus"}:             {Continent: NorthAmerica, Latitude: 37.77, Longitude: -122.42}, // California
+	{Cloud: Azure, Region: "westus2"}:            {Continent: NorthAmerica, Latitude: 47.23, Longitude: -119.85}, // Washington
+	{Cloud: Azure, Region: "westus3"}:            {Continent: NorthAmerica, Latitude: 33.45, Longitude: -112.07}, // Phoenix
+}
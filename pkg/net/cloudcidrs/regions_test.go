@@ -0,0 +1,86 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudcidrs
+
+import (
+	"math"
+	"testing"
+)
+
+// regions we do not expect to have RegionInfo
+var regionsWithoutInfo = map[IPInfo]bool{
+	// global meta regions
+	{Cloud: AWS, Region: "GLOBAL"}: true,
+	{Cloud: GCP, Region: "global"}: true,
+	// GCP does not document where these are
+	{Cloud: GCP, Region: "us-east7"}: true,
+	{Cloud: GCP, Region: "us-west8"}: true,
+}
+
+func TestGetRegionInfo(t *testing.T) {
+	continents := map[string]bool{
+		Africa: true, Asia: true, Europe: true, NorthAmerica: true, Oceania: true, SouthAmerica: true,
+	}
+	for _, info := range AllIPInfos() {
+		r, ok := GetRegionInfo(info)
+		if ok == regionsWithoutInfo[info] {
+			t.Errorf("unexpected RegionInfo presence for %+v: %v, add it to regionInfos", info, ok)
+			continue
+		}
+		if ok && (!continents[r.Continent] ||
+			r.Latitude < -90 || r.Latitude > 90 || r.Longitude < -180 || r.Longitude > 180) {
+			t.Errorf("invalid RegionInfo for %+v: %+v", info, r)
+		}
+	}
+	// ensure we drop regions that are gone from the IP range data,
+	// for clouds whose IP range data is generated
+	generatedClouds := map[string]bool{}
+	for info := range regionToRanges {
+		generatedClouds[info.Cloud] = true
+	}
+	for info := range regionInfos {
+		if _, ok := regionToRanges[info]; !ok && generatedClouds[info.Cloud] {
+			t.Errorf("RegionInfo for unknown region %+v", info)
+		}
+	}
+}
+
+func TestRegionInfoDistanceKm(t *testing.T) {
+	dublin, _ := GetRegionInfo(IPInfo{Cloud: AWS, Region: "eu-west-1"})
+	london, _ := GetRegionInfo(IPInfo{Cloud: AWS, Region: "eu-west-2"})
+	sydney, _ := GetRegionInfo(IPInfo{Cloud: AWS, Region: "ap-southeast-2"})
+	testCases := []struct {
+		Name     string
+		From, To RegionInfo
+		Expected float64
+	}{
+		{Name: "same place", From: dublin, To: dublin, Expected: 0},
+		{Name: "Dublin to London", From: dublin, To: london, Expected: 464},
+		{Name: "London to Sydney", From: london, To: sydney, Expected: 16990},
+		{Name: "Sydney to London", From: sydney, To: london, Expected: 16990},
+	}
+	for i := range testCases {
+		tc := testCases[i]
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			// within 1%
+			if d := tc.From.DistanceKm(tc.To); math.Abs(d-tc.Expected) > tc.Expected/100 {
+				t.Fatalf("expected about %vkm, got: %vkm", tc.Expected, d)
+			}
+		})
+	}
+}
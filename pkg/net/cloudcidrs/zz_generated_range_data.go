@@ -25,6 +25,9 @@ import (
 // AWS cloud
 const AWS = "AWS"
 
+// Azure cloud
+const Azure = "Azure"
+
 // GCP cloud
 const GCP = "GCP"
 